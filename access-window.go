@@ -0,0 +1,221 @@
+package mwgp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Access windows grant the time-limited access to the peers, such as for the contractors,
+// the peers are expired once the window closes, instead of after the Timeout.
+
+const (
+	kMinutesPerDay  = 24 * 60
+	kMinutesPerWeek = 7 * kMinutesPerDay
+)
+
+var weekdayNames = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// AccessWindow is the time range and the weekly schedule of a peer, a nil one allows any time.
+type AccessWindow struct {
+	// zero if unbounded
+	notBefore time.Time
+	notAfter  time.Time
+
+	// the ranges in minutes since Monday 00:00 in location, empty if there is no schedule
+	schedule []scheduleRange
+	location *time.Location
+}
+
+// scheduleRange is [start, end) in minutes of a week, they never wrap around.
+type scheduleRange struct {
+	start int
+	end   int
+}
+
+// NewAccessWindow parses the RFC 3339 timestamps and the weekly schedule,
+// such as "Mon-Fri 09:00-18:00" or "Sat 22:00-02:00", in the IANA time zone (default to UTC).
+// it returns nil if there is no restriction.
+func NewAccessWindow(notBefore string, notAfter string, schedule []string, timezone string) (w *AccessWindow, err error) {
+	if notBefore == "" && notAfter == "" && len(schedule) == 0 {
+		if timezone != "" {
+			err = fmt.Errorf("schedule_tz requires schedule")
+		}
+		return
+	}
+	w = &AccessWindow{
+		location: time.UTC,
+	}
+	if notBefore != "" {
+		w.notBefore, err = time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			err = fmt.Errorf("invalid not_before %s: %w", notBefore, err)
+			return
+		}
+	}
+	if notAfter != "" {
+		w.notAfter, err = time.Parse(time.RFC3339, notAfter)
+		if err != nil {
+			err = fmt.Errorf("invalid not_after %s: %w", notAfter, err)
+			return
+		}
+		if !w.notBefore.IsZero() && !w.notAfter.After(w.notBefore) {
+			err = fmt.Errorf("not_after %s is not after not_before %s", notAfter, notBefore)
+			return
+		}
+	}
+	if timezone != "" {
+		w.location, err = time.LoadLocation(timezone)
+		if err != nil {
+			err = fmt.Errorf("invalid schedule_tz %s: %w", timezone, err)
+			return
+		}
+	}
+	for _, s := range schedule {
+		var ranges []scheduleRange
+		ranges, err = parseScheduleRanges(s)
+		if err != nil {
+			err = fmt.Errorf("invalid schedule %s: %w", s, err)
+			return
+		}
+		w.schedule = append(w.schedule, ranges...)
+	}
+	return
+}
+
+// parseScheduleRanges parses "Mon-Fri 09:00-18:00" into a range for every day,
+// a range ending before it starts continues into the next day.
+func parseScheduleRanges(s string) (ranges []scheduleRange, err error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		err = fmt.Errorf("expected \"<days> <HH:MM>-<HH:MM>\"")
+		return
+	}
+	firstDay, lastDay, err := parseWeekdayRange(fields[0])
+	if err != nil {
+		return
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		err = fmt.Errorf("invalid time range %s", fields[1])
+		return
+	}
+	start, err := parseMinuteOfDay(times[0])
+	if err != nil {
+		return
+	}
+	end, err := parseMinuteOfDay(times[1])
+	if err != nil {
+		return
+	}
+	if end <= start {
+		end += kMinutesPerDay
+	}
+	for day := firstDay; ; day = (day + 1) % 7 {
+		r := scheduleRange{
+			start: day*kMinutesPerDay + start,
+			end:   day*kMinutesPerDay + end,
+		}
+		if r.end > kMinutesPerWeek {
+			// from Sunday into Monday
+			ranges = append(ranges, scheduleRange{start: 0, end: r.end - kMinutesPerWeek})
+			r.end = kMinutesPerWeek
+		}
+		ranges = append(ranges, r)
+		if day == lastDay {
+			break
+		}
+	}
+	return
+}
+
+// parseWeekdayRange parses "Mon" or "Mon-Fri" into the days since Monday.
+func parseWeekdayRange(s string) (first int, last int, err error) {
+	days := strings.Split(s, "-")
+	if len(days) > 2 {
+		err = fmt.Errorf("invalid days %s", s)
+		return
+	}
+	parsed := make([]int, len(days))
+	for i, day := range days {
+		parsed[i] = -1
+		for d, name := range weekdayNames {
+			if strings.EqualFold(day, name) {
+				parsed[i] = d
+			}
+		}
+		if parsed[i] < 0 {
+			err = fmt.Errorf("invalid day %s, must be one of %s", day, strings.Join(weekdayNames, ", "))
+			return
+		}
+	}
+	first = parsed[0]
+	last = parsed[len(parsed)-1]
+	return
+}
+
+// parseMinuteOfDay parses "HH:MM", "24:00" is the end of the day.
+func parseMinuteOfDay(s string) (minute int, err error) {
+	var hour, minuteOfHour int
+	_, err = fmt.Sscanf(s, "%d:%d", &hour, &minuteOfHour)
+	if err != nil || hour < 0 || minuteOfHour < 0 || minuteOfHour >= 60 || hour*60+minuteOfHour > kMinutesPerDay {
+		err = fmt.Errorf("invalid time %s", s)
+		return
+	}
+	minute = hour*60 + minuteOfHour
+	return
+}
+
+// minuteOfWeek returns the minutes since Monday 00:00 and the start of that minute.
+func (w *AccessWindow) minuteOfWeek(now time.Time) (minute int, minuteStart time.Time) {
+	local := now.In(w.location)
+	weekday := (int(local.Weekday()) + 6) % 7
+	minute = weekday*kMinutesPerDay + local.Hour()*60 + local.Minute()
+	minuteStart = now.Truncate(time.Minute)
+	return
+}
+
+func (w *AccessWindow) Allows(now time.Time) bool {
+	if w == nil {
+		return true
+	}
+	if !w.notBefore.IsZero() && now.Before(w.notBefore) {
+		return false
+	}
+	if !w.notAfter.IsZero() && !now.Before(w.notAfter) {
+		return false
+	}
+	if len(w.schedule) == 0 {
+		return true
+	}
+	minute, _ := w.minuteOfWeek(now)
+	for _, r := range w.schedule {
+		if minute >= r.start && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// closesAt returns the time to check the window again if it allows now, which is not later than it closes.
+// it is zero if the window never closes.
+func (w *AccessWindow) closesAt(now time.Time) (closes time.Time) {
+	if w == nil {
+		return
+	}
+	closes = w.notAfter
+	if len(w.schedule) == 0 {
+		return
+	}
+	minute, minuteStart := w.minuteOfWeek(now)
+	for _, r := range w.schedule {
+		if minute >= r.start && minute < r.end {
+			end := minuteStart.Add(time.Duration(r.end-minute) * time.Minute)
+			if closes.IsZero() || end.Before(closes) {
+				closes = end
+			}
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package mwgp
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessWindow(t *testing.T) {
+	w, err := NewAccessWindow("2024-01-01T00:00:00Z", "2024-03-01T00:00:00Z",
+		[]string{"Mon-Fri 09:00-18:00", "Sun 22:00-02:00"}, "Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	for _, c := range []struct {
+		time    time.Time
+		allowed bool
+		closes  time.Time
+	}{
+		// Thursday
+		{time.Date(2024, 2, 29, 9, 0, 0, 0, shanghai), true, time.Date(2024, 2, 29, 18, 0, 0, 0, shanghai)},
+		{time.Date(2024, 2, 29, 18, 0, 0, 0, shanghai), false, time.Time{}},
+		// Sunday night into Monday
+		{time.Date(2024, 2, 25, 23, 30, 0, 0, shanghai), true, time.Date(2024, 2, 26, 0, 0, 0, 0, shanghai)},
+		{time.Date(2024, 2, 26, 1, 59, 30, 0, shanghai), true, time.Date(2024, 2, 26, 2, 0, 0, 0, shanghai)},
+		{time.Date(2024, 2, 26, 2, 0, 0, 0, shanghai), false, time.Time{}},
+		// out of not_before and not_after
+		{time.Date(2023, 12, 29, 10, 0, 0, 0, shanghai), false, time.Time{}},
+		{time.Date(2024, 3, 1, 10, 0, 0, 0, shanghai), false, time.Time{}},
+	} {
+		if w.Allows(c.time) != c.allowed {
+			t.Errorf("%s: expected allowed %v", c.time, c.allowed)
+			continue
+		}
+		if c.allowed && !w.closesAt(c.time).Equal(c.closes) {
+			t.Errorf("%s: expected to close at %s, got %s", c.time, c.closes, w.closesAt(c.time))
+		}
+	}
+
+	for _, schedule := range []string{"Mon 09:00", "Mon-Fri-Sat 09:00-18:00", "Foo 09:00-18:00", "Mon 09:00-25:00"} {
+		_, err = NewAccessWindow("", "", []string{schedule}, "")
+		if err == nil {
+			t.Errorf("expected invalid schedule %s", schedule)
+		}
+	}
+	w, err = NewAccessWindow("", "", nil, "")
+	if w != nil || err != nil {
+		t.Errorf("expected no access window, got %v, %v", w, err)
+	}
+}
+
+func TestWireGuardIndexTranslationTable_ExpireAccessWindow(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	now := time.Now()
+	table.expireWheel = newExpireWheel(table.Timeout, now)
+
+	// the window closes before the peer is idle for the Timeout
+	notAfter := now.Add(table.Timeout / 4).Truncate(time.Second).Add(time.Second)
+	access, err := NewAccessWindow("", notAfter.Format(time.RFC3339), nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &Peer{clientProxyIndex: 1, access: access}
+	peer.touch(now)
+	table.clientMap.Store(peer.clientProxyIndex, peer)
+	table.expireWheel.Schedule(peer, peer.expireCheckTime(table.Timeout, now))
+
+	tick := table.expireWheel.tick
+	peer.touch(notAfter)
+	table.handlePeersExpireCheck(notAfter.Add(-tick))
+	if table.clientMap.Len() != 1 {
+		t.Fatal("peer expired before the window closes")
+	}
+	table.handlePeersExpireCheck(notAfter.Add(tick))
+	if table.clientMap.Len() != 0 {
+		t.Error("peer not expired after the window closes")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_RestoreCachedPeers(t *testing.T) {
+	var serverPrivateKey, expiredPrivateKey, restoredPrivateKey, unknownPrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	_ = expiredPrivateKey.FromBase64("MB0pM6NZg0bO3QjUkPqgAtXzV1Tb2hnHO1SC3QGOQ1Q=")
+	_ = restoredPrivateKey.FromBase64("sJtkS0WB8U3A8nZp7tJqVDTn62z5bCvcNt0qMUlgE3A=")
+	_ = unknownPrivateKey.FromBase64("YEc3ZTo6/hxS7h2T4Ol9kHj3Dqz1dM1wJxUuM7KQh0Q=")
+	expiredPublicKey := expiredPrivateKey.PublicKey()
+	restoredPublicKey := restoredPrivateKey.PublicKey()
+
+	now := time.Now()
+	server := &ServerConfigServer{
+		PrivateKey: &serverPrivateKey,
+		Address:    "127.0.0.1",
+		Peers: []*ServerConfigPeer{
+			{ClientPublicKey: &expiredPublicKey, ForwardTo: ":1001", NotAfter: now.Add(-time.Hour).Format(time.RFC3339)},
+			{ClientPublicKey: &restoredPublicKey, ForwardTo: ":1001", NotAfter: now.Add(time.Hour).Format(time.RFC3339), AllowFrom: []string{"192.0.2.0/24"}},
+		},
+	}
+	err := server.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{servers: []*ServerConfigServer{server}}
+
+	// the peers were created before the restart
+	cacheFilePath := filepath.Join(t.TempDir(), "cache.json")
+	cached := NewWireGuardIndexTranslationTable()
+	cached.CacheJar.CacheFilePath = cacheFilePath
+	for i, privateKey := range []NoisePrivateKey{expiredPrivateKey, restoredPrivateKey, unknownPrivateKey} {
+		peer := &Peer{
+			clientPublicKey:   privateKey.PublicKey(),
+			serverPublicKey:   serverPrivateKey.PublicKey(),
+			clientOriginIndex: uint32(i + 1),
+			clientProxyIndex:  uint32(i + 1),
+			serverOriginIndex: uint32(i + 1),
+			serverProxyIndex:  uint32(i + 1),
+			clientDestination: netip.MustParseAddrPort("192.0.2.1:51820"),
+			serverDestination: netip.MustParseAddrPort("127.0.0.1:1001"),
+		}
+		cached.clientMap.Store(peer.clientProxyIndex, peer)
+	}
+	err = cached.CacheJar.SaveLocked(cached.clientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := NewWireGuardIndexTranslationTable()
+	table.CacheJar.CacheFilePath = cacheFilePath
+	table.RestorePeerFunc = s.restorePeer
+	err = table.CacheJar.LoadLocked(table.serverMap, table.clientMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.restoreCachedPeersLocked()
+
+	if table.clientMap.Len() != 1 || table.serverMap.Len() != 1 {
+		t.Fatalf("expected only the peer allowed by the config, got %d", table.clientMap.Len())
+	}
+	peer, ok := table.clientMap.Load(2)
+	if !ok {
+		t.Fatal("the peer allowed by the config is dropped")
+	}
+	if peer.access == nil || peer.access.Allows(now.Add(2*time.Hour)) {
+		t.Error("the access window is not restored")
+	}
+	if peer.sourceFilter.Allows(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("the source filter is not restored")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"time"
 )
@@ -26,20 +26,30 @@ type WGITCachePeer struct {
 	ServerDestination         string         `json:"sdst"`
 	ServerSourceValidateLevel int            `json:"ssvl"`
 	ObfuscateEnabled          bool           `json:"obfe"`
+	ClientLocal               string         `json:"cloc,omitempty"`
+	ClientLocalIP             string         `json:"clip,omitempty"`
 }
 
 func (cp *WGITCachePeer) FromWGITPeer(peer *Peer) (err error) {
 	cp.ClientOriginIndex = peer.clientOriginIndex
 	cp.ClientProxyIndex = peer.clientProxyIndex
 	cp.ClientPublicKey = peer.clientPublicKey
+	peer.endpointLock.RLock()
 	cp.ClientDestination = peer.clientDestination.String()
+	if addr := transportLocalAddr(peer.clientTransport); addr != nil {
+		cp.ClientLocal = addr.String()
+	}
+	if peer.clientLocal.IsValid() {
+		cp.ClientLocalIP = peer.clientLocal.String()
+	}
+	peer.endpointLock.RUnlock()
 	cp.ClientSourceValidateLevel = peer.clientSourceValidateLevel
 
 	cp.ServerOriginIndex = peer.serverOriginIndex
 	cp.ServerProxyIndex = peer.serverProxyIndex
 	cp.ServerPublicKey = peer.serverPublicKey
-	if peer.serverDestination != nil {
-		cp.ServerDestination = peer.serverDestination.String()
+	if serverDestination := peer.currentServerDestination(); serverDestination.IsValid() {
+		cp.ServerDestination = serverDestination.String()
 	}
 	cp.ServerSourceValidateLevel = peer.serverSourceValidateLevel
 
@@ -58,7 +68,7 @@ func (cp *WGITCachePeer) WGITPeer() (peer *Peer, err error) {
 		err = fmt.Errorf("client destination cannot be empty")
 		return
 	}
-	peer.clientDestination, err = net.ResolveUDPAddr("udp", cp.ClientDestination)
+	peer.clientDestination, err = netip.ParseAddrPort(cp.ClientDestination)
 	if err != nil {
 		return
 	}
@@ -71,7 +81,7 @@ func (cp *WGITCachePeer) WGITPeer() (peer *Peer, err error) {
 		err = fmt.Errorf("server destination cannot be empty")
 		return
 	}
-	peer.serverDestination, err = net.ResolveUDPAddr("udp", cp.ServerDestination)
+	peer.serverDestination, err = netip.ParseAddrPort(cp.ServerDestination)
 	if err != nil {
 		return
 	}
@@ -80,9 +90,16 @@ func (cp *WGITCachePeer) WGITPeer() (peer *Peer, err error) {
 	peer.clientCookieGenerator.Init(peer.clientPublicKey.NoisePublicKey)
 	peer.serverCookieGenerator.Init(peer.serverPublicKey.NoisePublicKey)
 
-	peer.lastActive.Store(time.Now())
+	peer.touch(time.Now())
 
 	peer.obfuscateEnabled = cp.ObfuscateEnabled
+	peer.cachedClientLocal = cp.ClientLocal
+	if cp.ClientLocalIP != "" {
+		peer.clientLocal, err = netip.ParseAddr(cp.ClientLocalIP)
+		if err != nil {
+			return
+		}
+	}
 
 	return
 }
@@ -95,22 +112,23 @@ type WGITCacheJar struct {
 	WGITCacheConfig
 }
 
-func (c *WGITCacheJar) SaveLocked(clientMap map[uint32]*Peer) (err error) {
+func (c *WGITCacheJar) SaveLocked(clientMap *peerIndexMap) (err error) {
 	if c.CacheFilePath == "" {
 		return
 	}
 
 	ct := WGITCacheTable{}
 
-	for _, peer := range clientMap {
+	clientMap.Range(func(index uint32, peer *Peer) bool {
 		cp := WGITCachePeer{}
 		ferr := cp.FromWGITPeer(peer)
 		if ferr != nil {
 			log.Printf("[error] failed to convert peer to cache peer: %s\n", ferr.Error())
-			continue
+			return true
 		}
 		ct.ClientMap = append(ct.ClientMap, cp)
-	}
+		return true
+	})
 
 	bs, err := json.MarshalIndent(&ct, "", "  ")
 	if err != nil {
@@ -133,7 +151,7 @@ func (c *WGITCacheJar) SaveLocked(clientMap map[uint32]*Peer) (err error) {
 	return
 }
 
-func (c *WGITCacheJar) LoadLocked(serverMap map[uint32]*Peer, clientMap map[uint32]*Peer) (err error) {
+func (c *WGITCacheJar) LoadLocked(serverMap *peerIndexMap, clientMap *peerIndexMap) (err error) {
 	if c.CacheFilePath == "" {
 		return
 	}
@@ -160,9 +178,9 @@ func (c *WGITCacheJar) LoadLocked(serverMap map[uint32]*Peer, clientMap map[uint
 			log.Printf("[error] failed to convert cache peer to peer: %s\n", ferr.Error())
 			continue
 		}
-		clientMap[peer.clientProxyIndex] = peer
+		clientMap.Store(peer.clientProxyIndex, peer)
 		if peer.serverProxyIndex != 0 {
-			serverMap[peer.serverProxyIndex] = peer
+			serverMap.Store(peer.serverProxyIndex, peer)
 		}
 	}
 
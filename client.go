@@ -6,22 +6,51 @@ import (
 	"golang.zx2c4.com/wireguard/device"
 	"log"
 	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ClientConfig struct {
-	Server                    string         `json:"server"`
-	Listen                    string         `json:"listen"`
-	Timeout                   int            `json:"timeout,omitempty"`
-	Resolver                  string         `json:"resolver,omitempty"`
-	ClientSourceValidateLevel int            `json:"csvl,omitempty"`
-	ServerSourceValidateLevel int            `json:"ssvl,omitempty"`
-	MaxPacketSize             int            `json:"max_packet_size,omitempty"`
-	ClientPublicKey           NoisePublicKey `json:"client_pubkey"`
-	ServerPublicKey           NoisePublicKey `json:"server_pubkey"`
-	ObfuscateKey              string         `json:"obfs"`
+	Server                    string                  `json:"server"`
+	Listen                    string                  `json:"listen"`
+	Timeout                   int                     `json:"timeout,omitempty"`
+	Resolver                  string                  `json:"resolver,omitempty"`
+	ClientSourceValidateLevel int                     `json:"csvl,omitempty"`
+	ServerSourceValidateLevel int                     `json:"ssvl,omitempty"`
+	MaxPacketSize             int                     `json:"max_packet_size,omitempty"`
+	ClientPublicKey           NoisePublicKey          `json:"client_pubkey"`
+	ServerPublicKey           NoisePublicKey          `json:"server_pubkey"`
+	ObfuscateKey              string                  `json:"obfs"`
+	ObfuscateMimicry          string                  `json:"obfs_mimicry,omitempty"`
+	ObfuscatePadding          *ObfuscatePaddingConfig `json:"obfs_padding,omitempty"`
 	WGITCacheConfig
 
+	// HopInterval switches to another port in the port range of server every HopInterval seconds.
+	HopInterval int `json:"hop_interval,omitempty"`
+
+	// HopPackets switches to another port in the port range of server every HopPackets packets sent.
+	HopPackets int `json:"hop_packets,omitempty"`
+
+	// HopSourcePort also switches the local source port on every hop.
+	HopSourcePort bool `json:"hop_source_port,omitempty"`
+
+	// Transport is the transport to mwgp-server, can be "udp" (default), "tcp" or "ws".
+	Transport string `json:"transport,omitempty"`
+
+	// WebSocketURL is the URL of the WebSocket endpoint of mwgp-server, such as "wss://example.com/mwgp",
+	// required by the "ws" transport. The server address is default to the host of it.
+	WebSocketURL string `json:"ws_url,omitempty"`
+
+	// ListenSocketOptions are the socket options of the listen socket to the WireGuard client (optional).
+	ListenSocketOptions *SocketOptions `json:"listen_sockopt,omitempty"`
+
+	// ServerSocketOptions are the socket options of the sockets to mwgp-server (optional),
+	// such as the fwmark to keep the packets from looping back into the WireGuard interface.
+	ServerSocketOptions *SocketOptions `json:"server_sockopt,omitempty"`
+
 	// Deprecated: use Resolver instead
 	DNS string `json:"dns,omitempty"`
 }
@@ -29,15 +58,49 @@ type ClientConfig struct {
 type Client struct {
 	wgitTable        *WireGuardIndexTranslationTable
 	server           string
+	listen           *net.UDPAddr
 	cachedServerPeer ServerConfigPeer
 	resolver         UDPAddrResolver
+	obfuscator       *WireGuardObfuscator
+
+	listenSocketOptions *SocketOptions
+	serverSocketOptions *SocketOptions
+
+	// for stream transports only
+	streamDialFunc func(destination *net.UDPAddr) (stream datagramStream, err error)
+
+	// for port hopping only
+	hopper        *portHopper
+	hopSourcePort bool
+	// the packet-based hops requested by the writers, handled by hopLoop
+	hopChan    chan struct{}
+	hopPending int32
+
+	// resolved server address, without the port hopping applied
+	serverAddr     netip.AddrPort
+	serverAddrLock sync.Mutex
+	// serializes updateServerDestination, so the updates are sent in order without serverAddrLock
+	serverUpdateLock sync.Mutex
 }
 
 func NewClientWithConfig(config *ClientConfig) (outClient *Client, err error) {
 	client := Client{}
-	client.server = config.Server
+	serverAddress := config.Server
+	if serverAddress == "" && config.Transport == TransportWebSocket {
+		serverAddress, err = webSocketURLHostPort(config.WebSocketURL)
+		if err != nil {
+			err = fmt.Errorf("invalid ws_url %s: %w", config.WebSocketURL, err)
+			return
+		}
+	}
+	serverHost, serverPortStart, serverPortEnd, err := splitHostPortRange(serverAddress)
+	if err != nil {
+		err = fmt.Errorf("invalid server address %s: %w", serverAddress, err)
+		return
+	}
+	client.server = net.JoinHostPort(serverHost, strconv.Itoa(serverPortStart))
 	client.wgitTable = NewWireGuardIndexTranslationTable()
-	client.wgitTable.ClientListen, err = net.ResolveUDPAddr("udp", config.Listen)
+	client.listen, err = net.ResolveUDPAddr("udp", config.Listen)
 	if err != nil {
 		err = fmt.Errorf("invalid listen address %s: %w", config.Listen, err)
 		return
@@ -49,8 +112,26 @@ func NewClientWithConfig(config *ClientConfig) (outClient *Client, err error) {
 		client.wgitTable.MaxPacketSize = uint(config.MaxPacketSize)
 	}
 	client.wgitTable.ExtractPeerFunc = client.generateServerPeer
+	if config.ListenSocketOptions != nil {
+		err = config.ListenSocketOptions.Validate()
+		if err != nil {
+			err = fmt.Errorf("invalid listen_sockopt: %w", err)
+			return
+		}
+		client.listenSocketOptions = config.ListenSocketOptions
+	}
+	if config.ServerSocketOptions != nil {
+		err = config.ServerSocketOptions.Validate()
+		if err != nil {
+			err = fmt.Errorf("invalid server_sockopt: %w", err)
+			return
+		}
+		client.serverSocketOptions = config.ServerSocketOptions
+	}
 	client.cachedServerPeer.serverPublicKey = config.ServerPublicKey
 	client.cachedServerPeer.ClientPublicKey = &config.ClientPublicKey
+	client.cachedServerPeer.ClientSourceValidateLevel = config.ClientSourceValidateLevel
+	client.cachedServerPeer.ServerSourceValidateLevel = config.ServerSourceValidateLevel
 	client.wgitTable.CacheJar.WGITCacheConfig = config.WGITCacheConfig
 	resolver := config.Resolver
 	if config.DNS != "" {
@@ -67,27 +148,205 @@ func NewClientWithConfig(config *ClientConfig) (outClient *Client, err error) {
 		return
 	}
 
+	if serverPortEnd != serverPortStart || config.HopInterval > 0 || config.HopPackets > 0 || config.HopSourcePort {
+		if config.HopInterval < 0 || config.HopPackets < 0 {
+			err = fmt.Errorf("invalid hop_interval or hop_packets")
+			return
+		}
+		if config.HopInterval == 0 && config.HopPackets == 0 {
+			err = fmt.Errorf("port hopping requires hop_interval or hop_packets")
+			return
+		}
+		seed := []byte(config.ObfuscateKey)
+		if len(seed) == 0 {
+			seed = config.ServerPublicKey.NoisePublicKey[:]
+		}
+		client.hopper = newPortHopper(serverPortStart, serverPortEnd,
+			time.Duration(config.HopInterval)*time.Second, uint64(config.HopPackets), seed)
+		client.hopSourcePort = config.HopSourcePort
+		client.hopChan = make(chan struct{}, 1)
+		if serverPortEnd != serverPortStart {
+			// the server replies from the port we sent to,
+			// which is changing along with the hopping.
+			switch client.cachedServerPeer.ServerSourceValidateLevel {
+			case SourceValidateLevelDefault, SourceValidateLevelIPAndPort:
+				client.cachedServerPeer.ServerSourceValidateLevel = SourceValidateLevelIP
+			}
+		}
+	}
+
+	switch config.Transport {
+	case "", TransportUDP:
+	case TransportTCP, TransportWebSocket:
+		if client.hopper != nil {
+			err = fmt.Errorf("port hopping is not supported by the %s transport", config.Transport)
+			return
+		}
+		client.streamDialFunc = newTCPDatagramStreamDialer(client.serverSocketOptions)
+		if config.Transport == TransportWebSocket {
+			if config.WebSocketURL == "" {
+				err = fmt.Errorf("ws transport requires ws_url")
+				return
+			}
+			client.streamDialFunc, err = newWebSocketDatagramStreamDialer(config.WebSocketURL, client.serverSocketOptions)
+			if err != nil {
+				err = fmt.Errorf("invalid ws_url %s: %w", config.WebSocketURL, err)
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown transport: %s", config.Transport)
+		return
+	}
+
 	var obfuscator WireGuardObfuscator
 	obfuscator.Initialize(config.ObfuscateKey)
-	client.wgitTable.ServerWriteToUDPFunc = func(conn *net.UDPConn, packet *Packet) (err error) {
-		packet.Flags |= PacketFlagObfuscateBeforeSend
-		return obfuscator.WriteToUDPWithObfuscate(conn, packet)
+	err = obfuscator.SetMimicry(config.ObfuscateMimicry)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs_mimicry: %w", err)
+		return
 	}
-	client.wgitTable.ServerReadFromUDPFunc = obfuscator.ReadFromUDPWithDeobfuscate
+	err = obfuscator.SetPadding(config.ObfuscatePadding)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs_padding: %w", err)
+		return
+	}
+	obfuscator.packetPool = &client.wgitTable.packetPool
+	client.obfuscator = &obfuscator
 
 	outClient = &client
 	return
 }
 
-func (c *Client) generateServerPeer(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error) {
-	if c.cachedServerPeer.forwardToAddress == nil {
+// newServerTransport creates a transport to mwgp-server.
+func (c *Client) newServerTransport() (transport Transport, err error) {
+	var raw *PacketConnTransport
+	if c.streamDialFunc != nil {
+		raw = NewPacketConnTransport(newStreamClientConn(c.streamDialFunc))
+	} else {
+		raw, err = ListenUDPTransportWithOptions(nil, c.serverSocketOptions)
+		if err != nil {
+			return
+		}
+	}
+	transport = &clientUpstreamTransport{
+		Transport: c.obfuscator.WrapTransport(raw),
+		client:    c,
+	}
+	return
+}
+
+// clientUpstreamTransport obfuscates all packets to mwgp-server, and counts them for port hopping.
+type clientUpstreamTransport struct {
+	Transport
+	client *Client
+}
+
+func (t *clientUpstreamTransport) WritePacket(packet *Packet) (err error) {
+	t.prepare(packet)
+	return t.Transport.WritePacket(packet)
+}
+
+func (t *clientUpstreamTransport) BatchSize() int {
+	return transportBatchSize(t.Transport)
+}
+
+func (t *clientUpstreamTransport) ReadPackets(packets []*Packet) (n int, err error) {
+	return readPackets(t.Transport, packets)
+}
+
+func (t *clientUpstreamTransport) WritePackets(packets []*Packet) (err error) {
+	for _, packet := range packets {
+		t.prepare(packet)
+	}
+	return writePackets(t.Transport, packets)
+}
+
+func (t *clientUpstreamTransport) prepare(packet *Packet) {
+	if t.client.hopper != nil && t.client.hopper.CountPacket() {
+		t.client.requestHop()
+	}
+	packet.Flags |= PacketFlagObfuscateBeforeSend
+}
+
+func (c *Client) generateServerPeer(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error) {
+	// the forward_to address is updated by the hops
+	c.serverAddrLock.Lock()
+	peer := c.cachedServerPeer
+	c.serverAddrLock.Unlock()
+	if !peer.forwardToAddress.IsValid() {
 		err = fmt.Errorf("forward_to address is not resolved yet")
 		return
 	}
-	fi = &c.cachedServerPeer
+	fi = &peer
 	return
 }
 
+// updateServerDestination updates the server destination of all peers
+// with the resolved server address and the current port of port hopping.
+func (c *Client) updateServerDestination() {
+	c.serverUpdateLock.Lock()
+	defer c.serverUpdateLock.Unlock()
+
+	c.serverAddrLock.Lock()
+	if !c.serverAddr.IsValid() {
+		c.serverAddrLock.Unlock()
+		return
+	}
+	sa := c.serverAddr
+	if c.hopper != nil {
+		sa = netip.AddrPortFrom(c.serverAddr.Addr(), uint16(c.hopper.Port()))
+	}
+	changed := c.cachedServerPeer.forwardToAddress != sa
+	c.cachedServerPeer.forwardToAddress = sa
+	c.serverAddrLock.Unlock()
+
+	// the handshakes should not wait for the mainLoop
+	if changed {
+		c.wgitTable.UpdateAllServerDestinationChan <- sa
+	}
+}
+
+// requestHop requests a packet-based hop without blocking, at most one is pending.
+func (c *Client) requestHop() {
+	if atomic.CompareAndSwapInt32(&c.hopPending, 0, 1) {
+		c.hopChan <- struct{}{}
+	}
+}
+
+// hopLoop handles the time-based and the packet-based hops in a single goroutine.
+func (c *Client) hopLoop() {
+	var timerChan <-chan time.Time
+	var timer *time.Timer
+	if c.hopper.interval > 0 {
+		timer = time.NewTimer(time.Until(c.hopper.NextHop()))
+		timerChan = timer.C
+	}
+	for {
+		select {
+		case <-timerChan:
+			timer.Reset(time.Until(c.hopper.NextHop()))
+		case <-c.hopChan:
+			// the packets sent during this hop can request the next one
+			atomic.StoreInt32(&c.hopPending, 0)
+		}
+		c.hop()
+	}
+}
+
+func (c *Client) hop() {
+	c.updateServerDestination()
+	if c.hopSourcePort {
+		transport, err := c.newServerTransport()
+		if err == nil {
+			err = c.wgitTable.ReplaceServerTransport(transport)
+		}
+		if err != nil {
+			log.Printf("[error] failed to switch source port: %s\n", err.Error())
+		}
+	}
+}
+
 func (c *Client) Start() (err error) {
 	go func() {
 		for {
@@ -97,16 +356,30 @@ func (c *Client) Start() (err error) {
 				time.Sleep(10 * time.Second)
 				continue
 			}
-			if c.cachedServerPeer.forwardToAddress == nil ||
-				!c.cachedServerPeer.forwardToAddress.IP.Equal(sa.IP) ||
-				c.cachedServerPeer.forwardToAddress.Port != sa.Port {
-				c.cachedServerPeer.forwardToAddress = sa
-				c.wgitTable.UpdateAllServerDestinationChan <- sa
-			}
+			c.serverAddrLock.Lock()
+			c.serverAddr = addrPortFromUDPAddr(sa)
+			c.serverAddrLock.Unlock()
+			c.updateServerDestination()
 			time.Sleep(5 * time.Minute)
 		}
 	}()
-	log.Printf("[info] listen on %s ...\n", c.wgitTable.ClientListen)
+	if c.hopper != nil {
+		go c.hopLoop()
+	}
+	clientTransport, err := ListenUDPTransportWithOptions(c.listen, c.listenSocketOptions)
+	if err != nil {
+		err = fmt.Errorf("failed to listen on %s: %w", c.listen.String(), err)
+		return
+	}
+	c.wgitTable.ClientTransports = []Transport{clientTransport}
+	serverTransport, err := c.newServerTransport()
+	if err != nil {
+		err = fmt.Errorf("failed to create transport to server: %w", err)
+		return
+	}
+	// mwgp-client serves a single WireGuard peer, so a single worker is enough
+	c.wgitTable.ServerTransports = []Transport{serverTransport}
+	log.Printf("[info] listen on %s ...\n", c.listen)
 	err = c.wgitTable.Serve()
 	return
 }
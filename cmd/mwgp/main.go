@@ -9,7 +9,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	_ "github.com/haruue-net/mwgp/resolvers/dns"
 	_ "github.com/haruue-net/mwgp/resolvers/hn2etxt"
@@ -123,6 +125,16 @@ func startServer(configPath string) (err error) {
 	if err != nil {
 		return
 	}
+	go func() {
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+		<-signalChan
+		err := server.SaveTrafficUsage()
+		if err != nil {
+			log.Printf("[error] failed to save traffic usage: %s\n", err)
+		}
+		os.Exit(0)
+	}()
 	return server.Start()
 }
 
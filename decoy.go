@@ -0,0 +1,118 @@
+package mwgp
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	kDecoyMaxSessions    = 1024
+	kDecoySessionTimeout = 60 * time.Second
+)
+
+// decoyForwarder forwards the packets that cannot be recognized as mwgp packets
+// to a decoy UDP service, and sends its replies back to the prober,
+// so the port looks like the decoy service.
+type decoyForwarder struct {
+	decoyAddr *net.UDPAddr
+
+	// source address -> session
+	sessions     map[netip.AddrPort]*decoySession
+	sessionsLock sync.Mutex
+
+	bufferPool sync.Pool
+}
+
+type decoySession struct {
+	conn       *net.UDPConn
+	lastActive time.Time
+}
+
+func newDecoyForwarder(decoyAddr *net.UDPAddr) (d *decoyForwarder) {
+	d = &decoyForwarder{
+		decoyAddr: decoyAddr,
+		sessions:  make(map[netip.AddrPort]*decoySession),
+	}
+	d.bufferPool.New = func() interface{} {
+		return make([]byte, defaultMaxPacketSize)
+	}
+	go d.expireLoop()
+	return
+}
+
+// SaveOrigin saves the origin data of the packet before it gets deobfuscated.
+func (d *decoyForwarder) SaveOrigin(packet *Packet) (origin []byte) {
+	origin = d.bufferPool.Get().([]byte)
+	if len(origin) < packet.Length {
+		origin = make([]byte, packet.Length)
+	}
+	origin = origin[:copy(origin, packet.Slice())]
+	return
+}
+
+func (d *decoyForwarder) RecycleOrigin(origin []byte) {
+	d.bufferPool.Put(origin[:cap(origin)])
+}
+
+// Forward forwards the origin data of a packet to the decoy service,
+// replies will be sent back to the source through the clientTransport from the local address.
+func (d *decoyForwarder) Forward(clientTransport Transport, source netip.AddrPort, local netip.Addr, origin []byte) {
+	d.sessionsLock.Lock()
+	session, ok := d.sessions[source]
+	if !ok {
+		if len(d.sessions) >= kDecoyMaxSessions {
+			d.sessionsLock.Unlock()
+			return
+		}
+		conn, err := net.DialUDP("udp", nil, d.decoyAddr)
+		if err != nil {
+			d.sessionsLock.Unlock()
+			log.Printf("[error] failed to dial decoy %s: %s\n", d.decoyAddr.String(), err.Error())
+			return
+		}
+		session = &decoySession{conn: conn}
+		d.sessions[source] = session
+		go d.replyLoop(clientTransport, session, source, local)
+	}
+	session.lastActive = time.Now()
+	d.sessionsLock.Unlock()
+
+	_, _ = session.conn.Write(origin)
+}
+
+func (d *decoyForwarder) replyLoop(clientTransport Transport, session *decoySession, source netip.AddrPort, local netip.Addr) {
+	reply := Packet{
+		Data:        make([]byte, defaultMaxPacketSize),
+		Destination: source,
+		Local:       local,
+	}
+	for {
+		n, err := session.conn.Read(reply.Data)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// such as ECONNREFUSED caused by ICMP port unreachable
+			continue
+		}
+		reply.Length = n
+		_ = clientTransport.WritePacket(&reply)
+	}
+}
+
+func (d *decoyForwarder) expireLoop() {
+	for current := range time.Tick(kDecoySessionTimeout) {
+		d.sessionsLock.Lock()
+		for key, session := range d.sessions {
+			if session.lastActive.Before(current.Add(-kDecoySessionTimeout)) {
+				_ = session.conn.Close()
+				delete(d.sessions, key)
+			}
+		}
+		d.sessionsLock.Unlock()
+	}
+}
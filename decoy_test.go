@@ -0,0 +1,141 @@
+package mwgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStrictClientTransport(t *testing.T) {
+	var serverPrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	serverPublicKey := serverPrivateKey.PublicKey()
+
+	decoyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoyConn.Close()
+
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	checker := &device.CookieChecker{}
+	checker.Init(serverPublicKey.NoisePublicKey)
+	s := &Server{
+		obfuscator:      &obfuscator,
+		strictObfuscate: true,
+		cookieCheckers:  []*device.CookieChecker{checker},
+		decoy:           newDecoyForwarder(decoyConn.LocalAddr().(*net.UDPAddr)),
+	}
+	raw := newTestTransport()
+	defer raw.Close()
+	transport := s.wrapClientTransport(raw)
+
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	proberAddr := netip.MustParseAddrPort("192.0.2.3:51820")
+	obfuscate := func(messageType byte, length int, addMACs bool) (origin []byte, obfuscated []byte) {
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize), Length: length}
+		p.Data[0] = messageType
+		_, _ = rand.Read(p.Data[4:p.Length])
+		if addMACs {
+			var generator device.CookieGenerator
+			generator.Init(serverPublicKey.NoisePublicKey)
+			p.FixMACs(&generator)
+		}
+		origin = append([]byte(nil), p.Slice()...)
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(p)
+		obfuscated = append([]byte(nil), p.Slice()...)
+		return
+	}
+	expectRead := func(origin []byte) {
+		t.Helper()
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+		err := transport.ReadPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Slice(), origin) || p.Source != clientAddr {
+			t.Fatalf("unexpected packet type %d from %s", p.MessageType(), p.Source)
+		}
+	}
+	expectDecoy := func(origin []byte) {
+		t.Helper()
+		_ = decoyConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, defaultMaxPacketSize)
+		n, addr, err := decoyConn.ReadFromUDP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], origin) {
+			t.Fatalf("the decoy received a modified packet")
+		}
+		// the reply of the decoy goes back to the prober
+		_, _ = decoyConn.WriteToUDP([]byte("decoy"), addr)
+		raw.expect(t, []byte("decoy"), proberAddr)
+	}
+
+	// the valid packets pass
+	origin, obfuscated := obfuscate(device.MessageInitiationType, device.MessageInitiationSize, true)
+	raw.readChan <- testDatagram{data: obfuscated, addr: clientAddr}
+	expectRead(origin)
+	origin, obfuscated = obfuscate(device.MessageTransportType, 1280, false)
+	raw.readChan <- testDatagram{data: obfuscated, addr: clientAddr}
+	expectRead(origin)
+
+	// the invalid packets are forwarded to the decoy as they are received
+	probe := make([]byte, 200)
+	_, _ = rand.Read(probe)
+	_, obfuscated = obfuscate(device.MessageInitiationType, device.MessageInitiationSize, false)
+	raw.readChan <- testDatagram{data: probe, addr: proberAddr}
+	raw.readChan <- testDatagram{data: obfuscated, addr: proberAddr}
+	origin, valid := obfuscate(device.MessageTransportType, 128, false)
+	raw.readChan <- testDatagram{data: valid, addr: clientAddr}
+	expectRead(origin)
+	expectDecoy(probe)
+	expectDecoy(obfuscated)
+}
+
+func TestDecoyForwarder_MaxSessions(t *testing.T) {
+	decoyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoyConn.Close()
+
+	d := newDecoyForwarder(decoyConn.LocalAddr().(*net.UDPAddr))
+	raw := newTestTransport()
+	defer raw.Close()
+	for i := 0; i < kDecoyMaxSessions-1; i++ {
+		source := netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 18, byte(i >> 8), byte(i)}), 51820)
+		d.sessions[source] = &decoySession{lastActive: time.Now()}
+	}
+
+	d.Forward(raw, netip.MustParseAddrPort("192.0.2.1:51820"), netip.Addr{}, []byte("first"))
+	d.Forward(raw, netip.MustParseAddrPort("192.0.2.2:51820"), netip.Addr{}, []byte("second"))
+	if len(d.sessions) != kDecoyMaxSessions {
+		t.Errorf("expected %d sessions, got %d", kDecoyMaxSessions, len(d.sessions))
+	}
+
+	_ = decoyConn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, defaultMaxPacketSize)
+	n, _, err := decoyConn.ReadFromUDP(b)
+	if err != nil || string(b[:n]) != "first" {
+		t.Fatalf("unexpected packet %q to the decoy, %v", b[:n], err)
+	}
+	_, _, err = decoyConn.ReadFromUDP(b)
+	if err == nil {
+		t.Errorf("the packet over the session cap is forwarded")
+	}
+	d.sessionsLock.Lock()
+	for _, session := range d.sessions {
+		if session.conn != nil {
+			_ = session.conn.Close()
+		}
+	}
+	d.sessionsLock.Unlock()
+}
@@ -0,0 +1,83 @@
+package mwgp
+
+import (
+	"time"
+)
+
+const (
+	// the number of ticks in a Timeout
+	kExpireWheelSlots = 16
+
+	kExpireWheelMinTick = 10 * time.Millisecond
+)
+
+// expireWheel is a hashed timing wheel for the peer expiry,
+// so an expiry check only visits the peers which may be expired instead of all of them.
+//
+// a peer is scheduled at lastActive + Timeout, when the slot is reached,
+// it is either expired or rescheduled with the updated lastActive.
+type expireWheel struct {
+	tick  time.Duration
+	slots [][]*Peer
+
+	// the tick number of the last advance
+	current int64
+}
+
+func newExpireWheel(timeout time.Duration, now time.Time) (w *expireWheel) {
+	w = &expireWheel{
+		tick: timeout / kExpireWheelSlots,
+	}
+	if w.tick < kExpireWheelMinTick {
+		w.tick = kExpireWheelMinTick
+	}
+	// a peer is never scheduled more than a Timeout later, so the slots never wrap around
+	w.slots = make([][]*Peer, int64(timeout/w.tick)+2)
+	w.current = w.tickOf(now)
+	return
+}
+
+func (w *expireWheel) tickOf(t time.Time) int64 {
+	return t.UnixNano() / int64(w.tick)
+}
+
+// Schedule schedules the peer to be checked at deadline, or the next tick if it has passed.
+func (w *expireWheel) Schedule(peer *Peer, deadline time.Time) {
+	n := w.tickOf(deadline) + 1
+	if n <= w.current {
+		n = w.current + 1
+	}
+	if n > w.current+int64(len(w.slots)) {
+		n = w.current + int64(len(w.slots))
+	}
+	slot := n % int64(len(w.slots))
+	w.slots[slot] = append(w.slots[slot], peer)
+}
+
+// Advance calls f for every peer scheduled before now.
+// f may call Schedule, the peer is always scheduled in a later slot.
+func (w *expireWheel) Advance(now time.Time, f func(peer *Peer)) {
+	target := w.tickOf(now)
+	steps := target - w.current
+	if steps > int64(len(w.slots)) {
+		steps = int64(len(w.slots))
+	}
+	start := w.current
+	w.current = target
+	for i := int64(1); i <= steps; i++ {
+		slot := (start + i) % int64(len(w.slots))
+		peers := w.slots[slot]
+		w.slots[slot] = nil
+		for _, peer := range peers {
+			f(peer)
+		}
+	}
+}
+
+// Len returns the number of scheduled peers.
+func (w *expireWheel) Len() (n int) {
+	for _, slot := range w.slots {
+		n += len(slot)
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package mwgp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireWheel(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeout := 16 * time.Second
+	w := newExpireWheel(timeout, now)
+
+	peers := make([]*Peer, 3)
+	for i := range peers {
+		peers[i] = &Peer{clientProxyIndex: uint32(i)}
+		w.Schedule(peers[i], now.Add(time.Duration(i+1)*4*time.Second))
+	}
+
+	var checked []*Peer
+	check := func(peer *Peer) {
+		checked = append(checked, peer)
+	}
+	w.Advance(now.Add(4*time.Second), check)
+	if len(checked) != 0 {
+		t.Fatalf("no peer should be checked before the deadline, got %d", len(checked))
+	}
+	w.Advance(now.Add(6*time.Second), check)
+	if len(checked) != 1 || checked[0] != peers[0] {
+		t.Fatalf("expected peer 0 checked, got %v", checked)
+	}
+
+	// a peer rescheduled in f is checked in a later slot
+	w.Advance(now.Add(10*time.Second), func(peer *Peer) {
+		checked = append(checked, peer)
+		w.Schedule(peer, now.Add(13*time.Second))
+	})
+	if len(checked) != 2 || checked[1] != peers[1] {
+		t.Fatalf("expected peer 1 checked, got %v", checked)
+	}
+	if w.Len() != 2 {
+		t.Fatalf("expected 2 scheduled peers, got %d", w.Len())
+	}
+
+	// a long pause checks all the peers once
+	w.Advance(now.Add(time.Hour), check)
+	if len(checked) != 4 || w.Len() != 0 {
+		t.Fatalf("expected all peers checked, got %d, remaining %d", len(checked), w.Len())
+	}
+}
+
+func TestWireGuardIndexTranslationTable_Expire(t *testing.T) {
+	table := NewWireGuardIndexTranslationTable()
+	now := time.Now()
+	table.expireWheel = newExpireWheel(table.Timeout, now)
+
+	active := &Peer{clientProxyIndex: 1, serverProxyIndex: 2}
+	idle := &Peer{clientProxyIndex: 3, serverProxyIndex: 4}
+	for _, peer := range []*Peer{active, idle} {
+		peer.touch(now)
+		table.clientMap.Store(peer.clientProxyIndex, peer)
+		table.serverMap.Store(peer.serverProxyIndex, peer)
+		table.expireWheel.Schedule(peer, now.Add(table.Timeout))
+	}
+
+	// the peers are checked within a tick after their deadline
+	tick := table.expireWheel.tick
+	active.touch(now.Add(table.Timeout / 2))
+	table.handlePeersExpireCheck(now.Add(table.Timeout + tick))
+	if _, ok := table.clientMap.Load(idle.clientProxyIndex); ok {
+		t.Errorf("idle peer not expired")
+	}
+	if _, ok := table.serverMap.Load(idle.serverProxyIndex); ok {
+		t.Errorf("idle peer not expired from serverMap")
+	}
+	if _, ok := table.serverMap.Load(active.serverProxyIndex); !ok {
+		t.Errorf("active peer expired")
+	}
+
+	table.handlePeersExpireCheck(now.Add(table.Timeout*3/2 + tick))
+	if table.clientMap.Len() != 0 || table.serverMap.Len() != 0 {
+		t.Errorf("active peer not expired after timeout")
+	}
+}
+
+func BenchmarkWireGuardIndexTranslationTable_ExpireCheck(b *testing.B) {
+	table, _ := newBenchmarkTable()
+	now := time.Now()
+	// all the peers keep active, so every check only reschedules the peers in a slot
+	table.clientMap.Range(func(index uint32, peer *Peer) bool {
+		peer.touch(now.Add(365 * 24 * time.Hour))
+		return true
+	})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.handlePeersExpireCheck(now.Add(time.Duration(i+1) * table.expireWheel.tick))
+	}
+}
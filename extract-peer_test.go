@@ -0,0 +1,238 @@
+package mwgp
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestMessageInitiation returns a MessageInitiation with the static key of the client encrypted to the server,
+// the rest of it is not filled.
+func newTestMessageInitiation(t *testing.T, serverPublicKey NoisePublicKey, clientPublicKey NoisePublicKey) (msg *device.MessageInitiation) {
+	var ephemeral NoisePrivateKey
+	err := ephemeral.FromBase64("aBLEHM1Kd8yCNQb8GSCWhbcnyJEiK00Uvw3QkGzAz0A=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = &device.MessageInitiation{
+		Type:      device.MessageInitiationType,
+		Ephemeral: ephemeral.PublicKey().NoisePublicKey,
+	}
+
+	var hash, chainKey [blake2s.Size]byte
+	devicex.mixHash(&hash, &device.InitialHash, serverPublicKey.NoisePublicKey[:])
+	devicex.mixHash(&hash, &hash, msg.Ephemeral[:])
+	devicex.mixKey(&chainKey, &device.InitialChainKey, msg.Ephemeral[:])
+
+	var key [chacha20poly1305.KeySize]byte
+	ss := ephemeral.SharedSecret(serverPublicKey.NoisePublicKey)
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	aead.Seal(msg.Static[:0], device.ZeroNonce[:], clientPublicKey.NoisePublicKey[:], hash[:])
+	return
+}
+
+// extractTestPeer extracts the peer of the MessageInitiation like the forwarding table.
+func extractTestPeer(s *Server, msg *device.MessageInitiation, source netip.AddrPort) (sp *ServerConfigPeer, err error) {
+	request := &PeerRequest{Source: source}
+	request.ServerPublicKey, request.ClientPublicKey, err = s.decryptPeer(msg)
+	if err != nil {
+		return
+	}
+	return s.extractPeer(context.Background(), msg, request)
+}
+
+func TestServer_ExtractPeerFrom(t *testing.T) {
+	var serverPrivateKey, clientPrivateKey, otherPrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	_ = clientPrivateKey.FromBase64("MB0pM6NZg0bO3QjUkPqgAtXzV1Tb2hnHO1SC3QGOQ1Q=")
+	_ = otherPrivateKey.FromBase64("sJtkS0WB8U3A8nZp7tJqVDTn62z5bCvcNt0qMUlgE3A=")
+	clientPublicKey := clientPrivateKey.PublicKey()
+
+	server := &ServerConfigServer{
+		PrivateKey: &serverPrivateKey,
+		Address:    "127.0.0.1",
+		Peers: []*ServerConfigPeer{
+			{ClientPublicKey: &clientPublicKey, From: []string{"192.0.2.0/24"}, ForwardTo: ":1001"},
+			{ClientPublicKey: &clientPublicKey, ForwardTo: ":1002"},
+			{From: []string{"198.51.100.0/24"}, ForwardTo: ":1003"},
+		},
+	}
+	err := server.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{servers: []*ServerConfigServer{server}}
+
+	serverPublicKey := serverPrivateKey.PublicKey()
+	for _, c := range []struct {
+		client    NoisePublicKey
+		source    string
+		forwardTo string
+	}{
+		{clientPublicKey, "192.0.2.1:51820", "127.0.0.1:1001"},
+		{clientPublicKey, "[::ffff:192.0.2.1]:51820", "127.0.0.1:1001"},
+		{clientPublicKey, "203.0.113.1:51820", "127.0.0.1:1002"},
+		{otherPrivateKey.PublicKey(), "198.51.100.1:51820", "127.0.0.1:1003"},
+		{otherPrivateKey.PublicKey(), "203.0.113.1:51820", ""},
+	} {
+		msg := newTestMessageInitiation(t, serverPublicKey, c.client)
+		sp, err := extractTestPeer(s, msg, netip.MustParseAddrPort(c.source))
+		if c.forwardTo == "" {
+			if err == nil {
+				t.Errorf("%s: expected no matched peer, got %s", c.source, sp.forwardToAddress)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.source, err)
+			continue
+		}
+		if sp.forwardToAddress.String() != c.forwardTo || *sp.ClientPublicKey != c.client {
+			t.Errorf("%s: expected forward to %s, got %s", c.source, c.forwardTo, sp.forwardToAddress)
+		}
+	}
+}
+
+type testPeerProvider struct {
+	lookups  int
+	requests []PeerRequest
+	lookup   func(request *PeerRequest) (*ServerConfigPeer, time.Duration, error)
+}
+
+func (p *testPeerProvider) LookupPeer(ctx context.Context, request *PeerRequest) (sp *ServerConfigPeer, ttl time.Duration, err error) {
+	p.lookups++
+	p.requests = append(p.requests, *request)
+	return p.lookup(request)
+}
+
+func TestServer_ExtractPeerProvider(t *testing.T) {
+	var serverPrivateKey, knownPrivateKey, allowedPrivateKey, deniedPrivateKey, unknownPrivateKey, otherSourcePrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	_ = knownPrivateKey.FromBase64("MB0pM6NZg0bO3QjUkPqgAtXzV1Tb2hnHO1SC3QGOQ1Q=")
+	_ = allowedPrivateKey.FromBase64("sJtkS0WB8U3A8nZp7tJqVDTn62z5bCvcNt0qMUlgE3A=")
+	_ = deniedPrivateKey.FromBase64("YEc3ZTo6/hxS7h2T4Ol9kHj3Dqz1dM1wJxUuM7KQh0Q=")
+	_ = unknownPrivateKey.FromBase64("cF5m3w3e2XrCtkE0s7Cz8RaYp0m3DSo2Y4u3F0q7pEE=")
+	_ = otherSourcePrivateKey.FromBase64("2G0cL1QeZ8m3pXv6nYk9Jw4tR7sA5bU0dC3fH6iK1Vw=")
+	knownPublicKey := knownPrivateKey.PublicKey()
+
+	server := &ServerConfigServer{
+		PrivateKey: &serverPrivateKey,
+		Address:    "127.0.0.1",
+		Peers: []*ServerConfigPeer{
+			{ClientPublicKey: &knownPublicKey, ForwardTo: ":1001"},
+			{ForwardTo: ":1003"},
+		},
+	}
+	err := server.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{servers: []*ServerConfigServer{server}, wgitTable: NewWireGuardIndexTranslationTable()}
+	provider := &testPeerProvider{
+		lookup: func(request *PeerRequest) (*ServerConfigPeer, time.Duration, error) {
+			switch request.ClientPublicKey {
+			case allowedPrivateKey.PublicKey():
+				return &ServerConfigPeer{ForwardTo: ":1002"}, 0, nil
+			case deniedPrivateKey.PublicKey():
+				return nil, 0, ErrPeerDenied
+			case otherSourcePrivateKey.PublicKey():
+				return &ServerConfigPeer{ForwardTo: ":1004", From: []string{"198.51.100.0/24"}}, 0, nil
+			}
+			return nil, 0, nil
+		},
+	}
+	s.SetPeerProvider(provider, time.Minute)
+
+	serverPublicKey := serverPrivateKey.PublicKey()
+	source := netip.MustParseAddrPort("192.0.2.1:51820")
+	for _, c := range []struct {
+		client    NoisePublicKey
+		forwardTo string
+	}{
+		{knownPublicKey, "127.0.0.1:1001"},
+		{allowedPrivateKey.PublicKey(), "127.0.0.1:1002"},
+		{deniedPrivateKey.PublicKey(), ""},
+		{unknownPrivateKey.PublicKey(), "127.0.0.1:1003"},
+		// the from of the peers from the provider is applied
+		{otherSourcePrivateKey.PublicKey(), "127.0.0.1:1003"},
+	} {
+		// the second lookup is cached
+		for i := 0; i < 2; i++ {
+			msg := newTestMessageInitiation(t, serverPublicKey, c.client)
+			sp, err := extractTestPeer(s, msg, source)
+			if c.forwardTo == "" {
+				if !errors.Is(err, ErrPeerDenied) {
+					t.Errorf("%s: expected denied, got %v", c.client.Base64(), err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", c.client.Base64(), err)
+			}
+			if sp.forwardToAddress.String() != c.forwardTo || *sp.ClientPublicKey != c.client {
+				t.Errorf("%s: expected forward to %s, got %s", c.client.Base64(), c.forwardTo, sp.forwardToAddress)
+			}
+		}
+	}
+
+	// the known client is not looked up
+	if provider.lookups != 4 {
+		t.Errorf("expected 4 lookups, got %d", provider.lookups)
+	}
+	request := provider.requests[0]
+	if request.ServerPublicKey != serverPublicKey || request.ClientPublicKey != allowedPrivateKey.PublicKey() || request.Source != source {
+		t.Errorf("unexpected request %+v", request)
+	}
+}
+
+func TestServer_CheckUpstreamObfuscator(t *testing.T) {
+	var serverPrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	server := &ServerConfigServer{
+		PrivateKey: &serverPrivateKey,
+		Address:    "127.0.0.1",
+		Peers: []*ServerConfigPeer{
+			{ForwardTo: ":1001", UpstreamObfuscateKey: "secret", UpstreamObfuscateMimicry: ObfuscateMimicryQUIC},
+			{ForwardTo: ":1002", From: []string{"192.0.2.0/24"}},
+		},
+	}
+	err := server.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{servers: []*ServerConfigServer{server}}
+	err = s.initializeUpstreamObfuscators()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		forwardTo string
+		key       string
+		mimicry   string
+		ok        bool
+	}{
+		{":1001", "secret", ObfuscateMimicryQUIC, true},
+		{":1001", "other", ObfuscateMimicryQUIC, false},
+		{":1001", "secret", "", false},
+		{":1001", "", "", false},
+		{":1002", "", "", true},
+		{":1002", "secret", "", false},
+	} {
+		sp := &ServerConfigPeer{ForwardTo: c.forwardTo, UpstreamObfuscateKey: c.key, UpstreamObfuscateMimicry: c.mimicry}
+		err = server.initializePeer(sp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.checkUpstreamObfuscator(sp)
+		if (err == nil) != c.ok {
+			t.Errorf("%s with upstream_obfs %q and mimicry %q: unexpected result %v", c.forwardTo, c.key, c.mimicry, err)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The handshake limiter protects mwgp-server from the handshake floods,
+// since every MessageInitiation costs a goroutine and a DH operation to find the client public key.
+// the excess packets are dropped silently and counted, instead of logging every one of them.
+
+const (
+	kHandshakeLimiterReportInterval = time.Minute
+
+	// the max number of buckets of sources or public keys,
+	// so a flood from spoofed sources cannot exhaust the memory.
+	kHandshakeLimiterMaxBuckets = 65536
+	// the min interval to prune the buckets when they are full,
+	// so a flood of new keys does not scan all of them on every packet.
+	kHandshakeLimiterFullPruneInterval = time.Second
+
+	kDefaultHandshakeLimitIPv4Prefix = 32
+	kDefaultHandshakeLimitIPv6Prefix = 64
+)
+
+var errHandshakeRateLimited = errors.New("handshake rate limited")
+
+type HandshakeRateLimitConfig struct {
+	// PerSource limits the handshake packets from every source address prefix (optional).
+	PerSource *RateLimitConfig `json:"per_source,omitempty"`
+	// SourceIPv4Prefix and SourceIPv6Prefix are the prefix lengths of the sources sharing a bucket,
+	// default to 32 and 64.
+	SourceIPv4Prefix int `json:"source_ipv4_prefix,omitempty"`
+	SourceIPv6Prefix int `json:"source_ipv6_prefix,omitempty"`
+	// PerPublicKey limits the MessageInitiation forwarded for every client public key (optional).
+	PerPublicKey *RateLimitConfig `json:"per_pubkey,omitempty"`
+	// MaxConcurrent is the max number of the handshake packets being handled at the same time (optional).
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// RateLimitConfig is a token bucket.
+type RateLimitConfig struct {
+	// Rate is the number of packets allowed per second.
+	Rate float64 `json:"rate"`
+	// Burst is the size of the bucket, default to Rate rounded up.
+	Burst int `json:"burst,omitempty"`
+}
+
+// HandshakeLimiterStats are the numbers of the handshake packets dropped since the start.
+type HandshakeLimiterStats struct {
+	DroppedBySource     uint64
+	DroppedByPublicKey  uint64
+	DroppedByConcurrent uint64
+}
+
+// HandshakeLimiter limits the handshake packets from clients, a nil one allows everything.
+type HandshakeLimiter struct {
+	sources    *tokenBuckets // netip.Prefix -> bucket
+	ipv4Prefix int
+	ipv6Prefix int
+
+	publicKeys *tokenBuckets // NoisePublicKey -> bucket
+
+	// the slots of the concurrent handshakes, nil if unlimited
+	concurrent chan struct{}
+
+	droppedBySource     uint64
+	droppedByPublicKey  uint64
+	droppedByConcurrent uint64
+
+	// the stats of the last report
+	reported HandshakeLimiterStats
+}
+
+func NewHandshakeLimiter(config *HandshakeRateLimitConfig) (l *HandshakeLimiter, err error) {
+	l = &HandshakeLimiter{
+		ipv4Prefix: config.SourceIPv4Prefix,
+		ipv6Prefix: config.SourceIPv6Prefix,
+	}
+	if l.ipv4Prefix == 0 {
+		l.ipv4Prefix = kDefaultHandshakeLimitIPv4Prefix
+	}
+	if l.ipv6Prefix == 0 {
+		l.ipv6Prefix = kDefaultHandshakeLimitIPv6Prefix
+	}
+	if l.ipv4Prefix < 0 || l.ipv4Prefix > 32 || l.ipv6Prefix < 0 || l.ipv6Prefix > 128 {
+		err = fmt.Errorf("invalid source prefix length /%d or /%d", l.ipv4Prefix, l.ipv6Prefix)
+		return
+	}
+	if config.PerSource != nil {
+		l.sources, err = newTokenBuckets(config.PerSource)
+		if err != nil {
+			err = fmt.Errorf("invalid per_source: %w", err)
+			return
+		}
+	}
+	if config.PerPublicKey != nil {
+		l.publicKeys, err = newTokenBuckets(config.PerPublicKey)
+		if err != nil {
+			err = fmt.Errorf("invalid per_pubkey: %w", err)
+			return
+		}
+	}
+	if config.MaxConcurrent < 0 {
+		err = fmt.Errorf("invalid max_concurrent %d", config.MaxConcurrent)
+		return
+	}
+	if config.MaxConcurrent > 0 {
+		l.concurrent = make(chan struct{}, config.MaxConcurrent)
+	}
+	return
+}
+
+// admit checks the handshake packet from client before it is handled,
+// done must be called after it is handled if it returns true.
+func (l *HandshakeLimiter) admit(packet *Packet) bool {
+	if l == nil {
+		return true
+	}
+	if l.sources != nil && !l.sources.allow(l.sourcePrefix(packet.Source.Addr()), time.Now()) {
+		atomic.AddUint64(&l.droppedBySource, 1)
+		return false
+	}
+	if l.concurrent != nil {
+		select {
+		case l.concurrent <- struct{}{}:
+		default:
+			atomic.AddUint64(&l.droppedByConcurrent, 1)
+			return false
+		}
+	}
+	return true
+}
+
+func (l *HandshakeLimiter) done() {
+	if l == nil || l.concurrent == nil {
+		return
+	}
+	<-l.concurrent
+}
+
+// allowPublicKey checks the MessageInitiation of the client public key before it is forwarded.
+func (l *HandshakeLimiter) allowPublicKey(publicKey NoisePublicKey) bool {
+	if l == nil || l.publicKeys == nil {
+		return true
+	}
+	if !l.publicKeys.allow(publicKey, time.Now()) {
+		atomic.AddUint64(&l.droppedByPublicKey, 1)
+		return false
+	}
+	return true
+}
+
+func (l *HandshakeLimiter) sourcePrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := l.ipv6Prefix
+	if addr.Is4() {
+		bits = l.ipv4Prefix
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+func (l *HandshakeLimiter) Stats() HandshakeLimiterStats {
+	return HandshakeLimiterStats{
+		DroppedBySource:     atomic.LoadUint64(&l.droppedBySource),
+		DroppedByPublicKey:  atomic.LoadUint64(&l.droppedByPublicKey),
+		DroppedByConcurrent: atomic.LoadUint64(&l.droppedByConcurrent),
+	}
+}
+
+// report logs the packets dropped since the last report, and forgets the idle buckets.
+// it is called by the main loop only.
+func (l *HandshakeLimiter) report(now time.Time) {
+	stats := l.Stats()
+	bySource := stats.DroppedBySource - l.reported.DroppedBySource
+	byPublicKey := stats.DroppedByPublicKey - l.reported.DroppedByPublicKey
+	byConcurrent := stats.DroppedByConcurrent - l.reported.DroppedByConcurrent
+	l.reported = stats
+	if bySource+byPublicKey+byConcurrent > 0 {
+		log.Printf("[warn] handshake rate limit dropped %d packets by source, %d by client public key and %d by max_concurrent in the last %s\n",
+			bySource, byPublicKey, byConcurrent, kHandshakeLimiterReportInterval)
+	}
+	if l.sources != nil {
+		l.sources.prune(now)
+	}
+	if l.publicKeys != nil {
+		l.publicKeys.prune(now)
+	}
+}
+
+// tokenBuckets are the token buckets of the same rate for different keys.
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	lock    sync.Mutex
+	buckets map[interface{}]*tokenBucket
+	pruned  time.Time // the last prune
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens since the last refill.
+func (b *tokenBucket) refill(rate float64, burst float64, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+func newTokenBuckets(config *RateLimitConfig) (b *tokenBuckets, err error) {
+	if !(config.Rate > 0) || math.IsInf(config.Rate, 0) {
+		err = fmt.Errorf("invalid rate %v", config.Rate)
+		return
+	}
+	if config.Burst < 0 {
+		err = fmt.Errorf("invalid burst %d", config.Burst)
+		return
+	}
+	b = &tokenBuckets{
+		rate:    config.Rate,
+		burst:   float64(config.Burst),
+		buckets: make(map[interface{}]*tokenBucket),
+	}
+	if b.burst == 0 {
+		b.burst = math.Ceil(b.rate)
+	}
+	return
+}
+
+// allow takes a token from the bucket of key if there is any.
+func (b *tokenBuckets) allow(key interface{}, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		if len(b.buckets) >= kHandshakeLimiterMaxBuckets {
+			if now.Sub(b.pruned) >= kHandshakeLimiterFullPruneInterval {
+				b.pruneLocked(now)
+			}
+			if len(b.buckets) >= kHandshakeLimiterMaxBuckets {
+				// all of them are busy, refuse the new keys rather than
+				// forgetting the buckets being limited.
+				return false
+			}
+		}
+		bucket = &tokenBucket{
+			tokens: b.burst,
+			last:   now,
+		}
+		b.buckets[key] = bucket
+	}
+	bucket.refill(b.rate, b.burst, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (b *tokenBuckets) prune(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pruneLocked(now)
+}
+
+// pruneLocked forgets the buckets which are full again, they are the same as the new ones.
+func (b *tokenBuckets) pruneLocked(now time.Time) {
+	b.pruned = now
+	for key, bucket := range b.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package mwgp
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimiter_PerSource(t *testing.T) {
+	l, err := NewHandshakeLimiter(&HandshakeRateLimitConfig{
+		PerSource:        &RateLimitConfig{Rate: 1, Burst: 2},
+		SourceIPv4Prefix: 24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	allow := func(source string) bool {
+		return l.sources.allow(l.sourcePrefix(netip.MustParseAddr(source)), now)
+	}
+
+	// the sources in the same /24 share the burst, including the IPv4-mapped ones
+	if !allow("192.0.2.1") || !allow("::ffff:192.0.2.2") {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if allow("192.0.2.3") {
+		t.Fatal("expected the source to be limited")
+	}
+	if !allow("198.51.100.1") {
+		t.Fatal("expected another source to be allowed")
+	}
+
+	// a token is refilled every second
+	now = now.Add(time.Second)
+	if !allow("192.0.2.1") || allow("192.0.2.1") {
+		t.Fatal("expected a single token to be refilled")
+	}
+
+	// the full buckets are forgotten
+	now = now.Add(10 * time.Second)
+	l.report(now)
+	if len(l.sources.buckets) != 0 {
+		t.Errorf("expected no bucket left, got %d", len(l.sources.buckets))
+	}
+}
+
+func TestHandshakeLimiter_Admit(t *testing.T) {
+	l, err := NewHandshakeLimiter(&HandshakeRateLimitConfig{
+		PerPublicKey:  &RateLimitConfig{Rate: 1},
+		MaxConcurrent: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := &Packet{Source: netip.MustParseAddrPort("192.0.2.1:51820")}
+	if !l.admit(packet) {
+		t.Fatal("expected the first packet to be admitted")
+	}
+	if l.admit(packet) {
+		t.Fatal("expected the concurrent packet to be dropped")
+	}
+	l.done()
+	if !l.admit(packet) {
+		t.Fatal("expected the packet to be admitted after done")
+	}
+	l.done()
+
+	var publicKey NoisePublicKey
+	if !l.allowPublicKey(publicKey) || l.allowPublicKey(publicKey) {
+		t.Fatal("expected the public key to be limited after the burst of 1")
+	}
+
+	stats := l.Stats()
+	if stats.DroppedByConcurrent != 1 || stats.DroppedByPublicKey != 1 || stats.DroppedBySource != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// a nil limiter allows everything
+	var unlimited *HandshakeLimiter
+	if !unlimited.admit(packet) || !unlimited.allowPublicKey(publicKey) {
+		t.Error("expected the nil limiter to allow everything")
+	}
+	unlimited.done()
+
+	_, err = NewHandshakeLimiter(&HandshakeRateLimitConfig{PerSource: &RateLimitConfig{}})
+	if err == nil {
+		t.Error("expected invalid rate")
+	}
+}
+
+func TestTokenBuckets_Full(t *testing.T) {
+	b, err := newTokenBuckets(&RateLimitConfig{Rate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < kHandshakeLimiterMaxBuckets; i++ {
+		if !b.allow(i, now) {
+			t.Fatalf("expected key %d to be allowed", i)
+		}
+	}
+
+	// the busy buckets are kept and the new keys are refused
+	if b.allow(kHandshakeLimiterMaxBuckets, now) {
+		t.Error("expected the new key to be refused")
+	}
+	if b.allow(0, now) {
+		t.Error("expected the limited key to stay limited")
+	}
+
+	// the new keys are allowed again once the old buckets are refilled
+	now = now.Add(2 * time.Second)
+	if !b.allow(kHandshakeLimiterMaxBuckets, now) {
+		t.Error("expected the new key to be allowed after the prune")
+	}
+}
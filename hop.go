@@ -0,0 +1,153 @@
+package mwgp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Port hopping evades the per-flow UDP blocking or throttling.
+//
+// mwgp-server listens on a port range (e.g. ":20000-20100") into a single WGIT table,
+// mwgp-client sends to one port in the range and switches to another one
+// every hop_interval seconds and/or every hop_packets packets.
+//
+// The hop sequence is derived from the obfuscation password (or the server public key if not set)
+// and the current time slot, so both sides agree on it.
+
+const (
+	kPortRangeMaxLength = 1024
+)
+
+// splitHostPortRange splits address like "host:20000-20100" into host and an inclusive port range.
+// an address without port range like "host:20000" is also accepted.
+func splitHostPortRange(address string) (host string, portStart, portEnd int, err error) {
+	host, portRange, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	portStart, portEnd, err = parsePortRange(portRange)
+	if err != nil {
+		return
+	}
+	if portEnd-portStart+1 > kPortRangeMaxLength {
+		err = fmt.Errorf("port range %s is too large, at most %d ports", portRange, kPortRangeMaxLength)
+		return
+	}
+	return
+}
+
+// parsePortRange parses an inclusive port range like "20000-20100", a single port like "20000" is also accepted.
+func parsePortRange(portRange string) (portStart, portEnd int, err error) {
+	portTokens := strings.SplitN(portRange, "-", 2)
+	portStart, err = strconv.Atoi(strings.TrimSpace(portTokens[0]))
+	if err != nil {
+		err = fmt.Errorf("invalid port %s: %w", portTokens[0], err)
+		return
+	}
+	portEnd = portStart
+	if len(portTokens) == 2 {
+		portEnd, err = strconv.Atoi(strings.TrimSpace(portTokens[1]))
+		if err != nil {
+			err = fmt.Errorf("invalid port %s: %w", portTokens[1], err)
+			return
+		}
+	}
+	if portStart < 0 || portEnd > 65535 || portStart > portEnd {
+		err = fmt.Errorf("invalid port range %s", portRange)
+		return
+	}
+	return
+}
+
+// resolveUDPAddrRange resolves address like "host:20000-20100" into a UDPAddr for every port.
+func resolveUDPAddrRange(address string) (addrs []*net.UDPAddr, err error) {
+	host, portStart, portEnd, err := splitHostPortRange(address)
+	if err != nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(portStart)))
+	if err != nil {
+		return
+	}
+	for port := portStart; port <= portEnd; port++ {
+		addrs = append(addrs, &net.UDPAddr{
+			IP:   addr.IP,
+			Port: port,
+			Zone: addr.Zone,
+		})
+	}
+	return
+}
+
+type portHopper struct {
+	// accessed atomically, keep them 64-bit aligned
+	packetCounter uint64
+	packetHops    uint64
+
+	portStart int
+	portCount int
+	interval  time.Duration
+	packets   uint64
+	seed      [sha256.Size]byte
+}
+
+func newPortHopper(portStart, portEnd int, interval time.Duration, packets uint64, seed []byte) (h *portHopper) {
+	h = &portHopper{
+		portStart: portStart,
+		portCount: portEnd - portStart + 1,
+		interval:  interval,
+		packets:   packets,
+		seed:      sha256.Sum256(seed),
+	}
+	return
+}
+
+func (h *portHopper) index(current time.Time) (index uint64) {
+	if h.interval > 0 {
+		index = uint64(current.UnixNano() / int64(h.interval))
+	}
+	index += atomic.LoadUint64(&h.packetHops)
+	return
+}
+
+// Port returns the destination port should be used currently.
+func (h *portHopper) Port() int {
+	if h.portCount <= 1 {
+		return h.portStart
+	}
+	var index [8]byte
+	binary.LittleEndian.PutUint64(index[:], h.index(time.Now()))
+	var digest xxhash.Digest
+	digest.Reset()
+	_, _ = digest.Write(h.seed[:])
+	_, _ = digest.Write(index[:])
+	return h.portStart + int(digest.Sum64()%uint64(h.portCount))
+}
+
+// NextHop returns the time of next time-based hop, or zero time if it is disabled.
+func (h *portHopper) NextHop() (next time.Time) {
+	if h.interval <= 0 {
+		return
+	}
+	next = time.Unix(0, (time.Now().UnixNano()/int64(h.interval)+1)*int64(h.interval))
+	return
+}
+
+// CountPacket counts a sent packet, returns true if a packet-based hop happened.
+func (h *portHopper) CountPacket() (hopped bool) {
+	if h.packets == 0 {
+		return
+	}
+	if atomic.AddUint64(&h.packetCounter, 1)%h.packets == 0 {
+		atomic.AddUint64(&h.packetHops, 1)
+		hopped = true
+	}
+	return
+}
@@ -0,0 +1,125 @@
+package mwgp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSplitHostPortRange(t *testing.T) {
+	cases := []struct {
+		address   string
+		host      string
+		portStart int
+		portEnd   int
+		fail      bool
+	}{
+		{address: "192.0.2.1:1000", host: "192.0.2.1", portStart: 1000, portEnd: 1000},
+		{address: ":20000-20099", host: "", portStart: 20000, portEnd: 20099},
+		{address: "[2001:db8::1]:20000-20001", host: "2001:db8::1", portStart: 20000, portEnd: 20001},
+		{address: "192.0.2.1", fail: true},
+		{address: "192.0.2.1:2000-1000", fail: true},
+		{address: "192.0.2.1:1000-70000", fail: true},
+		{address: "192.0.2.1:1000-3000", fail: true},
+		{address: "192.0.2.1:a-b", fail: true},
+	}
+	for _, c := range cases {
+		host, portStart, portEnd, err := splitHostPortRange(c.address)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: expected error", c.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.address, err.Error())
+			continue
+		}
+		if host != c.host || portStart != c.portStart || portEnd != c.portEnd {
+			t.Errorf("%s: got %s %d-%d", c.address, host, portStart, portEnd)
+		}
+	}
+}
+
+func TestPortHopper(t *testing.T) {
+	h1 := newPortHopper(20000, 20099, time.Hour, 10, []byte("password"))
+	h2 := newPortHopper(20000, 20099, time.Hour, 10, []byte("password"))
+
+	ports := make(map[int]struct{})
+	for i := 0; i < 100; i++ {
+		port := h1.Port()
+		if port < 20000 || port > 20099 {
+			t.Fatalf("port %d out of range", port)
+		}
+		if port != h2.Port() {
+			t.Fatalf("hoppers with the same seed disagree")
+		}
+		ports[port] = struct{}{}
+		for j := 0; j < 10; j++ {
+			hopped1 := h1.CountPacket()
+			hopped2 := h2.CountPacket()
+			if hopped1 != (j == 9) || hopped2 != hopped1 {
+				t.Fatalf("unexpected packet-based hop at packet %d", j)
+			}
+		}
+	}
+	if len(ports) < 2 {
+		t.Errorf("port never changed")
+	}
+
+	next := h1.NextHop()
+	if !next.After(time.Now()) || next.Sub(time.Now()) > time.Hour {
+		t.Errorf("invalid next hop: %s", next)
+	}
+}
+
+func TestClient_RequestHop(t *testing.T) {
+	c := &Client{hopChan: make(chan struct{}, 1)}
+	c.cachedServerPeer.forwardToAddress = netip.MustParseAddrPort("192.0.2.1:20000")
+
+	// the hops requested by the packets are coalesced until the pending one is handled
+	for i := 0; i < 100; i++ {
+		c.requestHop()
+	}
+	if len(c.hopChan) != 1 {
+		t.Fatalf("expected 1 pending hop, got %d", len(c.hopChan))
+	}
+
+	// the peers of the handshakes are not changed by the hops
+	peer, err := c.generateServerPeer(context.Background(), nil, &PeerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cachedServerPeer.forwardToAddress = netip.MustParseAddrPort("192.0.2.1:20001")
+	if peer.forwardToAddress.Port() != 20000 {
+		t.Errorf("the peer is changed by the hop to %s", peer.forwardToAddress)
+	}
+}
+
+func TestClient_UpdateServerDestination(t *testing.T) {
+	c := &Client{wgitTable: NewWireGuardIndexTranslationTable()}
+	c.serverAddr = netip.MustParseAddrPort("192.0.2.1:20000")
+
+	// the mainLoop is busy, the handshakes are not blocked by the pending update
+	go c.updateServerDestination()
+	deadline := time.Now().Add(time.Second)
+	for {
+		peer, err := c.generateServerPeer(context.Background(), nil, &PeerRequest{})
+		if err == nil && peer.forwardToAddress == c.serverAddr {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the handshake is blocked by the update")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case addr := <-c.wgitTable.UpdateAllServerDestinationChan:
+		if addr != c.serverAddr {
+			t.Errorf("unexpected update %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the update is not sent")
+	}
+}
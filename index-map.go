@@ -0,0 +1,110 @@
+package mwgp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// must be a power of 2
+	kPeerIndexMapShards = 256
+)
+
+// peerIndexMap is a concurrent map of proxy index -> Peer for the read-mostly workload,
+// every packet looks up the map while only the handshakes and expiry modify it.
+//
+// the map is sharded by the index, and every shard is a copy-on-write snapshot,
+// so the lookups are lock-free, and a modification only copies a small shard.
+//
+// the proxy indexes are random (generated by WireGuard or us), so the low bits are used to select the shard.
+type peerIndexMap struct {
+	shards [kPeerIndexMapShards]peerIndexMapShard
+}
+
+type peerIndexMapShard struct {
+	// serializes the modifications
+	lock sync.Mutex
+	m    atomic.Value // map[uint32]*Peer, must not be modified once stored
+}
+
+func newPeerIndexMap() (m *peerIndexMap) {
+	m = &peerIndexMap{}
+	for i := range m.shards {
+		m.shards[i].m.Store(make(map[uint32]*Peer))
+	}
+	return
+}
+
+func (m *peerIndexMap) shard(index uint32) *peerIndexMapShard {
+	return &m.shards[index&(kPeerIndexMapShards-1)]
+}
+
+func (s *peerIndexMapShard) snapshot() map[uint32]*Peer {
+	return s.m.Load().(map[uint32]*Peer)
+}
+
+func (m *peerIndexMap) Load(index uint32) (peer *Peer, ok bool) {
+	peer, ok = m.shard(index).snapshot()[index]
+	return
+}
+
+func (m *peerIndexMap) Store(index uint32, peer *Peer) {
+	s := m.shard(index)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.snapshot()
+	updated := make(map[uint32]*Peer, len(old)+1)
+	for k, v := range old {
+		updated[k] = v
+	}
+	updated[index] = peer
+	s.m.Store(updated)
+}
+
+// Delete deletes the indexes from the map, every shard is copied at most once.
+func (m *peerIndexMap) Delete(indexes ...uint32) {
+	shardIndexes := make(map[*peerIndexMapShard][]uint32)
+	for _, index := range indexes {
+		s := m.shard(index)
+		if _, ok := s.snapshot()[index]; ok {
+			shardIndexes[s] = append(shardIndexes[s], index)
+		}
+	}
+	for s, indexes := range shardIndexes {
+		s.delete(indexes)
+	}
+}
+
+func (s *peerIndexMapShard) delete(indexes []uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old := s.snapshot()
+	updated := make(map[uint32]*Peer, len(old))
+	for k, v := range old {
+		updated[k] = v
+	}
+	for _, index := range indexes {
+		delete(updated, index)
+	}
+	s.m.Store(updated)
+}
+
+// Range calls f for every peer in the snapshots of the shards, until f returns false.
+func (m *peerIndexMap) Range(f func(index uint32, peer *Peer) bool) {
+	for i := range m.shards {
+		for index, peer := range m.shards[i].snapshot() {
+			if !f(index, peer) {
+				return
+			}
+		}
+	}
+}
+
+func (m *peerIndexMap) Len() (n int) {
+	for i := range m.shards {
+		n += len(m.shards[i].snapshot())
+	}
+	return
+}
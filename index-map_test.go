@@ -0,0 +1,124 @@
+package mwgp
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const kBenchmarkPeers = 100000
+
+func TestPeerIndexMap(t *testing.T) {
+	m := newPeerIndexMap()
+	peers := make(map[uint32]*Peer)
+	for i := 0; i < 1000; i++ {
+		index := rand.Uint32()
+		peers[index] = &Peer{clientProxyIndex: index}
+		m.Store(index, peers[index])
+	}
+	if m.Len() != len(peers) {
+		t.Fatalf("expected %d peers, got %d", len(peers), m.Len())
+	}
+	for index, peer := range peers {
+		if p, ok := m.Load(index); !ok || p != peer {
+			t.Fatalf("peer %08x not found", index)
+		}
+	}
+
+	var deleted []uint32
+	for index := range peers {
+		if len(deleted) == len(peers)/2 {
+			break
+		}
+		deleted = append(deleted, index)
+	}
+	m.Delete(deleted...)
+	for _, index := range deleted {
+		if _, ok := m.Load(index); ok {
+			t.Fatalf("peer %08x not deleted", index)
+		}
+		delete(peers, index)
+	}
+
+	ranged := 0
+	m.Range(func(index uint32, peer *Peer) bool {
+		if peers[index] != peer {
+			t.Errorf("unexpected peer %08x", index)
+		}
+		ranged++
+		return true
+	})
+	if ranged != len(peers) || m.Len() != len(peers) {
+		t.Errorf("expected %d peers, ranged %d, len %d", len(peers), ranged, m.Len())
+	}
+}
+
+// newBenchmarkTable returns a table with kBenchmarkPeers replied peers, and their serverProxyIndex.
+func newBenchmarkTable() (table *WireGuardIndexTranslationTable, serverProxyIndexes []uint32) {
+	table = NewWireGuardIndexTranslationTable()
+	now := time.Now()
+	table.expireWheel = newExpireWheel(table.Timeout, now)
+	clientDestination := netip.MustParseAddrPort("192.0.2.1:51820")
+	for i := 0; i < kBenchmarkPeers; i++ {
+		peer := &Peer{
+			clientDestination:         clientDestination,
+			clientSourceValidateLevel: SourceValidateLevelIPAndPort,
+		}
+		peer.touch(now)
+		peer.clientProxyIndex = table.generateProxyIndexLocked(table.clientMap, rand.Uint32())
+		table.clientMap.Store(peer.clientProxyIndex, peer)
+		peer.serverProxyIndex = table.generateProxyIndexLocked(table.serverMap, rand.Uint32())
+		table.serverMap.Store(peer.serverProxyIndex, peer)
+		table.expireWheel.Schedule(peer, now.Add(table.Timeout))
+		serverProxyIndexes = append(serverProxyIndexes, peer.serverProxyIndex)
+	}
+	return
+}
+
+func BenchmarkPeerIndexMap_Load(b *testing.B) {
+	table, indexes := newBenchmarkTable()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Int()
+		for pb.Next() {
+			if _, ok := table.serverMap.Load(indexes[i%len(indexes)]); !ok {
+				b.Fatal("peer not found")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkPeerIndexMap_Store(b *testing.B) {
+	table, _ := newBenchmarkTable()
+	peer := &Peer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := rand.Uint32()
+		table.clientMap.Store(index, peer)
+		table.clientMap.Delete(index)
+	}
+}
+
+func BenchmarkWireGuardIndexTranslationTable_MessageTransport(b *testing.B) {
+	table, indexes := newBenchmarkTable()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		packet := &Packet{
+			Data:   make([]byte, 32),
+			Length: 32,
+			Source: netip.MustParseAddrPort("192.0.2.1:51820"),
+		}
+		packet.Data[0] = 4 // MessageTransportType
+		i := rand.Int()
+		for pb.Next() {
+			_ = packet.SetReceiverIndex(indexes[i%len(indexes)])
+			_, err := table.processMessageTransport(packet, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"golang.zx2c4.com/wireguard/device"
 	"os"
@@ -37,6 +38,34 @@ func (devicexType) isZero(val []byte) bool {
 	return acc == 1
 }
 
+// DecryptInitiationPublicKey decrypts the static public key of the client from the MessageInitiation,
+// if it is sent to the privateKey.
+func DecryptInitiationPublicKey(privateKey NoisePrivateKey, msg *device.MessageInitiation) (clientPublicKey NoisePublicKey, err error) {
+	ourPublicKey := privateKey.PublicKey()
+
+	// most implementation here is copied from device.Device.ConsumeMessageInitiation().
+	var (
+		hash     [blake2s.Size]byte
+		chainKey [blake2s.Size]byte
+	)
+
+	devicex.mixHash(&hash, &device.InitialHash, ourPublicKey.NoisePublicKey[:])
+	devicex.mixHash(&hash, &hash, msg.Ephemeral[:])
+	devicex.mixKey(&chainKey, &device.InitialChainKey, msg.Ephemeral[:])
+
+	// decrypt static key
+	var key [chacha20poly1305.KeySize]byte
+	ss := privateKey.SharedSecret(msg.Ephemeral)
+	if devicex.isZero(ss[:]) {
+		err = fmt.Errorf("invalid ephemeral key")
+		return
+	}
+	device.KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err = aead.Open(clientPublicKey.NoisePublicKey[:0], device.ZeroNonce[:], msg.Static[:], hash[:])
+	return
+}
+
 type NoisePublicKey struct {
 	device.NoisePublicKey
 }
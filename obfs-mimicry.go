@@ -0,0 +1,304 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"golang.zx2c4.com/wireguard/device"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Protocol mimicry wraps the obfuscated packets with a header of another
+// well-known UDP protocol, so they will not be identified as random-looking
+// UDP by DPI.
+//
+// The wrapped header does not carry any state of the flow,
+// so the packets can still be deobfuscated without per-flow state.
+//
+// A. QUIC (v1)
+// A.1. MessageInitiation, MessageResponse and MessageCookieReply are wrapped
+//      into a long header Initial packet with random DCID and SCID.
+//      MessageInitiation is padded to at least 1200 bytes as required by RFC 9000.
+// A.2. MessageTransport is wrapped into a short header packet,
+//      with an 8-bytes DCID derived from the receiver_index and the user key,
+//      so all packets of the same session share the same DCID.
+//
+// B. DTLS (1.2)
+// B.1. MessageInitiation, MessageResponse and MessageCookieReply are wrapped
+//      into a handshake record, MessageTransport is wrapped into an
+//      application_data record.
+// B.2. The sequence number of records is increased per packet, the handshake
+//      records are in epoch 0 and the application_data records in epoch 1.
+
+const (
+	ObfuscateMimicryNone = ""
+	ObfuscateMimicryQUIC = "quic"
+	ObfuscateMimicryDTLS = "dtls"
+)
+
+const (
+	kQUICVersion1                = 0x00000001
+	kQUICLongHeaderFormBits      = 0b11000000
+	kQUICLongHeaderTypeMask      = 0b00110000
+	kQUICShortHeaderFormBits     = 0b01000000
+	kQUICMaxConnectionIDLength   = 20
+	kQUICMinConnectionIDLength   = 8
+	kQUICShortHeaderDCIDLength   = 8
+	kQUICShortHeaderLength       = 1 + kQUICShortHeaderDCIDLength
+	kQUICInitialMinPacketLength  = 1200
+	kQUICLongHeaderMinLength     = 1 + 4 + 1 + kQUICMinConnectionIDLength + 1 + kQUICMinConnectionIDLength + 1 + 2
+	kQUICMaxTwoBytesVarintLength = 0x3fff
+
+	kDTLSContentTypeHandshake       = 22
+	kDTLSContentTypeApplicationData = 23
+	kDTLSVersion12                  = 0xfefd
+	kDTLSRecordHeaderLength         = 13
+)
+
+func (o *WireGuardObfuscator) SetMimicry(mimicry string) (err error) {
+	switch mimicry {
+	case ObfuscateMimicryNone:
+	case ObfuscateMimicryQUIC, ObfuscateMimicryDTLS:
+		if !o.enabled {
+			err = fmt.Errorf("mimicry %s requires obfuscation to be enabled", mimicry)
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown mimicry: %s", mimicry)
+		return
+	}
+	o.mimicry = mimicry
+	return
+}
+
+// mimicryMinLength returns the minimum length of the obfuscated packet (without mimicry header).
+func (o *WireGuardObfuscator) mimicryMinLength(messageType int) int {
+	if o.mimicry == ObfuscateMimicryQUIC && messageType == device.MessageInitiationType {
+		return kQUICInitialMinPacketLength - kQUICLongHeaderMinLength
+	}
+	return 0
+}
+
+// mimicryTransportOverhead returns the length of mimicry header added to every MessageTransport.
+func (o *WireGuardObfuscator) mimicryTransportOverhead() int {
+	switch o.mimicry {
+	case ObfuscateMimicryQUIC:
+		return kQUICShortHeaderLength
+	case ObfuscateMimicryDTLS:
+		return kDTLSRecordHeaderLength
+	}
+	return 0
+}
+
+// mimicryWrap wraps the obfuscated packet with the mimicry header.
+//
+// messageType and receiverIndex are the values before the packet obfuscated.
+func (o *WireGuardObfuscator) mimicryWrap(packet *Packet, messageType int, receiverIndex uint32) {
+	switch o.mimicry {
+	case ObfuscateMimicryQUIC:
+		if messageType == device.MessageTransportType {
+			o.quicWrapShortHeader(packet, receiverIndex)
+		} else {
+			o.quicWrapLongHeader(packet)
+		}
+	case ObfuscateMimicryDTLS:
+		o.dtlsWrapRecord(packet, messageType)
+	}
+}
+
+// mimicryHeaderLength returns the length of the mimicry header of the packet, without modifying it.
+//
+// returns false if the packet is not wrapped with the expected mimicry header.
+func (o *WireGuardObfuscator) mimicryHeaderLength(packet *Packet) (headerLength int, ok bool) {
+	switch o.mimicry {
+	case ObfuscateMimicryQUIC:
+		if packet.Length < 1 {
+			return
+		}
+		if packet.Data[0]&kQUICLongHeaderFormBits == kQUICLongHeaderFormBits {
+			headerLength, ok = o.quicLongHeaderLength(packet)
+		} else if packet.Data[0]&kQUICLongHeaderFormBits == kQUICShortHeaderFormBits {
+			headerLength, ok = kQUICShortHeaderLength, true
+		}
+	case ObfuscateMimicryDTLS:
+		headerLength, ok = o.dtlsRecordHeaderLength(packet)
+	default:
+		ok = true
+		return
+	}
+	if ok && packet.Length < headerLength+device.MinMessageSize {
+		ok = false
+	}
+	return
+}
+
+// prependHeader moves the packet data backward to make room for a header with headerLength.
+func (o *WireGuardObfuscator) prependHeader(packet *Packet, headerLength int) (header []byte, ok bool) {
+	if packet.Length+headerLength > len(packet.Data) {
+		return
+	}
+	copy(packet.Data[headerLength:packet.Length+headerLength], packet.Data[:packet.Length])
+	packet.Length += headerLength
+	header = packet.Data[:headerLength]
+	ok = true
+	return
+}
+
+func (o *WireGuardObfuscator) quicWrapLongHeader(packet *Packet) {
+	dcidLength := kQUICMinConnectionIDLength + rand.Intn(kQUICMaxConnectionIDLength-kQUICMinConnectionIDLength+1)
+	scidLength := kQUICMinConnectionIDLength
+	payloadLength := packet.Length
+	lengthLength := 2
+	if payloadLength > kQUICMaxTwoBytesVarintLength {
+		lengthLength = 4
+	}
+	headerLength := 1 + 4 + 1 + dcidLength + 1 + scidLength + 1 + lengthLength
+	header, ok := o.prependHeader(packet, headerLength)
+	if !ok {
+		return
+	}
+
+	// header form (1) + fixed bit (1) + long packet type (Initial, 00) + protected bits (random)
+	header[0] = kQUICLongHeaderFormBits | byte(rand.Intn(0x10))
+	binary.BigEndian.PutUint32(header[1:], kQUICVersion1)
+	offset := 5
+	header[offset] = byte(dcidLength)
+	offset++
+	_, _ = rand.Read(header[offset : offset+dcidLength])
+	offset += dcidLength
+	header[offset] = byte(scidLength)
+	offset++
+	_, _ = rand.Read(header[offset : offset+scidLength])
+	offset += scidLength
+	// token length
+	header[offset] = 0
+	offset++
+	// length, as a 2-bytes (or 4-bytes for the large ones) variable-length integer
+	if lengthLength == 2 {
+		binary.BigEndian.PutUint16(header[offset:], 0x4000|uint16(payloadLength))
+	} else {
+		binary.BigEndian.PutUint32(header[offset:], 0x80000000|uint32(payloadLength))
+	}
+}
+
+func (o *WireGuardObfuscator) quicLongHeaderLength(packet *Packet) (headerLength int, ok bool) {
+	data := packet.Data[:packet.Length]
+	if len(data) < 7 {
+		return
+	}
+	if data[0]&kQUICLongHeaderTypeMask != 0 {
+		// not an Initial packet
+		return
+	}
+	if binary.BigEndian.Uint32(data[1:]) != kQUICVersion1 {
+		return
+	}
+	offset := 5
+	for i := 0; i < 2; i++ {
+		// DCID and SCID
+		cidLength := int(data[offset])
+		offset++
+		if cidLength > kQUICMaxConnectionIDLength || offset+cidLength > len(data) {
+			return
+		}
+		offset += cidLength
+	}
+	tokenLength, n := quicReadVarint(data[offset:])
+	if n == 0 || uint64(len(data)-offset-n) < tokenLength {
+		return
+	}
+	offset += n + int(tokenLength)
+	payloadLength, n := quicReadVarint(data[offset:])
+	if n == 0 {
+		return
+	}
+	offset += n
+	if uint64(len(data)-offset) != payloadLength {
+		return
+	}
+	headerLength, ok = offset, true
+	return
+}
+
+func (o *WireGuardObfuscator) quicWrapShortHeader(packet *Packet, receiverIndex uint32) {
+	header, ok := o.prependHeader(packet, kQUICShortHeaderLength)
+	if !ok {
+		return
+	}
+
+	// header form (0) + fixed bit (1) + spin bit, reserved bits, key phase, packet number length (random)
+	header[0] = kQUICShortHeaderFormBits | byte(rand.Intn(0x40))
+
+	var digest xxhash.Digest
+	digest.Reset()
+	_, _ = digest.Write(o.userKeyHash[:])
+	var index [4]byte
+	binary.LittleEndian.PutUint32(index[:], receiverIndex)
+	_, _ = digest.Write(index[:])
+	binary.BigEndian.PutUint64(header[1:], digest.Sum64())
+}
+
+// quicReadVarint reads a variable-length integer defined in RFC 9000 section 16.
+//
+// returns n = 0 if b is too short.
+func quicReadVarint(b []byte) (value uint64, n int) {
+	if len(b) < 1 {
+		return
+	}
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return
+	}
+	value = uint64(b[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(b[i])
+	}
+	n = length
+	return
+}
+
+func (o *WireGuardObfuscator) dtlsWrapRecord(packet *Packet, messageType int) {
+	payloadLength := packet.Length
+	if payloadLength > 0xffff {
+		return
+	}
+	header, ok := o.prependHeader(packet, kDTLSRecordHeaderLength)
+	if !ok {
+		return
+	}
+
+	if messageType == device.MessageTransportType {
+		header[0] = kDTLSContentTypeApplicationData
+	} else {
+		header[0] = kDTLSContentTypeHandshake
+	}
+	binary.BigEndian.PutUint16(header[1:], kDTLSVersion12)
+	// epoch (2 bytes) + sequence_number (6 bytes),
+	// the handshake records are sent before ChangeCipherSpec in epoch 0.
+	var epoch uint64
+	if messageType == device.MessageTransportType {
+		epoch = 1
+	}
+	sequence := atomic.AddUint64(&o.dtlsSequence, 1) & 0xffffffffffff
+	binary.BigEndian.PutUint64(header[3:], epoch<<48|sequence)
+	binary.BigEndian.PutUint16(header[11:], uint16(payloadLength))
+}
+
+func (o *WireGuardObfuscator) dtlsRecordHeaderLength(packet *Packet) (headerLength int, ok bool) {
+	data := packet.Data[:packet.Length]
+	if len(data) < kDTLSRecordHeaderLength {
+		return
+	}
+	if data[0] != kDTLSContentTypeHandshake && data[0] != kDTLSContentTypeApplicationData {
+		return
+	}
+	if binary.BigEndian.Uint16(data[1:]) != kDTLSVersion12 {
+		return
+	}
+	if int(binary.BigEndian.Uint16(data[11:])) != len(data)-kDTLSRecordHeaderLength {
+		return
+	}
+	headerLength, ok = kDTLSRecordHeaderLength, true
+	return
+}
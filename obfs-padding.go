@@ -0,0 +1,226 @@
+package mwgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.zx2c4.com/wireguard/device"
+	"math/rand"
+	"net/netip"
+	"sort"
+)
+
+// Padding policy for obfuscated MessageTransport.
+//
+// The length of MessageTransport leaks the length of the inner packet,
+// the padding policy pads them to make the traffic analysis harder,
+// at the cost of bandwidth.
+//
+// A. Framing
+// A.1. MessageTransport uses the reserved bytes (packet[1:4]) as the framing header,
+//      which is covered by the obfuscation of the first 16 bytes.
+// A.2. packet[1]&0x01: 16-bytes nonce is appended (see obfs.go).
+// A.3. packet[1]&0x02: the packet is padded, the padding length is stored in packet[2:4] (little-endian).
+//      The padding is appended after the origin packet, and before the nonce.
+// A.4. packet[1]&0x04: the packet is a chaff packet, which should be dropped after deobfuscated.
+//
+// B. Padding
+// B.1. All lengths in the policy are the length of the final UDP payload,
+//      including the appended nonce and the mimicry header.
+// B.2. Add a random length between [0, random_max] to the packet.
+// B.3. Round the length up to the smallest bucket that can hold it.
+// B.4. The length never exceeds the mtu. If the packet is already larger than it, do not pad.
+//
+// C. Chaff
+// C.1. After every obfuscated MessageTransport sent, send a chaff packet to the
+//      same destination with probability chaff_rate.
+// C.2. Chaff packets look like a keepalive MessageTransport of the same session,
+//      and follow the same padding policy.
+
+const (
+	kObfuscateTransportFlagNonce   = 0x01
+	kObfuscateTransportFlagPadding = 0x02
+	kObfuscateTransportFlagChaff   = 0x04
+
+	kObfuscatePaddingMaxLength = 0xffff
+
+	// payload size of a MessageTransport from a WireGuard interface with default MTU (1420)
+	kObfuscatePaddingDefaultMTU = 1452
+)
+
+type ObfuscatePaddingConfig struct {
+	// Buckets are the candidate lengths to pad the MessageTransport to, e.g. [256, 512, 1452].
+	Buckets []int `json:"buckets,omitempty"`
+
+	// RandomMax is the max random length added to every MessageTransport.
+	RandomMax int `json:"random_max,omitempty"`
+
+	// MTU is the max length of a padded MessageTransport, default to 1452.
+	MTU int `json:"mtu,omitempty"`
+
+	// ChaffRate is the probability to send a chaff packet after every MessageTransport, in [0, 1].
+	ChaffRate float64 `json:"chaff_rate,omitempty"`
+}
+
+type obfuscatePaddingPolicy struct {
+	buckets   []int
+	randomMax int
+	mtu       int
+	chaffRate float64
+}
+
+func (o *WireGuardObfuscator) SetPadding(config *ObfuscatePaddingConfig) (err error) {
+	if config == nil {
+		o.padding = nil
+		return
+	}
+	if !o.enabled {
+		err = fmt.Errorf("padding requires obfuscation to be enabled")
+		return
+	}
+	policy := &obfuscatePaddingPolicy{
+		buckets:   append([]int(nil), config.Buckets...),
+		randomMax: config.RandomMax,
+		mtu:       config.MTU,
+		chaffRate: config.ChaffRate,
+	}
+	if policy.mtu == 0 {
+		policy.mtu = kObfuscatePaddingDefaultMTU
+	}
+	if policy.mtu < device.MessageTransportSize || policy.mtu > kObfuscatePaddingMaxLength {
+		err = fmt.Errorf("invalid mtu: %d", policy.mtu)
+		return
+	}
+	if policy.randomMax < 0 || policy.randomMax > kObfuscatePaddingMaxLength {
+		err = fmt.Errorf("invalid random_max: %d", policy.randomMax)
+		return
+	}
+	for _, bucket := range policy.buckets {
+		if bucket <= 0 {
+			err = fmt.Errorf("invalid bucket: %d", bucket)
+			return
+		}
+	}
+	sort.Ints(policy.buckets)
+	if policy.chaffRate < 0 || policy.chaffRate > 1 {
+		err = fmt.Errorf("invalid chaff_rate: %f", policy.chaffRate)
+		return
+	}
+	o.padding = policy
+	return
+}
+
+// finalTransportLength returns the UDP payload length of an obfuscated MessageTransport.
+func (o *WireGuardObfuscator) finalTransportLength(length int) int {
+	if length < kObfuscateSuffixAsNonceMinLength {
+		length += kObfuscateNonceLength
+	}
+	return length + o.mimicryTransportOverhead()
+}
+
+// transportLengthForFinal is the inverse function of finalTransportLength.
+func (o *WireGuardObfuscator) transportLengthForFinal(final int) int {
+	length := final - o.mimicryTransportOverhead()
+	if length < kObfuscateSuffixAsNonceMinLength {
+		length -= kObfuscateNonceLength
+	}
+	return length
+}
+
+// padTransport pads the MessageTransport according to the padding policy.
+func (o *WireGuardObfuscator) padTransport(packet *Packet) {
+	if o.padding == nil {
+		return
+	}
+	policy := o.padding
+
+	final := o.finalTransportLength(packet.Length)
+	if policy.randomMax > 0 {
+		final += rand.Intn(policy.randomMax + 1)
+	}
+	for _, bucket := range policy.buckets {
+		if bucket >= final {
+			final = bucket
+			break
+		}
+	}
+	if final > policy.mtu {
+		final = policy.mtu
+	}
+
+	paddedLength := o.transportLengthForFinal(final)
+	if paddedLength > len(packet.Data)-kObfuscateNonceLength-o.mimicryTransportOverhead() {
+		return
+	}
+	paddingLength := paddedLength - packet.Length
+	if paddingLength <= 0 || paddingLength > kObfuscatePaddingMaxLength {
+		return
+	}
+	_, _ = rand.Read(packet.Data[packet.Length:paddedLength])
+	packet.Data[1] |= kObfuscateTransportFlagPadding
+	binary.LittleEndian.PutUint16(packet.Data[2:4], uint16(paddingLength))
+	packet.Length = paddedLength
+}
+
+// unpaddedTransportLength returns the length of a MessageTransport without the nonce and the padding,
+// with the first 4 bytes of it deobfuscated in header.
+//
+// returns false if the framing header is invalid.
+func unpaddedTransportLength(header []byte, length int) (unpadded int, chaff bool, ok bool) {
+	flags := header[1]
+	if flags&^(kObfuscateTransportFlagNonce|kObfuscateTransportFlagPadding|kObfuscateTransportFlagChaff) != 0 {
+		return
+	}
+	unpadded = length
+	if flags&kObfuscateTransportFlagNonce != 0 {
+		unpadded -= kObfuscateNonceLength
+	}
+	if flags&kObfuscateTransportFlagPadding != 0 {
+		paddingLength := int(binary.LittleEndian.Uint16(header[2:4]))
+		if unpadded-paddingLength < device.MessageTransportSize {
+			return
+		}
+		unpadded -= paddingLength
+	} else if header[2] != 0 || header[3] != 0 {
+		return
+	}
+	chaff = flags&kObfuscateTransportFlagChaff != 0
+	ok = true
+	return
+}
+
+func (o *WireGuardObfuscator) shouldSendChaff(messageType int) bool {
+	if o.padding == nil || o.padding.chaffRate == 0 {
+		return false
+	}
+	if messageType != device.MessageTransportType {
+		return false
+	}
+	return rand.Float64() < o.padding.chaffRate
+}
+
+// writeChaff sends a keepalive-looking chaff packet for the session of receiverIndex from the local address.
+func (o *WireGuardObfuscator) writeChaff(transport Transport, destination netip.AddrPort, local netip.Addr, receiverIndex uint32) (err error) {
+	var chaff *Packet
+	if o.packetPool != nil {
+		chaff = o.packetPool.Get().(*Packet)
+		defer func() {
+			chaff.Reset()
+			o.packetPool.Put(chaff)
+		}()
+	} else {
+		chaff = &Packet{Data: make([]byte, o.padding.mtu+kObfuscateNonceLength+o.mimicryTransportOverhead())}
+	}
+	chaff.Length = device.MessageTransportSize
+	chaff.Destination = destination
+	chaff.Flags = PacketFlagObfuscateBeforeSend
+	chaff.Local = local
+	chaff.Data[0] = device.MessageTransportType
+	chaff.Data[1] = kObfuscateTransportFlagChaff
+	chaff.Data[2] = 0
+	chaff.Data[3] = 0
+	binary.LittleEndian.PutUint32(chaff.Data[4:8], receiverIndex)
+	_, _ = rand.Read(chaff.Data[8:chaff.Length])
+	o.Obfuscate(chaff)
+	err = transport.WritePacket(chaff)
+	return
+}
@@ -6,6 +6,8 @@ import (
 	"golang.zx2c4.com/wireguard/device"
 	"math/rand"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 )
 
@@ -47,6 +49,14 @@ import (
 // C. Modified XXHASH64
 // C.1.  Modified XXHASH64 is a patched XXHASH64 function which must returns a pattern that changes original WireGuard protocol.
 //       So the packets of original WireGuard protocol can be distinguished from obfuscated packets.
+//
+// D. Padding (optional)
+// D.1.  Before A.1c, pad MessageTransport according to the padding policy, see obfs-padding.go.
+// D.2.  In B.5b, remove the padding according to the framing header.
+//
+// E. Protocol Mimicry (optional)
+// E.1.  After A.4, wrap the obfuscated packet with a header of QUIC or DTLS, see obfs-mimicry.go.
+// E.2.  Before B.2, remove the header, drop the packet if it is not wrapped with the expected header.
 
 const (
 	kObfuscateRandomSuffixMaxLength  = 384
@@ -59,11 +69,16 @@ const (
 )
 
 type WireGuardObfuscator struct {
+	// accessed atomically, keep it 64-bit aligned
+	dtlsSequence uint64
+
 	enabled     bool
 	userKeyHash [sha256.Size]byte
+	mimicry     string
+	padding     *obfuscatePaddingPolicy
 
-	ReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	WriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
+	// packetPool is the packet pool of WireGuardIndexTranslationTable to obtain the chaff packets from (optional).
+	packetPool *sync.Pool
 }
 
 func (o *WireGuardObfuscator) Initialize(userKey string) {
@@ -98,10 +113,14 @@ func (o *WireGuardObfuscator) Obfuscate(packet *Packet) {
 	}
 
 	messageType := packet.MessageType()
+	receiverIndex, _ := packet.ReceiverIndex()
 	var obfsPartLength int
 	switch messageType {
 	case device.MessageInitiationType:
 		packet.Length = device.MessageInitiationSize + kObfuscateNonceLength + rand.Int()%kObfuscateRandomSuffixMaxLength
+		if minLength := o.mimicryMinLength(messageType); packet.Length < minLength {
+			packet.Length = minLength + rand.Int()%kObfuscateRandomSuffixMaxLength
+		}
 		obfsPartLength = device.MessageInitiationSize
 		if isAllZero(packet.Data[kMessageInitiationTypeMAC2Offset:device.MessageInitiationSize]) {
 			packet.Data[1] = 0x01
@@ -122,8 +141,9 @@ func (o *WireGuardObfuscator) Obfuscate(packet *Packet) {
 		_, _ = rand.Read(packet.Data[obfsPartLength:packet.Length])
 	case device.MessageTransportType:
 		obfsPartLength = device.MessageTransportHeaderSize
+		o.padTransport(packet)
 		if packet.Length < kObfuscateSuffixAsNonceMinLength {
-			packet.Data[1] = 0x01
+			packet.Data[1] |= kObfuscateTransportFlagNonce
 			packet.Length += kObfuscateNonceLength
 			_, _ = rand.Read(packet.Data[packet.Length-kObfuscateNonceLength : packet.Length])
 		}
@@ -148,9 +168,35 @@ func (o *WireGuardObfuscator) Obfuscate(packet *Packet) {
 			packet.Data[j] ^= xorKey[j-i]
 		}
 	}
+
+	o.mimicryWrap(packet, messageType, receiverIndex)
 }
 
 func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
+	var header obfuscatedHeader
+	if !o.decodeHeader(packet, &header) {
+		return
+	}
+	o.deobfuscateWithHeader(packet, &header)
+}
+
+// obfuscatedHeader is the header of an obfuscated packet, decoded without modifying the packet.
+type obfuscatedHeader struct {
+	mimicryLength int
+	// the first kObfuscateXORKeyLength bytes, deobfuscated
+	data   [kObfuscateXORKeyLength]byte
+	digest xxhash.Digest
+
+	// for MessageTransport only, the length without the nonce and the padding,
+	// and whether the framing header is valid
+	transportLength int
+	transportChaff  bool
+	transportValid  bool
+}
+
+// decodeHeader decodes the header of the packet without modifying it,
+// returns false if the packet is not obfuscated.
+func (o *WireGuardObfuscator) decodeHeader(packet *Packet, header *obfuscatedHeader) (ok bool) {
 	if !o.enabled {
 		return
 	}
@@ -162,22 +208,43 @@ func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
 		// non-obfuscated WireGuard packet
 		return
 	}
+	header.mimicryLength, ok = o.mimicryHeaderLength(packet)
+	if !ok {
+		return
+	}
 
-	var nonce [kObfuscateNonceLength]byte
-	copy(nonce[:], packet.Data[packet.Length-kObfuscateNonceLength:])
-
-	var digest xxhash.Digest
-	digest.Reset()
-	_, _ = digest.Write(nonce[:])
+	header.digest.Reset()
+	_, _ = header.digest.Write(packet.Data[packet.Length-kObfuscateNonceLength : packet.Length])
 
 	// decode first 8 bytes for message type
-	_, _ = digest.Write(o.userKeyHash[:])
-	var xorKey [kObfuscateXORKeyLength]byte
-	digest.Sum(xorKey[:0])
-	o.modifyHashMaskForWireGuardHeaderConflict(xorKey[:])
-	for i := 0; i < kObfuscateXORKeyLength; i++ {
-		packet.Data[i] ^= xorKey[i]
+	_, _ = header.digest.Write(o.userKeyHash[:])
+	header.digest.Sum(header.data[:0])
+	o.modifyHashMaskForWireGuardHeaderConflict(header.data[:])
+	for i := range header.data {
+		header.data[i] ^= packet.Data[header.mimicryLength+i]
 	}
+	if header.data[0] == device.MessageTransportType {
+		header.transportLength, header.transportChaff, header.transportValid =
+			unpaddedTransportLength(header.data[:4], packet.Length-header.mimicryLength)
+	}
+	return
+}
+
+// isValidTransport reports whether the packet will be deobfuscated into a MessageTransport
+// with a valid framing header and at least device.MessageTransportSize.
+func (h *obfuscatedHeader) isValidTransport() bool {
+	return h.data[0] == device.MessageTransportType && h.transportValid && h.transportLength >= device.MessageTransportSize
+}
+
+// deobfuscateWithHeader deobfuscates the packet with the header from decodeHeader.
+func (o *WireGuardObfuscator) deobfuscateWithHeader(packet *Packet, header *obfuscatedHeader) {
+	if header.mimicryLength > 0 {
+		copy(packet.Data, packet.Data[header.mimicryLength:packet.Length])
+		packet.Length -= header.mimicryLength
+	}
+	copy(packet.Data, header.data[:])
+	digest := &header.digest
+	var xorKey [kObfuscateXORKeyLength]byte
 
 	memset := func(b []byte, c byte) {
 		for i := range b {
@@ -209,10 +276,17 @@ func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
 		obfsPartLength = device.MessageCookieReplySize
 	case device.MessageTransportType:
 		obfsPartLength = device.MessageTransportHeaderSize
-		if packet.Data[1] == 0x01 {
-			packet.Data[1] = 0
-			packet.Length -= kObfuscateNonceLength
+		if !header.transportValid {
+			// wtf?
+			return
 		}
+		packet.Length = header.transportLength
+		if header.transportChaff {
+			packet.Flags |= PacketFlagChaff
+		}
+		packet.Data[1] = 0
+		packet.Data[2] = 0
+		packet.Data[3] = 0
 	default:
 		// wtf?
 		return
@@ -230,30 +304,124 @@ func (o *WireGuardObfuscator) Deobfuscate(packet *Packet) {
 	packet.Flags |= PacketFlagDeobfuscatedAfterReceived
 }
 
-func (o *WireGuardObfuscator) WriteToUDPWithObfuscate(conn *net.UDPConn, packet *Packet) (err error) {
+// WritePacketWithObfuscate obfuscates the packet and writes it to the transport.
+func (o *WireGuardObfuscator) WritePacketWithObfuscate(transport Transport, packet *Packet) (err error) {
+	sendChaff := o.enabled && packet.Flags&PacketFlagObfuscateBeforeSend != 0 && o.shouldSendChaff(packet.MessageType())
+	receiverIndex, _ := packet.ReceiverIndex()
 	o.Obfuscate(packet)
-	if o.WriteToUDPFunc == nil {
-		o.WriteToUDPFunc = defaultWriteToUDPFunc
-	}
-	err = o.WriteToUDPFunc(conn, packet)
+	err = transport.WritePacket(packet)
 	if err != nil {
 		return
 	}
+	if sendChaff {
+		err = o.writeChaff(transport, packet.Destination, packet.Local, receiverIndex)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func (o *WireGuardObfuscator) ReadFromUDPWithDeobfuscate(conn *net.UDPConn, packet *Packet) (err error) {
-	if o.ReadFromUDPFunc == nil {
-		o.ReadFromUDPFunc = defaultReadFromUDPFunc
+// ReadPacketWithDeobfuscate reads a packet from the transport and deobfuscates it,
+// chaff packets are dropped.
+func (o *WireGuardObfuscator) ReadPacketWithDeobfuscate(transport Transport, packet *Packet) (err error) {
+	for {
+		err = transport.ReadPacket(packet)
+		if err != nil {
+			return
+		}
+		o.Deobfuscate(packet)
+		if packet.Flags&PacketFlagChaff == 0 {
+			break
+		}
+		packet.Flags &^= PacketFlagChaff | PacketFlagDeobfuscatedAfterReceived
 	}
-	err = o.ReadFromUDPFunc(conn, packet)
+	return
+}
+
+// WritePacketsWithObfuscate is the batch version of WritePacketWithObfuscate.
+func (o *WireGuardObfuscator) WritePacketsWithObfuscate(transport Transport, packets []*Packet) (err error) {
+	type chaffTarget struct {
+		destination   netip.AddrPort
+		local         netip.Addr
+		receiverIndex uint32
+	}
+	var chaffTargets []chaffTarget
+	for _, packet := range packets {
+		if o.enabled && packet.Flags&PacketFlagObfuscateBeforeSend != 0 && o.shouldSendChaff(packet.MessageType()) {
+			receiverIndex, _ := packet.ReceiverIndex()
+			chaffTargets = append(chaffTargets, chaffTarget{packet.Destination, packet.Local, receiverIndex})
+		}
+		o.Obfuscate(packet)
+	}
+	err = writePackets(transport, packets)
 	if err != nil {
 		return
 	}
-	o.Deobfuscate(packet)
+	for _, target := range chaffTargets {
+		err = o.writeChaff(transport, target.destination, target.local, target.receiverIndex)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
+// ReadPacketsWithDeobfuscate is the batch version of ReadPacketWithDeobfuscate.
+func (o *WireGuardObfuscator) ReadPacketsWithDeobfuscate(transport Transport, packets []*Packet) (n int, err error) {
+	for {
+		n, err = readPackets(transport, packets)
+		if err != nil {
+			return
+		}
+		n = compactPackets(packets, n, func(packet *Packet) bool {
+			o.Deobfuscate(packet)
+			return packet.Flags&PacketFlagChaff == 0
+		})
+		if n > 0 {
+			return
+		}
+	}
+}
+
+// WrapTransport returns a Transport which obfuscates the packets written to the transport,
+// and deobfuscates the packets read from it.
+func (o *WireGuardObfuscator) WrapTransport(transport Transport) Transport {
+	return &obfuscatedTransport{
+		Transport:  transport,
+		obfuscator: o,
+	}
+}
+
+type obfuscatedTransport struct {
+	Transport
+	obfuscator *WireGuardObfuscator
+}
+
+func (t *obfuscatedTransport) ReadPacket(packet *Packet) (err error) {
+	return t.obfuscator.ReadPacketWithDeobfuscate(t.Transport, packet)
+}
+
+func (t *obfuscatedTransport) WritePacket(packet *Packet) (err error) {
+	return t.obfuscator.WritePacketWithObfuscate(t.Transport, packet)
+}
+
+func (t *obfuscatedTransport) LocalAddr() net.Addr {
+	return transportLocalAddr(t.Transport)
+}
+
+func (t *obfuscatedTransport) BatchSize() int {
+	return transportBatchSize(t.Transport)
+}
+
+func (t *obfuscatedTransport) ReadPackets(packets []*Packet) (n int, err error) {
+	return t.obfuscator.ReadPacketsWithDeobfuscate(t.Transport, packets)
+}
+
+func (t *obfuscatedTransport) WritePackets(packets []*Packet) (err error) {
+	return t.obfuscator.WritePacketsWithObfuscate(t.Transport, packets)
+}
+
 func (o *WireGuardObfuscator) modifyHashMaskForWireGuardHeaderConflict(b []byte) {
 	if b[0]&0b11111000 == 0 && b[1]&0b11111110 == 0 {
 		b[0] |= 0b11010111
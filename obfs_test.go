@@ -1,8 +1,11 @@
 package mwgp
 
 import (
+	"bytes"
 	"crypto/rand"
 	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"sync"
 	"testing"
 )
 
@@ -17,11 +20,285 @@ func TestWireGuardObfuscator_Obfuscate(t *testing.T) {
 	}
 }
 
+func TestWireGuardObfuscator_Mimicry(t *testing.T) {
+	for _, mimicry := range []string{ObfuscateMimicryQUIC, ObfuscateMimicryDTLS} {
+		testObfuscateWithMimicry(t, mimicry, device.MessageInitiationType, device.MessageInitiationSize, true)
+		testObfuscateWithMimicry(t, mimicry, device.MessageInitiationType, device.MessageInitiationSize, false)
+		testObfuscateWithMimicry(t, mimicry, device.MessageResponseType, device.MessageResponseSize, true)
+		testObfuscateWithMimicry(t, mimicry, device.MessageResponseType, device.MessageResponseSize, false)
+		testObfuscateWithMimicry(t, mimicry, device.MessageCookieReplyType, device.MessageCookieReplySize, false)
+		for i := device.MinMessageSize; i <= 1500; i++ {
+			testObfuscateWithMimicry(t, mimicry, device.MessageTransportType, i, false)
+		}
+	}
+}
+
+func TestWireGuardObfuscator_MimicryHeader(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+
+	newPacket := func(messageType byte, messageLength int) *Packet {
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+		p.Data[0] = messageType
+		p.Length = messageLength
+		_, _ = rand.Read(p.Data[4:p.Length])
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		return p
+	}
+
+	err := obfuscator.SetMimicry(ObfuscateMimicryQUIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPacket(device.MessageInitiationType, device.MessageInitiationSize)
+	obfuscator.Obfuscate(p)
+	if p.Data[0]&0xf0 != 0xc0 || p.Data[1] != 0 || p.Data[2] != 0 || p.Data[3] != 0 || p.Data[4] != 1 {
+		t.Errorf("MessageInitiation is not wrapped as QUIC Initial: % x", p.Data[:5])
+	}
+	if p.Length < kQUICInitialMinPacketLength {
+		t.Errorf("QUIC Initial is too short: %d", p.Length)
+	}
+	p = newPacket(device.MessageTransportType, 128)
+	_ = p.SetReceiverIndex(0x12345678)
+	dcid := make([]byte, kQUICShortHeaderDCIDLength)
+	obfuscator.Obfuscate(p)
+	copy(dcid, p.Data[1:kQUICShortHeaderLength])
+	if p.Data[0]&0xc0 != 0x40 {
+		t.Errorf("MessageTransport is not wrapped as QUIC short header packet: %x", p.Data[0])
+	}
+	p = newPacket(device.MessageTransportType, 256)
+	_ = p.SetReceiverIndex(0x12345678)
+	obfuscator.Obfuscate(p)
+	if !bytes.Equal(dcid, p.Data[1:kQUICShortHeaderLength]) {
+		t.Errorf("QUIC DCID changed in the same session: % x => % x", dcid, p.Data[1:kQUICShortHeaderLength])
+	}
+	// the payload over 0x3fff bytes has a 4-bytes length
+	p = &Packet{Data: make([]byte, defaultMaxPacketSize), Length: 20000}
+	obfuscator.quicWrapLongHeader(p)
+	if headerLength, ok := obfuscator.quicLongHeaderLength(p); !ok || p.Length-headerLength != 20000 {
+		t.Errorf("large QUIC Initial is not wrapped: %d bytes", p.Length)
+	}
+
+	err = obfuscator.SetMimicry(ObfuscateMimicryDTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = newPacket(device.MessageResponseType, device.MessageResponseSize)
+	obfuscator.Obfuscate(p)
+	if p.Data[0] != kDTLSContentTypeHandshake || p.Data[1] != 0xfe || p.Data[2] != 0xfd || p.Data[3] != 0 || p.Data[4] != 0 {
+		t.Errorf("MessageResponse is not wrapped as DTLS handshake record in epoch 0: % x", p.Data[:5])
+	}
+	p = newPacket(device.MessageTransportType, 128)
+	obfuscator.Obfuscate(p)
+	if p.Data[0] != kDTLSContentTypeApplicationData || p.Data[1] != 0xfe || p.Data[2] != 0xfd || p.Data[3] != 0 || p.Data[4] != 1 {
+		t.Errorf("MessageTransport is not wrapped as DTLS application_data record in epoch 1: % x", p.Data[:5])
+	}
+
+	err = obfuscator.SetMimicry("http")
+	if err == nil {
+		t.Errorf("unknown mimicry accepted")
+	}
+}
+
+func TestWireGuardObfuscator_Padding(t *testing.T) {
+	for _, mimicry := range []string{ObfuscateMimicryNone, ObfuscateMimicryQUIC, ObfuscateMimicryDTLS} {
+		var obfuscator WireGuardObfuscator
+		obfuscator.Initialize("test")
+		err := obfuscator.SetMimicry(mimicry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = obfuscator.SetPadding(&ObfuscatePaddingConfig{
+			Buckets: []int{1452, 256, 512},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := device.MessageTransportSize; i <= 1500; i++ {
+			var p Packet
+			p.Data = make([]byte, defaultMaxPacketSize)
+			p.Data[0] = device.MessageTransportType
+			p.Length = i
+			_, _ = rand.Read(p.Data[4:p.Length])
+			origin := append([]byte(nil), p.Slice()...)
+
+			p.Flags |= PacketFlagObfuscateBeforeSend
+			obfuscator.Obfuscate(&p)
+			finalLength := obfuscator.finalTransportLength(i)
+			var expectedLength int
+			switch {
+			case finalLength <= 256:
+				expectedLength = 256
+			case finalLength <= 512:
+				expectedLength = 512
+			case finalLength <= 1452:
+				expectedLength = 1452
+			default:
+				expectedLength = finalLength
+			}
+			if p.Length != expectedLength {
+				t.Errorf("unexpected padded length (mimicry=%q, length=%d): expected %d, got %d", mimicry, i, expectedLength, p.Length)
+			}
+
+			obfuscator.Deobfuscate(&p)
+			if !bytes.Equal(origin, p.Slice()) {
+				t.Errorf("obfuscate/deobfuscate with padding failed (mimicry=%q, length=%d)", mimicry, i)
+			}
+		}
+	}
+}
+
+func TestWireGuardObfuscator_PaddingMTU(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	err := obfuscator.SetPadding(&ObfuscatePaddingConfig{
+		RandomMax: 1000,
+		MTU:       600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		var p Packet
+		p.Data = make([]byte, defaultMaxPacketSize)
+		p.Data[0] = device.MessageTransportType
+		p.Length = device.MessageTransportSize + i%500
+		p.Flags |= PacketFlagObfuscateBeforeSend
+		obfuscator.Obfuscate(&p)
+		if p.Length > 600 {
+			t.Fatalf("padded length %d exceeds mtu", p.Length)
+		}
+	}
+}
+
+func TestWireGuardObfuscator_Chaff(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	err := obfuscator.SetPadding(&ObfuscatePaddingConfig{ChaffRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Packet
+	p.Data = make([]byte, defaultMaxPacketSize)
+	p.Data[0] = device.MessageTransportType
+	p.Data[1] = kObfuscateTransportFlagChaff
+	p.Length = device.MessageTransportSize
+	p.Flags |= PacketFlagObfuscateBeforeSend
+	obfuscator.Obfuscate(&p)
+	obfuscator.Deobfuscate(&p)
+	if p.Flags&PacketFlagChaff == 0 {
+		t.Errorf("chaff packet not detected")
+	}
+	if !obfuscator.shouldSendChaff(device.MessageTransportType) {
+		t.Errorf("chaff not sent with chaff_rate=1")
+	}
+	if obfuscator.shouldSendChaff(device.MessageInitiationType) {
+		t.Errorf("chaff sent for handshake message")
+	}
+}
+
+func TestWireGuardObfuscator_ChaffFromPacketPool(t *testing.T) {
+	var obfuscator WireGuardObfuscator
+	obfuscator.Initialize("test")
+	err := obfuscator.SetPadding(&ObfuscatePaddingConfig{ChaffRate: 1, RandomMax: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocated int
+	var pool sync.Pool
+	pool.New = func() interface{} {
+		allocated++
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+		// the recycled packets are not cleared
+		for i := range p.Data {
+			p.Data[i] = 0xff
+		}
+		return p
+	}
+	obfuscator.packetPool = &pool
+
+	transport := newTestTransport()
+	defer transport.Close()
+	destination := netip.MustParseAddrPort("192.0.2.1:51820")
+	for i := 0; i < 4; i++ {
+		err = obfuscator.writeChaff(transport, destination, netip.Addr{}, 0x12345678)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := <-transport.writeChan
+		var p Packet
+		p.Data = make([]byte, defaultMaxPacketSize)
+		p.Length = copy(p.Data, d.data)
+		obfuscator.Deobfuscate(&p)
+		if p.Flags&PacketFlagChaff == 0 || d.addr != destination {
+			t.Errorf("invalid chaff packet")
+		}
+	}
+	if allocated == 0 {
+		t.Errorf("chaff packets are not taken from the packet pool")
+	}
+}
+
+func TestWireGuardObfuscator_DecodeHeader(t *testing.T) {
+	for _, mimicry := range []string{ObfuscateMimicryNone, ObfuscateMimicryQUIC, ObfuscateMimicryDTLS} {
+		var obfuscator WireGuardObfuscator
+		obfuscator.Initialize("test")
+		err := obfuscator.SetMimicry(mimicry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = obfuscator.SetPadding(&ObfuscatePaddingConfig{RandomMax: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			var p Packet
+			p.Data = make([]byte, defaultMaxPacketSize)
+			p.Length = device.MinMessageSize + i%1000
+			_, _ = rand.Read(p.Data[:p.Length])
+			if i < 1000 {
+				// obfuscated ones, and random ones for the rest
+				p.Data[0] = device.MessageTransportType
+				p.Data[1] = 0
+				p.Data[2] = 0
+				p.Data[3] = 0
+				if i%2 == 1 {
+					p.Data[0] = device.MessageInitiationType
+					p.Length = device.MessageInitiationSize
+				}
+				p.Flags |= PacketFlagObfuscateBeforeSend
+				obfuscator.Obfuscate(&p)
+			}
+			origin := append([]byte(nil), p.Slice()...)
+			var header obfuscatedHeader
+			transport := obfuscator.decodeHeader(&p, &header) && header.isValidTransport()
+			if !bytes.Equal(origin, p.Slice()) {
+				t.Fatalf("packet modified (mimicry=%q)", mimicry)
+			}
+			obfuscator.Deobfuscate(&p)
+			expected := p.Flags&PacketFlagDeobfuscatedAfterReceived != 0 &&
+				p.MessageType() == device.MessageTransportType && p.Length >= device.MessageTransportSize
+			if transport != expected {
+				t.Errorf("unexpected result %t (mimicry=%q, i=%d)", transport, mimicry, i)
+			}
+		}
+	}
+}
+
 func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC2 bool) {
+	testObfuscateWithMimicry(t, ObfuscateMimicryNone, messageType, messageLength, allZeroMAC2)
+}
+
+func testObfuscateWithMimicry(t *testing.T, mimicry string, messageType byte, messageLength int, allZeroMAC2 bool) {
 	var obfuscator WireGuardObfuscator
 
 	obfuscator.Initialize("test")
+	err := obfuscator.SetMimicry(mimicry)
+	if err != nil {
+		t.Fatal(err)
+	}
 	var p Packet
+	p.Data = make([]byte, defaultMaxPacketSize)
 	p.Data[0] = messageType
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -47,6 +324,7 @@ func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC
 	//t.Logf("origin packet: length=%d data=%v\n", p.Length, p.Data[:p.Length])
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data[:p.Length]...)
 
 	p.Flags |= PacketFlagObfuscateBeforeSend
 	obfuscator.Obfuscate(&p)
@@ -72,7 +350,7 @@ func testObfuscate(t *testing.T, messageType byte, messageLength int, allZeroMAC
 	}
 
 	if !packetEqual(&originPacket, &p) {
-		t.Errorf("obfuscate/deobfuscate failed\n")
+		t.Errorf("obfuscate/deobfuscate failed (mimicry=%q, type=%d, length=%d)\n", mimicry, messageType, messageLength)
 	}
 
 	//t.Logf("deobfuscated packet: length=%d data=%v\n", p.Length, p.Data[:p.Length])
@@ -83,6 +361,7 @@ func BenchmarkWireGuardObfuscator_Obfuscate(b *testing.B) {
 
 	obfuscator.Initialize("test")
 	var p Packet
+	p.Data = make([]byte, defaultMaxPacketSize)
 	p.Data[0] = 4
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -92,11 +371,14 @@ func BenchmarkWireGuardObfuscator_Obfuscate(b *testing.B) {
 	p.Flags |= PacketFlagObfuscateBeforeSend
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		p = originPacket
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
 		b.StartTimer()
 		obfuscator.Obfuscate(&p)
 	}
@@ -107,6 +389,7 @@ func BenchmarkWireGuardObfuscator_Deobfuscate(b *testing.B) {
 
 	obfuscator.Initialize("test")
 	var p Packet
+	p.Data = make([]byte, defaultMaxPacketSize)
 	p.Data[0] = 4
 	p.Data[1] = 0
 	p.Data[2] = 0
@@ -117,11 +400,14 @@ func BenchmarkWireGuardObfuscator_Deobfuscate(b *testing.B) {
 	obfuscator.Obfuscate(&p)
 
 	originPacket := p
+	originPacket.Data = append([]byte(nil), p.Data...)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		p = originPacket
+		copy(p.Data, originPacket.Data)
+		p.Length = originPacket.Length
+		p.Flags = originPacket.Flags
 		b.StartTimer()
 		obfuscator.Deobfuscate(&p)
 	}
@@ -4,7 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"golang.zx2c4.com/wireguard/device"
-	"net"
+	"net/netip"
 )
 
 const (
@@ -14,22 +14,32 @@ const (
 const (
 	PacketFlagDeobfuscatedAfterReceived = 1 << iota
 	PacketFlagObfuscateBeforeSend
+	PacketFlagChaff
 )
 
 type Packet struct {
 	Data        []byte
 	Length      int
-	Source      *net.UDPAddr
-	Destination *net.UDPAddr
+	Source      netip.AddrPort
+	Destination netip.AddrPort
 	Flags       uint64
+
+	// Local is the local address the packet received on, or to be sent from (optional),
+	// set only if the transport listens on a wildcard address and supports IP_PKTINFO.
+	Local netip.Addr
+
+	// the transport the packet received from, or to be sent through
+	transport Transport
 }
 
 func (p *Packet) Reset() {
 	//p.Data = [kMTU]byte{}
 	p.Length = 0
-	p.Source = nil
-	p.Destination = nil
+	p.Source = netip.AddrPort{}
+	p.Destination = netip.AddrPort{}
 	p.Flags = 0
+	p.Local = netip.Addr{}
+	p.transport = nil
 }
 
 func (p *Packet) Slice() []byte {
@@ -0,0 +1,213 @@
+package mwgp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Peer events publish the real endpoints of the clients to the WireGuard servers out-of-band,
+// so the tooling on the servers can attribute the sessions without changing the WireGuard packets.
+
+const (
+	PeerEventHandshake = "handshake"
+
+	kPeerEventQueueSize       = 1024
+	kPeerEventWebhookTimeout  = 5 * time.Second
+	kPeerEventSubscriberLimit = 5 * time.Second
+)
+
+// PeerEvent is published on the peer create stage #2, when the server replied the handshake.
+type PeerEvent struct {
+	Event           string `json:"event"`
+	Time            string `json:"time"`
+	ClientPublicKey string `json:"client_pubkey"`
+	// ClientEndpoint is the real endpoint of the client.
+	ClientEndpoint string `json:"client_endpoint"`
+	// ServerEndpoint is the endpoint of the WireGuard server, i.e. forward_to.
+	ServerEndpoint string `json:"server_endpoint"`
+	// UpstreamPort is the source port of mwgp which the server sees as the endpoint of the client.
+	UpstreamPort int `json:"upstream_port,omitempty"`
+}
+
+func newPeerEvent(peer *Peer, serverTransport Transport) (event *PeerEvent) {
+	peer.endpointLock.RLock()
+	clientDestination := peer.clientDestination
+	serverDestination := peer.serverDestination
+	peer.endpointLock.RUnlock()
+
+	event = &PeerEvent{
+		Event:           PeerEventHandshake,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		ClientPublicKey: peer.clientPublicKey.Base64(),
+		ClientEndpoint:  clientDestination.String(),
+		ServerEndpoint:  serverDestination.String(),
+	}
+	if addr, ok := transportLocalAddr(serverTransport).(*net.UDPAddr); ok {
+		event.UpstreamPort = addr.Port
+	}
+	return
+}
+
+// transportLocalAddr returns the local address of the transport, or nil if it is unknown.
+func transportLocalAddr(transport Transport) net.Addr {
+	if t, ok := transport.(interface{ LocalAddr() net.Addr }); ok {
+		return t.LocalAddr()
+	}
+	return nil
+}
+
+type PeerEventsConfig struct {
+	// Webhook is the URL to POST every event as JSON (optional).
+	Webhook string `json:"webhook,omitempty"`
+	// UnixSocket is the path of a Unix socket to listen on,
+	// every connected reader receives the events as JSON lines (optional).
+	UnixSocket string `json:"unix_socket,omitempty"`
+	// File is the path of a file to append the events as JSON lines (optional).
+	File string `json:"file,omitempty"`
+}
+
+// peerEventPublisher publishes the events to the outputs in its own goroutine,
+// so the handshakes are never blocked by a slow output.
+type peerEventPublisher struct {
+	queue chan *PeerEvent
+
+	webhook string
+	client  *http.Client
+
+	file *os.File
+
+	listener    net.Listener
+	subscribers map[net.Conn]struct{}
+	lock        sync.Mutex
+}
+
+func newPeerEventPublisher(config *PeerEventsConfig) (p *peerEventPublisher, err error) {
+	if config.Webhook == "" && config.UnixSocket == "" && config.File == "" {
+		err = errors.New("no webhook, unix_socket or file specified")
+		return
+	}
+	p = &peerEventPublisher{
+		queue:       make(chan *PeerEvent, kPeerEventQueueSize),
+		webhook:     config.Webhook,
+		subscribers: make(map[net.Conn]struct{}),
+	}
+	if p.webhook != "" {
+		p.client = &http.Client{
+			Timeout: kPeerEventWebhookTimeout,
+		}
+	}
+	if config.File != "" {
+		p.file, err = os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			err = fmt.Errorf("failed to open peer events file %s: %w", config.File, err)
+			return
+		}
+	}
+	if config.UnixSocket != "" {
+		// remove the stale socket of the last run
+		_ = os.Remove(config.UnixSocket)
+		p.listener, err = net.Listen("unix", config.UnixSocket)
+		if err != nil {
+			if p.file != nil {
+				_ = p.file.Close()
+			}
+			err = fmt.Errorf("failed to listen on peer events socket %s: %w", config.UnixSocket, err)
+			return
+		}
+		go p.acceptLoop()
+	}
+	go p.publishLoop()
+	return
+}
+
+// Publish queues the event, it never blocks.
+func (p *peerEventPublisher) Publish(event *PeerEvent) {
+	select {
+	case p.queue <- event:
+	default:
+		log.Printf("[warn] peer events queue is full, dropped event of client %s\n", event.ClientEndpoint)
+	}
+}
+
+func (p *peerEventPublisher) acceptLoop() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[error] failed to accept peer events subscriber: %s\n", err.Error())
+			continue
+		}
+		p.lock.Lock()
+		p.subscribers[conn] = struct{}{}
+		p.lock.Unlock()
+	}
+}
+
+func (p *peerEventPublisher) publishLoop() {
+	for event := range p.queue {
+		line, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[error] failed to marshal peer event: %s\n", err.Error())
+			continue
+		}
+		line = append(line, '\n')
+		if p.file != nil {
+			_, err = p.file.Write(line)
+			if err != nil {
+				log.Printf("[error] failed to write peer event to file: %s\n", err.Error())
+			}
+		}
+		if p.listener != nil {
+			p.writeSubscribers(line)
+		}
+		if p.webhook != "" {
+			err = p.postWebhook(line)
+			if err != nil {
+				log.Printf("[error] failed to post peer event to webhook: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// writeSubscribers writes the line to every subscriber, the ones that cannot keep up are disconnected.
+func (p *peerEventPublisher) writeSubscribers(line []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for conn := range p.subscribers {
+		_ = conn.SetWriteDeadline(time.Now().Add(kPeerEventSubscriberLimit))
+		w := bufio.NewWriter(conn)
+		_, err := w.Write(line)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			_ = conn.Close()
+			delete(p.subscribers, conn)
+		}
+	}
+}
+
+func (p *peerEventPublisher) postWebhook(body []byte) (err error) {
+	resp, err := p.client.Post(p.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+		return
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package mwgp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerEventPublisher(t *testing.T) {
+	dir := t.TempDir()
+	webhookEvents := make(chan PeerEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event PeerEvent
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		webhookEvents <- event
+	}))
+	defer webhook.Close()
+
+	config := &PeerEventsConfig{
+		Webhook:    webhook.URL,
+		UnixSocket: filepath.Join(dir, "events.sock"),
+		File:       filepath.Join(dir, "events.jsonl"),
+	}
+	publisher, err := newPeerEventPublisher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.listener.Close()
+
+	subscriber, err := net.Dial("unix", config.UnixSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	// wait for the subscriber to be accepted
+	for {
+		publisher.lock.Lock()
+		n := len(publisher.subscribers)
+		publisher.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	expected := PeerEvent{
+		Event:           PeerEventHandshake,
+		ClientPublicKey: "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		ClientEndpoint:  "192.0.2.1:51820",
+		ServerEndpoint:  "192.0.2.2:51820",
+		UpstreamPort:    30000,
+	}
+	event := expected
+	publisher.Publish(&event)
+
+	select {
+	case received := <-webhookEvents:
+		if received != expected {
+			t.Errorf("unexpected webhook event %+v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	_ = subscriber.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(subscriber).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received PeerEvent
+	err = json.Unmarshal(line, &received)
+	if err != nil || received != expected {
+		t.Errorf("unexpected unix socket event %s", line)
+	}
+
+	// the file is written before the webhook is called
+	file, err := os.Open(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(line) {
+		t.Errorf("unexpected file content %s", content)
+	}
+}
@@ -0,0 +1,168 @@
+package mwgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A PeerProvider delegates the peers of the unknown client public keys to an external authority,
+// such as an HTTP service or a local database, instead of the fallback peer in the config.
+
+const (
+	// the time limit of ExtractPeerFunc, including the lookup of PeerProvider
+	kExtractPeerTimeout = 5 * time.Second
+
+	// the max number of the cached lookups, so the clients cannot exhaust the memory
+	kPeerProviderCacheSize = 65536
+
+	// the time to cache the failed lookups, so a failing provider is not called on every handshake
+	kPeerProviderFailureTTL = 5 * time.Second
+)
+
+// ErrPeerDenied is returned (or wrapped) by PeerProvider to refuse the client,
+// the refusal is cached like a peer, other errors are cached for kPeerProviderFailureTTL.
+var ErrPeerDenied = errors.New("peer denied")
+
+// PeerRequest describes the client of a MessageInitiation.
+type PeerRequest struct {
+	// ServerPublicKey is the public key of the server which decrypted the MessageInitiation.
+	ServerPublicKey NoisePublicKey
+	// ClientPublicKey is the decrypted static public key of the client.
+	ClientPublicKey NoisePublicKey
+	// Source is the endpoint of the client.
+	Source netip.AddrPort
+	// Listener is the local address the client sent to, nil if it is unknown.
+	Listener net.Addr
+}
+
+type PeerProvider interface {
+	// LookupPeer returns the peer of the client, which is initialized like the ones in the config of the server,
+	// or nil if it is unknown to the provider, then the fallback peer in the config is used.
+	// ttl is the time to cache the result, or 0 for the default one.
+	LookupPeer(ctx context.Context, request *PeerRequest) (sp *ServerConfigPeer, ttl time.Duration, err error)
+}
+
+// peerProviderCache caches the initialized peers (and the refusals) from a PeerProvider,
+// and the concurrent lookups of the same client share a single call to the provider.
+type peerProviderCache struct {
+	provider PeerProvider
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	entries map[peerProviderCacheKey]*peerProviderCacheEntry
+}
+
+type peerProviderCacheKey struct {
+	serverPublicKey NoisePublicKey
+	clientPublicKey NoisePublicKey
+	// the provider may decide by the source address, but not the port
+	source netip.Addr
+}
+
+type peerProviderCacheEntry struct {
+	// closed when the lookup is done, the fields below are set before it
+	done chan struct{}
+
+	sp      *ServerConfigPeer
+	err     error
+	expires time.Time
+}
+
+func (e *peerProviderCacheEntry) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func newPeerProviderCache(provider PeerProvider, ttl time.Duration) *peerProviderCache {
+	return &peerProviderCache{
+		provider: provider,
+		ttl:      ttl,
+		entries:  make(map[peerProviderCacheKey]*peerProviderCacheEntry),
+	}
+}
+
+// lookup returns the cached result, or looks up the provider and initializes the peer by initialize.
+// ctx only limits the wait of the caller, the shared lookup has its own time limit.
+func (c *peerProviderCache) lookup(ctx context.Context, request *PeerRequest, initialize func(sp *ServerConfigPeer) error) (sp *ServerConfigPeer, err error) {
+	key := peerProviderCacheKey{
+		serverPublicKey: request.ServerPublicKey,
+		clientPublicKey: request.ClientPublicKey,
+		source:          request.Source.Addr().Unmap(),
+	}
+	now := time.Now()
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok && entry.isDone() && !now.Before(entry.expires) {
+		ok = false
+	}
+	if !ok {
+		entry = &peerProviderCacheEntry{
+			done: make(chan struct{}),
+		}
+		c.storeLocked(key, entry, now)
+		copied := *request
+		go c.resolve(&copied, initialize, entry)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-entry.done:
+		sp, err = entry.sp, entry.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// resolve looks up the provider for the entry and marks it done.
+// it does not use the ctx of any caller, since the result is shared by all of them.
+func (c *peerProviderCache) resolve(request *PeerRequest, initialize func(sp *ServerConfigPeer) error, entry *peerProviderCacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), kExtractPeerTimeout)
+	defer cancel()
+
+	sp, ttl, err := c.provider.LookupPeer(ctx, request)
+	if err == nil && sp != nil {
+		copied := *sp
+		sp = &copied
+		err = initialize(sp)
+		if err != nil {
+			err = fmt.Errorf("invalid peer from provider: %w", err)
+			sp = nil
+		}
+	}
+	if err != nil && !errors.Is(err, ErrPeerDenied) {
+		ttl = kPeerProviderFailureTTL
+	} else if ttl <= 0 {
+		ttl = c.ttl
+	}
+
+	entry.sp = sp
+	entry.err = err
+	entry.expires = time.Now().Add(ttl)
+	close(entry.done)
+}
+
+// storeLocked stores the entry, the expired ones are removed if the cache is full.
+func (c *peerProviderCache) storeLocked(key peerProviderCacheKey, entry *peerProviderCacheEntry, now time.Time) {
+	if len(c.entries) >= kPeerProviderCacheSize {
+		for k, e := range c.entries {
+			if e.isDone() && !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= kPeerProviderCacheSize {
+			// the lookups in flight are still done for their callers
+			c.entries = make(map[peerProviderCacheKey]*peerProviderCacheEntry)
+		}
+	}
+	c.entries[key] = entry
+}
@@ -0,0 +1,106 @@
+package mwgp
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingPeerProvider blocks the lookups until release is closed.
+type blockingPeerProvider struct {
+	lookups int32
+	release chan struct{}
+	err     error
+}
+
+func (p *blockingPeerProvider) LookupPeer(ctx context.Context, request *PeerRequest) (sp *ServerConfigPeer, ttl time.Duration, err error) {
+	atomic.AddInt32(&p.lookups, 1)
+	<-p.release
+	if p.err != nil {
+		err = p.err
+		return
+	}
+	sp = &ServerConfigPeer{ForwardTo: ":1001"}
+	return
+}
+
+func TestPeerProviderCache(t *testing.T) {
+	provider := &blockingPeerProvider{release: make(chan struct{})}
+	c := newPeerProviderCache(provider, time.Minute)
+	initialize := func(sp *ServerConfigPeer) error {
+		return nil
+	}
+
+	// the concurrent lookups of the same client share a single call
+	request := &PeerRequest{Source: netip.MustParseAddrPort("192.0.2.1:51820")}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sp, err := c.lookup(context.Background(), request, initialize)
+			if err != nil || sp == nil || sp.ForwardTo != ":1001" {
+				t.Errorf("unexpected lookup result %+v, %v", sp, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&provider.lookups) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(provider.release)
+	wg.Wait()
+	if provider.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", provider.lookups)
+	}
+
+	// the failures are cached briefly
+	provider.err = errors.New("unavailable")
+	request = &PeerRequest{Source: netip.MustParseAddrPort("192.0.2.2:51820")}
+	for i := 0; i < 2; i++ {
+		_, err := c.lookup(context.Background(), request, initialize)
+		if !errors.Is(err, provider.err) {
+			t.Errorf("expected failure, got %v", err)
+		}
+	}
+	if provider.lookups != 2 {
+		t.Errorf("expected 2 lookups, got %d", provider.lookups)
+	}
+	entry := c.entries[peerProviderCacheKey{source: request.Source.Addr()}]
+	if ttl := time.Until(entry.expires); ttl > kPeerProviderFailureTTL {
+		t.Errorf("the failure is cached for %s", ttl)
+	}
+	entry.expires = time.Now()
+	_, _ = c.lookup(context.Background(), request, initialize)
+	if provider.lookups != 3 {
+		t.Errorf("expected the expired failure to be looked up again, got %d lookups", provider.lookups)
+	}
+}
+
+func TestPeerProviderCache_CanceledCaller(t *testing.T) {
+	provider := &blockingPeerProvider{release: make(chan struct{})}
+	c := newPeerProviderCache(provider, time.Minute)
+	initialize := func(sp *ServerConfigPeer) error {
+		return nil
+	}
+	request := &PeerRequest{Source: netip.MustParseAddrPort("192.0.2.1:51820")}
+
+	// the first caller gives up, but the shared lookup goes on for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.lookup(ctx, request, initialize)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+	close(provider.release)
+	sp, err := c.lookup(context.Background(), request, initialize)
+	if err != nil || sp == nil || sp.ForwardTo != ":1001" {
+		t.Errorf("unexpected lookup result %+v, %v", sp, err)
+	}
+	if n := atomic.LoadInt32(&provider.lookups); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+}
@@ -0,0 +1,137 @@
+package mwgp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The peer webhook authorizes the client public keys unknown to the config with an HTTP endpoint,
+// such as the one of a user database, so the users can be managed without reloading the config.
+
+const (
+	kPeerWebhookDefaultTTL   = 60 * time.Second
+	kPeerWebhookTimeout      = 5 * time.Second
+	kPeerWebhookMaxReplySize = 64 * 1024
+)
+
+type PeerWebhookConfig struct {
+	// URL is the HTTP endpoint to POST the PeerWebhookRequest to.
+	URL string `json:"url"`
+	// TTL is the seconds to cache the replies without a ttl, default to 60.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// PeerWebhookRequest is posted to the webhook as JSON on the handshakes of the unknown client public keys.
+type PeerWebhookRequest struct {
+	ServerPublicKey string `json:"server_pubkey"`
+	ClientPublicKey string `json:"client_pubkey"`
+	// Source is the endpoint of the client.
+	Source string `json:"source"`
+	// Listen is the local address the client sent to, empty if it is unknown.
+	Listen string `json:"listen,omitempty"`
+}
+
+// PeerWebhookReply is the reply of the webhook, with the fields of a peer in the config if allowed,
+// such as forward_to, rate_limit and quota. the webhook replies 204 No Content to use the fallback peer.
+type PeerWebhookReply struct {
+	Allow bool `json:"allow"`
+	// TTL is the seconds to cache the reply, 0 for the default one.
+	TTL int `json:"ttl,omitempty"`
+	ServerConfigPeer
+}
+
+// peerWebhook is a PeerProvider looking up the peers from the webhook.
+type peerWebhook struct {
+	url    string
+	client *http.Client
+}
+
+func newPeerWebhook(config *PeerWebhookConfig) (w *peerWebhook, err error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		err = fmt.Errorf("invalid url %s: %w", config.URL, err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("invalid url %s, must be http or https", config.URL)
+		return
+	}
+	if config.TTL < 0 {
+		err = fmt.Errorf("invalid ttl %d", config.TTL)
+		return
+	}
+	w = &peerWebhook{
+		url: config.URL,
+		client: &http.Client{
+			// the webhook is a local endpoint, never use the proxy from the environment
+			Transport: &http.Transport{
+				Proxy: nil,
+				DialContext: (&net.Dialer{
+					Timeout: kPeerWebhookTimeout,
+				}).DialContext,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			Timeout: kPeerWebhookTimeout,
+		},
+	}
+	return
+}
+
+func (w *peerWebhook) LookupPeer(ctx context.Context, request *PeerRequest) (sp *ServerConfigPeer, ttl time.Duration, err error) {
+	webhookRequest := &PeerWebhookRequest{
+		ServerPublicKey: request.ServerPublicKey.Base64(),
+		ClientPublicKey: request.ClientPublicKey.Base64(),
+		Source:          request.Source.String(),
+	}
+	if request.Listener != nil {
+		webhookRequest.Listen = request.Listener.String()
+	}
+	body, err := json.Marshal(webhookRequest)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to post peer webhook: %w", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("unexpected status %s from peer webhook", resp.Status)
+		return
+	}
+
+	var reply PeerWebhookReply
+	err = json.NewDecoder(io.LimitReader(resp.Body, kPeerWebhookMaxReplySize)).Decode(&reply)
+	if err != nil {
+		err = fmt.Errorf("invalid reply from peer webhook: %w", err)
+		return
+	}
+	if reply.TTL < 0 {
+		err = fmt.Errorf("invalid ttl %d from peer webhook", reply.TTL)
+		return
+	}
+	ttl = time.Duration(reply.TTL) * time.Second
+	if !reply.Allow {
+		err = ErrPeerDenied
+		return
+	}
+	sp = &reply.ServerConfigPeer
+	return
+}
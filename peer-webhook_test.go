@@ -0,0 +1,109 @@
+package mwgp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerWebhook(t *testing.T) {
+	var serverPrivateKey, allowedPrivateKey, deniedPrivateKey, unknownPrivateKey, failedPrivateKey NoisePrivateKey
+	_ = serverPrivateKey.FromBase64("kEi8S0d6T/8Kj7I1CFn5SezS4VyNQsOZ7XFxQH8RVms=")
+	_ = allowedPrivateKey.FromBase64("MB0pM6NZg0bO3QjUkPqgAtXzV1Tb2hnHO1SC3QGOQ1Q=")
+	_ = deniedPrivateKey.FromBase64("sJtkS0WB8U3A8nZp7tJqVDTn62z5bCvcNt0qMUlgE3A=")
+	_ = unknownPrivateKey.FromBase64("YEc3ZTo6/hxS7h2T4Ol9kHj3Dqz1dM1wJxUuM7KQh0Q=")
+	_ = failedPrivateKey.FromBase64("cF5m3w3e2XrCtkE0s7Cz8RaYp0m3DSo2Y4u3F0q7pEE=")
+
+	serverPublicKey := serverPrivateKey.PublicKey()
+	allowedPublicKey := allowedPrivateKey.PublicKey()
+	deniedPublicKey := deniedPrivateKey.PublicKey()
+	unknownPublicKey := unknownPrivateKey.PublicKey()
+	failedPublicKey := failedPrivateKey.PublicKey()
+
+	var lastRequest PeerWebhookRequest
+	var lock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request PeerWebhookRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		lastRequest = request
+		lock.Unlock()
+		switch request.ClientPublicKey {
+		case allowedPublicKey.Base64():
+			_, _ = w.Write([]byte(`{"allow":true,"ttl":300,"forward_to":":1001","rate_limit":{"rate":125000}}`))
+		case deniedPublicKey.Base64():
+			_, _ = w.Write([]byte(`{"allow":false}`))
+		case unknownPublicKey.Base64():
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := newPeerWebhook(&PeerWebhookConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(client NoisePublicKey) (sp *ServerConfigPeer, ttl time.Duration, err error) {
+		request := &PeerRequest{
+			ServerPublicKey: serverPublicKey,
+			ClientPublicKey: client,
+			Source:          netip.MustParseAddrPort("192.0.2.1:51820"),
+			Listener:        &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 51820},
+		}
+		sp, ttl, err = webhook.LookupPeer(context.Background(), request)
+		return
+	}
+
+	sp, ttl, err := lookup(allowedPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp == nil || sp.ForwardTo != ":1001" || sp.RateLimit == nil || sp.RateLimit.Rate != 125000 || ttl != 300*time.Second {
+		t.Errorf("unexpected peer %+v with ttl %s", sp, ttl)
+	}
+
+	_, _, err = lookup(deniedPublicKey)
+	if !errors.Is(err, ErrPeerDenied) {
+		t.Errorf("expected denied, got %v", err)
+	}
+
+	sp, _, err = lookup(unknownPublicKey)
+	if sp != nil || err != nil {
+		t.Errorf("expected no decision, got %+v, %v", sp, err)
+	}
+
+	_, _, err = lookup(failedPublicKey)
+	if err == nil || errors.Is(err, ErrPeerDenied) {
+		t.Errorf("expected failure, got %v", err)
+	}
+
+	expected := PeerWebhookRequest{
+		ServerPublicKey: serverPublicKey.Base64(),
+		ClientPublicKey: failedPublicKey.Base64(),
+		Source:          "192.0.2.1:51820",
+		Listen:          "192.0.2.2:51820",
+	}
+	lock.Lock()
+	if lastRequest != expected {
+		t.Errorf("unexpected request %+v", lastRequest)
+	}
+	lock.Unlock()
+
+	_, err = newPeerWebhook(&PeerWebhookConfig{URL: "unix:///run/peers.sock"})
+	if err == nil {
+		t.Error("expected invalid url")
+	}
+}
@@ -1,20 +1,22 @@
 package mwgp
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"golang.org/x/crypto/blake2s"
-	"golang.org/x/crypto/chacha20poly1305"
 	"golang.zx2c4.com/wireguard/device"
 	"log"
 	"net"
+	"net/netip"
+	"runtime"
 	"strings"
 	"time"
 )
 
 type ServerConfigPeer struct {
 	ForwardTo        string `json:"forward_to"`
-	forwardToAddress *net.UDPAddr
+	forwardToAddress netip.AddrPort
 
 	// ClientSourceValidateLevel is same config with the one in ServerConfigServer
 	// but intended to be used as a per-peer override.
@@ -26,14 +28,66 @@ type ServerConfigPeer struct {
 
 	ClientPublicKey *NoisePublicKey `json:"pubkey,omitempty"`
 
+	// UpstreamObfuscateKey is same config with the one in ServerConfigServer
+	// but intended to be used as a per-peer override.
+	UpstreamObfuscateKey string `json:"upstream_obfs,omitempty"`
+
+	// UpstreamObfuscateMimicry is same config with the one in ServerConfigServer
+	// but intended to be used as a per-peer override.
+	UpstreamObfuscateMimicry string `json:"upstream_obfs_mimicry,omitempty"`
+
+	// RateLimit is same config with the one in ServerConfigServer
+	// but intended to be used as a per-peer override.
+	RateLimit *BandwidthLimitConfig `json:"rate_limit,omitempty"`
+
+	// Quota is same config with the one in ServerConfigServer
+	// but intended to be used as a per-peer override.
+	Quota *TrafficQuotaConfig `json:"quota,omitempty"`
+
+	// AllowFrom and DenyFrom are the CIDR lists of the client sources,
+	// checked in addition to the ones in ServerConfigServer and ServerConfig.
+	AllowFrom []string `json:"allow_from,omitempty"`
+	DenyFrom  []string `json:"deny_from,omitempty"`
+
+	// NotBefore and NotAfter are the RFC 3339 timestamps of the validity of the peer (optional).
+	NotBefore string `json:"not_before,omitempty"`
+	NotAfter  string `json:"not_after,omitempty"`
+
+	// Schedule is the weekly time ranges the peer is allowed in, such as "Mon-Fri 09:00-18:00" (optional).
+	Schedule []string `json:"schedule,omitempty"`
+
+	// ScheduleTimezone is the IANA time zone of Schedule, default to UTC.
+	ScheduleTimezone string `json:"schedule_tz,omitempty"`
+
+	// From is the CIDR list of the client sources the peer applies to (optional),
+	// so the same client public key can be forwarded to different servers depending on its source.
+	// the peers are matched in order, the first one with the client public key and the source wins.
+	From         []string `json:"from,omitempty"`
+	fromPrefixes []netip.Prefix
+
+	// FallbackOutsideWindow uses the fallback peer for the client out of the access window,
+	// instead of refusing it.
+	FallbackOutsideWindow bool `json:"fallback_outside_window,omitempty"`
+
 	// required by cookie generator
 	serverPublicKey NoisePublicKey
+
+	// the source filter of the peer, chained to the one of the server
+	sourceFilter *SourceFilter
+
+	// parsed from NotBefore, NotAfter and Schedule
+	access *AccessWindow
 }
 
 func (p ServerConfigPeer) isFallback() bool {
 	return p.ClientPublicKey == nil
 }
 
+// matchesSource returns true if the peer applies to the client source.
+func (p *ServerConfigPeer) matchesSource(source netip.Addr) bool {
+	return len(p.fromPrefixes) == 0 || containsAddr(p.fromPrefixes, source.Unmap())
+}
+
 const (
 	SourceValidateLevelDefault = iota
 
@@ -72,6 +126,32 @@ type ServerConfigServer struct {
 	// ServerSourceValidateLevel specified the way to handle a MessageTransport
 	// packet that comes from a source address not matches to prior packets.
 	ServerSourceValidateLevel int `json:"ssvl,omitempty"`
+
+	// UpstreamObfuscateKey is the obfuscation password used on the hop to the
+	// forward_to address, so that the upstream can be another mwgp-server.
+	UpstreamObfuscateKey string `json:"upstream_obfs,omitempty"`
+
+	// UpstreamObfuscateMimicry is the obfs_mimicry of the upstream mwgp-server.
+	UpstreamObfuscateMimicry string `json:"upstream_obfs_mimicry,omitempty"`
+
+	// UpstreamBind is the local address to forward the packets to the forward_to addresses from,
+	// such as "192.0.2.10" or "192.0.2.10:51820", overrides upstream_listen (optional).
+	UpstreamBind        string `json:"upstream_bind,omitempty"`
+	upstreamBindAddress *net.UDPAddr
+
+	// RateLimit limits the bandwidth of every client public key in each direction (optional).
+	RateLimit *BandwidthLimitConfig `json:"rate_limit,omitempty"`
+
+	// Quota limits the traffic of every client public key in a period (optional).
+	Quota *TrafficQuotaConfig `json:"quota,omitempty"`
+
+	// AllowFrom and DenyFrom are the CIDR lists of the client sources of the peers (optional),
+	// checked on the handshakes and the roaming clients.
+	AllowFrom    []string `json:"allow_from,omitempty"`
+	DenyFrom     []string `json:"deny_from,omitempty"`
+	sourceFilter *SourceFilter
+
+	publicKey NoisePublicKey
 }
 
 func (s *ServerConfigServer) Initialize() (err error) {
@@ -98,47 +178,111 @@ func (s *ServerConfigServer) Initialize() (err error) {
 		}
 	}
 
+	s.publicKey = s.PrivateKey.PublicKey()
+
+	s.sourceFilter, err = NewSourceFilter(s.AllowFrom, s.DenyFrom, nil)
+	if err != nil {
+		return
+	}
+
 	var foundFallback bool
 	for pi, p := range s.Peers {
-		if p.ClientPublicKey == nil {
+		// more fallback peers can be matched by the source
+		if p.ClientPublicKey == nil && len(p.From) == 0 {
 			if foundFallback {
-				err = fmt.Errorf("multiple fallback peers found")
+				err = fmt.Errorf("multiple fallback peers without from found")
 				return
 			}
 			foundFallback = true
 		}
-
-		if len(p.ForwardTo) == 0 {
-			err = fmt.Errorf("peer[%d] has no forward_to address", pi)
+		err = s.initializePeer(p)
+		if err != nil {
+			err = fmt.Errorf("peer[%d]: %w", pi, err)
 			return
 		}
+	}
+	return
+}
+
+// initializePeer resolves the peer with the config of the server,
+// for both the peers in the config and the ones from PeerProvider.
+func (s *ServerConfigServer) initializePeer(p *ServerConfigPeer) (err error) {
+	p.fromPrefixes, err = parsePrefixes(p.From)
+	if err != nil {
+		err = fmt.Errorf("invalid from: %w", err)
+		return
+	}
+
+	if len(p.ForwardTo) == 0 {
+		err = fmt.Errorf("no forward_to address")
+		return
+	}
+
+	forwardToTokens := strings.Split(p.ForwardTo, ":")
+	if len(forwardToTokens) != 2 {
+		err = fmt.Errorf("invalid forward_to address %s", p.ForwardTo)
+		return
+	}
+	address := strings.TrimSpace(forwardToTokens[0])
+	port := strings.TrimSpace(forwardToTokens[1])
+	if len(address) == 0 {
+		address = s.Address
+	}
+	forwardToAddress := strings.Join([]string{address, port}, ":")
+	var forwardToUDPAddr *net.UDPAddr
+	forwardToUDPAddr, err = net.ResolveUDPAddr("udp", forwardToAddress)
+	if err != nil {
+		err = fmt.Errorf("invalid forward_to address %s: %w", p.ForwardTo, err)
+		return
+	}
+	p.forwardToAddress = addrPortFromUDPAddr(forwardToUDPAddr)
 
-		forwardToTokens := strings.Split(p.ForwardTo, ":")
-		if len(forwardToTokens) != 2 {
-			err = fmt.Errorf("peer[%d] has invalid forward_to address %s", pi, p.ForwardTo)
+	if p.ClientSourceValidateLevel == SourceValidateLevelDefault {
+		p.ClientSourceValidateLevel = s.ClientSourceValidateLevel
+	}
+	if p.ServerSourceValidateLevel == SourceValidateLevelDefault {
+		p.ServerSourceValidateLevel = s.ServerSourceValidateLevel
+	}
+	if p.UpstreamObfuscateKey == "" {
+		p.UpstreamObfuscateKey = s.UpstreamObfuscateKey
+	}
+	if p.UpstreamObfuscateMimicry == "" {
+		p.UpstreamObfuscateMimicry = s.UpstreamObfuscateMimicry
+	}
+	if p.RateLimit == nil {
+		p.RateLimit = s.RateLimit
+	}
+	if p.RateLimit != nil {
+		err = p.RateLimit.Validate()
+		if err != nil {
+			err = fmt.Errorf("invalid rate_limit: %w", err)
 			return
 		}
-		address := strings.TrimSpace(forwardToTokens[0])
-		port := strings.TrimSpace(forwardToTokens[1])
-		if len(address) == 0 {
-			address = s.Address
-		}
-		forwardToAddress := strings.Join([]string{address, port}, ":")
-		p.forwardToAddress, err = net.ResolveUDPAddr("udp", forwardToAddress)
+	}
+	if p.Quota == nil {
+		p.Quota = s.Quota
+	}
+	if p.Quota != nil {
+		err = p.Quota.Validate()
 		if err != nil {
-			err = fmt.Errorf("peer[%d] has invalid forward_to address %s: %w", pi, p.ForwardTo, err)
+			err = fmt.Errorf("invalid quota: %w", err)
 			return
 		}
-
-		if p.ClientSourceValidateLevel == SourceValidateLevelDefault {
-			p.ClientSourceValidateLevel = s.ClientSourceValidateLevel
-		}
-		if p.ServerSourceValidateLevel == SourceValidateLevelDefault {
-			p.ServerSourceValidateLevel = s.ServerSourceValidateLevel
-		}
-
-		p.serverPublicKey = s.PrivateKey.PublicKey()
 	}
+	p.sourceFilter, err = NewSourceFilter(p.AllowFrom, p.DenyFrom, s.sourceFilter)
+	if err != nil {
+		return
+	}
+	p.access, err = NewAccessWindow(p.NotBefore, p.NotAfter, p.Schedule, p.ScheduleTimezone)
+	if err != nil {
+		return
+	}
+	if p.FallbackOutsideWindow && p.isFallback() {
+		err = fmt.Errorf("fallback_outside_window is not allowed on the fallback peer")
+		return
+	}
+
+	p.serverPublicKey = s.publicKey
 	return
 }
 
@@ -148,12 +292,93 @@ type ServerConfig struct {
 	MaxPacketSize int                   `json:"max_packet_size,omitempty"`
 	Servers       []*ServerConfigServer `json:"servers"`
 	ObfuscateKey  string                `json:"obfs"`
+	// ObfuscateMimicry wraps the obfuscated packets to look like another protocol,
+	// can be "quic" or "dtls" (optional).
+	ObfuscateMimicry string `json:"obfs_mimicry,omitempty"`
+	// ObfuscatePadding is the padding policy of obfuscated MessageTransport (optional).
+	ObfuscatePadding *ObfuscatePaddingConfig `json:"obfs_padding,omitempty"`
+	// StrictObfuscate drops every packet from clients that cannot be deobfuscated into
+	// a valid MessageInitiation (with valid MAC1) or MessageTransport silently.
+	// vanilla WireGuard clients cannot connect to the server with this option enabled.
+	StrictObfuscate bool `json:"strict_obfs,omitempty"`
+	// Decoy is the address of a UDP service (such as a DNS or QUIC server),
+	// packets dropped by StrictObfuscate will be forwarded to it.
+	Decoy string `json:"decoy,omitempty"`
+	// Listens are more addresses to listen on, such as the specific IPv4 and IPv6 addresses (optional).
+	// every one of them can also be a port range.
+	Listens []string `json:"listens,omitempty"`
+	// ListenTCP is the address to accept mwgp-client with the "tcp" transport (optional).
+	ListenTCP string `json:"listen_tcp,omitempty"`
+	// ListenWebSocket is the address to accept mwgp-client with the "ws" transport (optional).
+	ListenWebSocket string `json:"listen_ws,omitempty"`
+	// WebSocketPath is the HTTP path of the WebSocket endpoint, default to "/".
+	WebSocketPath string `json:"ws_path,omitempty"`
+	// Workers is the number of forwarding workers, default to GOMAXPROCS.
+	// every worker has its own SO_REUSEPORT sockets on the listen ports and its own socket to servers.
+	Workers int `json:"workers,omitempty"`
+	// UpstreamSocket allocates dedicated sockets to servers, "peer" for every peer (handshake session)
+	// or "pubkey" for every client public key, so servers can distinguish the clients by the source port.
+	// "transparent" binds the sockets to the addresses of clients, so servers see the real ones (Linux only).
+	// all the peers share the socket of the worker by default.
+	UpstreamSocket string `json:"upstream_socket,omitempty"`
+	// UpstreamListen is the local address to forward the packets to servers from,
+	// such as "192.0.2.10" or "192.0.2.10:51820" (optional). the port is shared by the workers.
+	UpstreamListen string `json:"upstream_listen,omitempty"`
+	// UpstreamPortRange is the local port range of the dedicated sockets, e.g. "30000-39999" (optional).
+	UpstreamPortRange string `json:"upstream_port_range,omitempty"`
+	// ListenSocketOptions are the socket options of the listen sockets to clients (optional).
+	ListenSocketOptions *SocketOptions `json:"listen_sockopt,omitempty"`
+	// UpstreamSocketOptions are the socket options of the sockets to servers (optional).
+	UpstreamSocketOptions *SocketOptions `json:"upstream_sockopt,omitempty"`
+	// PeerEvents publishes the client public key, the real client endpoint and the upstream source port
+	// on every handshake, so the tooling on servers can attribute the sessions to the clients (optional).
+	PeerEvents *PeerEventsConfig `json:"peer_events,omitempty"`
+	// HandshakeRateLimit limits the handshake packets from clients by source, client public key
+	// and the number of concurrent ones, the dropped ones are counted and logged periodically (optional).
+	HandshakeRateLimit *HandshakeRateLimitConfig `json:"handshake_rate_limit,omitempty"`
+	// TrafficUsageFile is the file to persist the usage of the traffic quotas across restarts (optional).
+	TrafficUsageFile string `json:"traffic_usage_file,omitempty"`
+	// AllowFrom and DenyFrom are the CIDR lists of the client sources of all the servers (optional),
+	// the handshakes from the denied sources are dropped before the DH operations.
+	AllowFrom []string `json:"allow_from,omitempty"`
+	DenyFrom  []string `json:"deny_from,omitempty"`
+	// PeerWebhook authorizes the client public keys unknown to the config with an HTTP endpoint,
+	// before the fallback peer, the replies are cached for their TTL (optional).
+	PeerWebhook *PeerWebhookConfig `json:"peer_webhook,omitempty"`
 	WGITCacheConfig
 }
 
 type Server struct {
 	wgitTable *WireGuardIndexTranslationTable
 	servers   []*ServerConfigServer
+	listens   []*net.UDPAddr
+	workers   int
+	// the local address of the sockets to servers, nil for the wildcard address
+	upstreamListen *net.UDPAddr
+	// socket options of the listen sockets and the sockets to servers
+	listenSocketOptions   *SocketOptions
+	upstreamSocketOptions *SocketOptions
+	obfuscator            *WireGuardObfuscator
+
+	// forward_to address -> obfuscator for the upstream hop,
+	// the only source of truth of upstream_obfs for both directions.
+	upstreamObfuscators map[netip.AddrPort]*WireGuardObfuscator
+	// forward_to IP -> obfuscator for the replies from other ports (allowed by ssvl),
+	// nil if the forward_to addresses of the IP do not share the same upstream_obfs.
+	upstreamObfuscatorsByIP map[netip.Addr]*WireGuardObfuscator
+
+	// for strict_obfs only
+	strictObfuscate bool
+	cookieCheckers  []*device.CookieChecker
+	decoy           *decoyForwarder
+
+	// looks up the unknown client public keys, nil if not set
+	peerProvider *peerProviderCache
+
+	// for stream transports only
+	listenTCP       string
+	listenWebSocket string
+	webSocketPath   string
 }
 
 func NewServerWithConfig(config *ServerConfig) (outServer *Server, err error) {
@@ -173,10 +398,37 @@ func NewServerWithConfig(config *ServerConfig) (outServer *Server, err error) {
 	server := Server{}
 	server.servers = config.Servers
 	server.wgitTable = NewWireGuardIndexTranslationTable()
-	server.wgitTable.ClientListen, err = net.ResolveUDPAddr("udp", config.Listen)
-	if err != nil {
-		err = fmt.Errorf("invalid listen address %s: %w", config.Listen, err)
-		return
+	listenAddresses := config.Listens
+	if config.Listen != "" || len(listenAddresses) == 0 {
+		listenAddresses = append([]string{config.Listen}, listenAddresses...)
+	}
+	var listens []*net.UDPAddr
+	for _, address := range listenAddresses {
+		// listen can be a port range for port hopping, e.g. ":20000-20100"
+		var addrs []*net.UDPAddr
+		addrs, err = resolveUDPAddrRange(address)
+		if err != nil {
+			err = fmt.Errorf("invalid listen address %s: %w", address, err)
+			return
+		}
+		listens = append(listens, addrs...)
+	}
+	server.listens = listens
+	server.workers = config.Workers
+	if server.workers <= 0 {
+		server.workers = runtime.GOMAXPROCS(0)
+	}
+	if server.workers > 1 && !reusePortSupported {
+		log.Printf("[warn] multiple workers are not supported on this platform, fallback to a single worker\n")
+		server.workers = 1
+	}
+	if len(listens) > 1 {
+		// every listen port has its own read loop holding a batch of packets
+		batchSize := kPacketBatchSize / len(listens)
+		if batchSize < 1 {
+			batchSize = 1
+		}
+		server.wgitTable.BatchSize = batchSize
 	}
 	if config.Timeout > 0 {
 		server.wgitTable.Timeout = time.Duration(config.Timeout) * time.Second
@@ -184,81 +436,588 @@ func NewServerWithConfig(config *ServerConfig) (outServer *Server, err error) {
 	if config.MaxPacketSize > 0 {
 		server.wgitTable.MaxPacketSize = uint(config.MaxPacketSize)
 	}
+	server.wgitTable.DecryptPeerFunc = server.decryptPeer
 	server.wgitTable.ExtractPeerFunc = server.extractPeer
+	server.wgitTable.RestorePeerFunc = server.restorePeer
+	if config.HandshakeRateLimit != nil {
+		server.wgitTable.HandshakeLimiter, err = NewHandshakeLimiter(config.HandshakeRateLimit)
+		if err != nil {
+			err = fmt.Errorf("invalid handshake_rate_limit: %w", err)
+			return
+		}
+	}
+	if config.PeerWebhook != nil {
+		var webhook *peerWebhook
+		webhook, err = newPeerWebhook(config.PeerWebhook)
+		if err != nil {
+			err = fmt.Errorf("invalid peer_webhook: %w", err)
+			return
+		}
+		ttl := kPeerWebhookDefaultTTL
+		if config.PeerWebhook.TTL > 0 {
+			ttl = time.Duration(config.PeerWebhook.TTL) * time.Second
+		}
+		server.SetPeerProvider(webhook, ttl)
+	}
+	err = server.initializeTrafficLimiter(config.TrafficUsageFile)
+	if err != nil {
+		return
+	}
+	server.wgitTable.ClientSourceFilter, err = NewSourceFilter(config.AllowFrom, config.DenyFrom, nil)
+	if err != nil {
+		return
+	}
+	if config.ListenSocketOptions != nil {
+		err = config.ListenSocketOptions.Validate()
+		if err != nil {
+			err = fmt.Errorf("invalid listen_sockopt: %w", err)
+			return
+		}
+		server.listenSocketOptions = config.ListenSocketOptions
+	}
+	if config.UpstreamSocketOptions != nil {
+		err = config.UpstreamSocketOptions.Validate()
+		if err != nil {
+			err = fmt.Errorf("invalid upstream_sockopt: %w", err)
+			return
+		}
+		server.upstreamSocketOptions = config.UpstreamSocketOptions
+	}
+	if config.UpstreamListen != "" {
+		server.upstreamListen, err = resolveBindAddr(config.UpstreamListen)
+		if err != nil {
+			err = fmt.Errorf("invalid upstream_listen %s: %w", config.UpstreamListen, err)
+			return
+		}
+	}
+	upstreamBinds, err := server.initializeUpstreamBinds()
+	if err != nil {
+		return
+	}
+	if config.UpstreamSocket == UpstreamSocketShared && config.UpstreamPortRange != "" {
+		err = fmt.Errorf("upstream_port_range requires upstream_socket")
+		return
+	}
+	if config.UpstreamSocket != UpstreamSocketShared || len(upstreamBinds) > 0 {
+		server.wgitTable.ServerTransportAllocator, err = newUpstreamSocketAllocator(config.UpstreamSocket, config.UpstreamPortRange,
+			server.upstreamListen, upstreamBinds, server.listenServerTransport)
+		if err != nil {
+			err = fmt.Errorf("invalid upstream_socket: %w", err)
+			return
+		}
+	}
 	server.wgitTable.CacheJar.WGITCacheConfig = config.WGITCacheConfig
+	server.listenTCP = config.ListenTCP
+	server.listenWebSocket = config.ListenWebSocket
+	server.webSocketPath = config.WebSocketPath
+	if server.webSocketPath == "" {
+		server.webSocketPath = "/"
+	} else if server.listenWebSocket == "" {
+		err = fmt.Errorf("ws_path requires listen_ws")
+		return
+	}
 
 	var obfuscator WireGuardObfuscator
 	obfuscator.Initialize(config.ObfuscateKey)
-	server.wgitTable.ClientWriteToUDPFunc = obfuscator.WriteToUDPWithObfuscate
-	server.wgitTable.ClientReadFromUDPFunc = obfuscator.ReadFromUDPWithDeobfuscate
+	err = obfuscator.SetMimicry(config.ObfuscateMimicry)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs_mimicry: %w", err)
+		return
+	}
+	err = obfuscator.SetPadding(config.ObfuscatePadding)
+	if err != nil {
+		err = fmt.Errorf("invalid obfs_padding: %w", err)
+		return
+	}
+	obfuscator.packetPool = &server.wgitTable.packetPool
+	server.obfuscator = &obfuscator
+
+	if config.StrictObfuscate {
+		if config.ObfuscateKey == "" {
+			err = fmt.Errorf("strict_obfs requires obfs")
+			return
+		}
+		for _, s := range server.servers {
+			checker := &device.CookieChecker{}
+			checker.Init(s.PrivateKey.PublicKey().NoisePublicKey)
+			server.cookieCheckers = append(server.cookieCheckers, checker)
+		}
+		if config.Decoy != "" {
+			var decoyAddr *net.UDPAddr
+			decoyAddr, err = net.ResolveUDPAddr("udp", config.Decoy)
+			if err != nil {
+				err = fmt.Errorf("invalid decoy address %s: %w", config.Decoy, err)
+				return
+			}
+			server.decoy = newDecoyForwarder(decoyAddr)
+		}
+		server.strictObfuscate = true
+	} else if config.Decoy != "" {
+		err = fmt.Errorf("decoy requires strict_obfs")
+		return
+	}
+
+	err = server.initializeUpstreamObfuscators()
+	if err != nil {
+		return
+	}
 
+	// the last one, as it starts listening
+	if config.PeerEvents != nil {
+		var publisher *peerEventPublisher
+		publisher, err = newPeerEventPublisher(config.PeerEvents)
+		if err != nil {
+			err = fmt.Errorf("invalid peer_events: %w", err)
+			return
+		}
+		server.wgitTable.PeerEventFunc = publisher.Publish
+	}
 	outServer = &server
 	return
 }
 
-func (s *Server) extractPeer(msg *device.MessageInitiation) (sp *ServerConfigPeer, err error) {
-	tryDecryptPeerPKWith := func(privateKey NoisePrivateKey) (peerPK NoisePublicKey, err error) {
-		ourPublicKey := privateKey.PublicKey()
+// initializeTrafficLimiter enables the traffic limiter if any peer has a rate_limit or quota,
+// or the peers may come from the peer provider.
+func (s *Server) initializeTrafficLimiter(usageFilePath string) (err error) {
+	limited := s.peerProvider != nil
+	var quota bool
+	for _, server := range s.servers {
+		for _, peer := range server.Peers {
+			limited = limited || peer.RateLimit != nil || peer.Quota != nil
+			quota = quota || peer.Quota != nil
+		}
+	}
+	if !limited {
+		if usageFilePath != "" {
+			err = fmt.Errorf("traffic_usage_file requires rate_limit or quota")
+		}
+		return
+	}
+	if quota && usageFilePath == "" {
+		log.Printf("[warn] traffic_usage_file is not set, the usage of the traffic quotas will be reset on restart\n")
+	}
+	s.wgitTable.TrafficLimiter, err = NewTrafficLimiter(usageFilePath)
+	return
+}
+
+// initializeUpstreamBinds returns the upstream_bind address of every forward_to address,
+// and checks the IP versions of them and upstream_listen.
+func (s *Server) initializeUpstreamBinds() (binds map[netip.AddrPort]*net.UDPAddr, err error) {
+	binds = make(map[netip.AddrPort]*net.UDPAddr)
+	for si, server := range s.servers {
+		if server.UpstreamBind != "" {
+			server.upstreamBindAddress, err = resolveBindAddr(server.UpstreamBind)
+			if err != nil {
+				err = fmt.Errorf("server[%d] has invalid upstream_bind %s: %w", si, server.UpstreamBind, err)
+				return
+			}
+		}
+		for pi, p := range server.Peers {
+			addr := p.forwardToAddress
+			bind := server.upstreamBindAddress
+			if bind == nil {
+				bind = s.upstreamListen
+			}
+			if bind != nil && bind.IP != nil && !bind.IP.IsUnspecified() && (bind.IP.To4() != nil) != addr.Addr().Is4() {
+				err = fmt.Errorf("server[%d]: peer[%d] cannot forward to %s from %s with different IP versions", si, pi, addr, bind)
+				return
+			}
+			if server.upstreamBindAddress == nil {
+				continue
+			}
+			if existed, ok := binds[addr]; ok {
+				if existed.String() != server.upstreamBindAddress.String() {
+					err = fmt.Errorf("server[%d]: peer[%d] has conflicting upstream_bind for forward_to address %s", si, pi, addr)
+					return
+				}
+				continue
+			}
+			binds[addr] = server.upstreamBindAddress
+		}
+	}
+	return
+}
+
+// resolveBindAddr resolves the local address like "192.0.2.10", "[2001:db8::1]:51820" or ":51820".
+func resolveBindAddr(address string) (addr *net.UDPAddr, err error) {
+	if ip := net.ParseIP(address); ip != nil {
+		addr = &net.UDPAddr{IP: ip}
+		return
+	}
+	addr, err = net.ResolveUDPAddr("udp", address)
+	return
+}
+
+func (s *Server) initializeUpstreamObfuscators() (err error) {
+	type upstreamObfuscateConfig struct {
+		key     string
+		mimicry string
+	}
+	upstreamObfuscateConfigs := make(map[netip.AddrPort]upstreamObfuscateConfig)
+	s.upstreamObfuscators = make(map[netip.AddrPort]*WireGuardObfuscator)
+	s.upstreamObfuscatorsByIP = make(map[netip.Addr]*WireGuardObfuscator)
+	for si, server := range s.servers {
+		for pi, p := range server.Peers {
+			addr := p.forwardToAddress
+			config := upstreamObfuscateConfig{
+				key:     p.UpstreamObfuscateKey,
+				mimicry: p.UpstreamObfuscateMimicry,
+			}
+			if existed, ok := upstreamObfuscateConfigs[addr]; ok {
+				if existed != config {
+					err = fmt.Errorf("server[%d]: peer[%d] has conflicting upstream_obfs for forward_to address %s", si, pi, addr)
+					return
+				}
+				continue
+			}
+			upstreamObfuscateConfigs[addr] = config
+			if config.key == "" {
+				if config.mimicry != "" {
+					err = fmt.Errorf("server[%d]: peer[%d] has upstream_obfs_mimicry but no upstream_obfs", si, pi)
+					return
+				}
+				continue
+			}
+			obfuscator := &WireGuardObfuscator{}
+			obfuscator.Initialize(config.key)
+			err = obfuscator.SetMimicry(config.mimicry)
+			if err != nil {
+				err = fmt.Errorf("server[%d]: peer[%d] has invalid upstream_obfs_mimicry: %w", si, pi, err)
+				return
+			}
+			s.upstreamObfuscators[addr] = obfuscator
+			ip := addr.Addr().Unmap()
+			if existed, ok := s.upstreamObfuscatorsByIP[ip]; !ok {
+				s.upstreamObfuscatorsByIP[ip] = obfuscator
+			} else if existed != nil && (existed.userKeyHash != obfuscator.userKeyHash || existed.mimicry != obfuscator.mimicry) {
+				s.upstreamObfuscatorsByIP[ip] = nil
+			}
+		}
+	}
+	for si, server := range s.servers {
+		for pi, p := range server.Peers {
+			err = s.checkUpstreamSourceValidateLevel(p)
+			if err != nil {
+				err = fmt.Errorf("server[%d]: peer[%d]: %w", si, pi, err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// checkUpstreamSourceValidateLevel checks that the replies accepted by the ssvl of the peer
+// can be deobfuscated with its upstream_obfs, which is chosen by the source of the replies.
+func (s *Server) checkUpstreamSourceValidateLevel(p *ServerConfigPeer) (err error) {
+	if _, ok := s.upstreamObfuscators[p.forwardToAddress]; !ok {
+		return
+	}
+	switch p.ServerSourceValidateLevel {
+	case SourceValidateLevelNone:
+		err = fmt.Errorf("upstream_obfs cannot be used with ssvl %d", p.ServerSourceValidateLevel)
+	case SourceValidateLevelIP:
+		if s.upstreamObfuscatorsByIP[p.forwardToAddress.Addr().Unmap()] == nil {
+			err = fmt.Errorf("upstream_obfs with ssvl %d requires the same upstream_obfs for all the forward_to addresses of %s",
+				p.ServerSourceValidateLevel, p.forwardToAddress.Addr())
+		}
+	}
+	return
+}
+
+// wrapClientTransport wraps the transport to clients with obfuscation and strict_obfs.
+func (s *Server) wrapClientTransport(transport Transport) Transport {
+	if s.strictObfuscate {
+		return &strictClientTransport{
+			Transport: s.obfuscator.WrapTransport(transport),
+			raw:       transport,
+			server:    s,
+		}
+	}
+	return s.obfuscator.WrapTransport(transport)
+}
+
+// listenServerTransport listens on addr for a dedicated transport to servers.
+func (s *Server) listenServerTransport(addr *net.UDPAddr, transparent bool) (transport Transport, err error) {
+	var udpTransport *PacketConnTransport
+	if transparent {
+		udpTransport, err = ListenTransparentUDPTransport(addr, s.upstreamSocketOptions)
+	} else {
+		udpTransport, err = ListenUDPTransportWithOptions(addr, s.upstreamSocketOptions)
+	}
+	if err != nil {
+		return
+	}
+	transport = s.wrapServerTransport(udpTransport)
+	return
+}
+
+// wrapServerTransport wraps the transport to servers with upstream_obfs.
+func (s *Server) wrapServerTransport(transport Transport) Transport {
+	if len(s.upstreamObfuscators) == 0 {
+		return transport
+	}
+	return &upstreamTransport{
+		Transport: transport,
+		server:    s,
+	}
+}
+
+// upstreamTransport obfuscates the packets to the forward_to addresses with upstream_obfs set.
+type upstreamTransport struct {
+	Transport
+	server *Server
+}
+
+// obfuscatorTo returns the obfuscator of the packet to destination, and marks the packet to be obfuscated.
+func (t *upstreamTransport) obfuscatorTo(packet *Packet) (obfuscator *WireGuardObfuscator) {
+	obfuscator = t.server.upstreamObfuscators[packet.Destination]
+	if obfuscator != nil {
+		packet.Flags |= PacketFlagObfuscateBeforeSend
+	}
+	return
+}
+
+// obfuscatorFrom returns the obfuscator of the packet from source,
+// the replies from other ports of the forward_to IP are matched by the IP.
+func (t *upstreamTransport) obfuscatorFrom(packet *Packet) (obfuscator *WireGuardObfuscator) {
+	obfuscator, ok := t.server.upstreamObfuscators[packet.Source]
+	if !ok {
+		// the non-obfuscated packets are left as they are by Deobfuscate
+		obfuscator = t.server.upstreamObfuscatorsByIP[packet.Source.Addr().Unmap()]
+	}
+	return
+}
+
+func (t *upstreamTransport) WritePacket(packet *Packet) (err error) {
+	if obfuscator := t.obfuscatorTo(packet); obfuscator != nil {
+		return obfuscator.WritePacketWithObfuscate(t.Transport, packet)
+	}
+	return t.Transport.WritePacket(packet)
+}
+
+func (t *upstreamTransport) ReadPacket(packet *Packet) (err error) {
+	err = t.Transport.ReadPacket(packet)
+	if err != nil {
+		return
+	}
+	if obfuscator := t.obfuscatorFrom(packet); obfuscator != nil {
+		obfuscator.Deobfuscate(packet)
+	}
+	return
+}
+
+func (t *upstreamTransport) LocalAddr() net.Addr {
+	return transportLocalAddr(t.Transport)
+}
 
-		// most implementation here is copied from device.Device.ConsumeMessageInitiation().
-		var (
-			hash     [blake2s.Size]byte
-			chainKey [blake2s.Size]byte
-		)
+func (t *upstreamTransport) BatchSize() int {
+	return transportBatchSize(t.Transport)
+}
 
-		devicex.mixHash(&hash, &device.InitialHash, ourPublicKey.NoisePublicKey[:])
-		devicex.mixHash(&hash, &hash, msg.Ephemeral[:])
-		devicex.mixKey(&chainKey, &device.InitialChainKey, msg.Ephemeral[:])
+func (t *upstreamTransport) WritePackets(packets []*Packet) (err error) {
+	for _, packet := range packets {
+		// no padding policy for the upstream, so no chaff to send
+		if obfuscator := t.obfuscatorTo(packet); obfuscator != nil {
+			obfuscator.Obfuscate(packet)
+		}
+	}
+	return writePackets(t.Transport, packets)
+}
+
+func (t *upstreamTransport) ReadPackets(packets []*Packet) (n int, err error) {
+	n, err = readPackets(t.Transport, packets)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets[:n] {
+		if obfuscator := t.obfuscatorFrom(packet); obfuscator != nil {
+			obfuscator.Deobfuscate(packet)
+		}
+	}
+	return
+}
+
+// strictClientTransport drops the packets from clients that cannot be validated for strict_obfs,
+// and forwards them to the decoy if configured.
+type strictClientTransport struct {
+	Transport // the obfuscated one
+	raw       Transport
+	server    *Server
+}
 
-		// decrypt static key
-		var key [chacha20poly1305.KeySize]byte
-		ss := privateKey.SharedSecret(msg.Ephemeral)
-		if devicex.isZero(ss[:]) {
+func (t *strictClientTransport) ReadPacket(packet *Packet) (err error) {
+	for {
+		err = t.raw.ReadPacket(packet)
+		if err != nil {
+			return
+		}
+		if t.validate(packet) {
 			return
 		}
-		device.KDF2(&chainKey, &key, chainKey[:], ss[:])
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err = aead.Open(peerPK.NoisePublicKey[:0], device.ZeroNonce[:], msg.Static[:], hash[:])
+		packet.Reset()
+	}
+}
+
+func (t *strictClientTransport) LocalAddr() net.Addr {
+	return transportLocalAddr(t.raw)
+}
+
+func (t *strictClientTransport) BatchSize() int {
+	return transportBatchSize(t.raw)
+}
+
+func (t *strictClientTransport) WritePackets(packets []*Packet) (err error) {
+	return writePackets(t.Transport, packets)
+}
+
+func (t *strictClientTransport) ReadPackets(packets []*Packet) (n int, err error) {
+	for {
+		n, err = readPackets(t.raw, packets)
 		if err != nil {
 			return
 		}
+		n = compactPackets(packets, n, t.validate)
+		if n > 0 {
+			return
+		}
+	}
+}
 
-		// TODO: now we have peerPK, but we can do further validation to protect against replay & flood
-		return
+// validate deobfuscates the packet, and returns false if it should be dropped.
+func (t *strictClientTransport) validate(packet *Packet) (valid bool) {
+	s := t.server
+	var header obfuscatedHeader
+	obfuscated := s.obfuscator.decodeHeader(packet, &header)
+	var origin []byte
+	if s.decoy != nil && !(obfuscated && header.isValidTransport()) {
+		// the valid MessageTransport are never forwarded to the decoy, skip the copy in the hot path
+		origin = s.decoy.SaveOrigin(packet)
+	}
+	if obfuscated {
+		s.obfuscator.deobfuscateWithHeader(packet, &header)
+	}
+	valid = packet.Flags&PacketFlagChaff == 0 && s.isValidClientPacket(packet)
+	if origin != nil {
+		if !valid && packet.Flags&PacketFlagChaff == 0 {
+			s.decoy.Forward(t.raw, packet.Source, packet.Local, origin)
+		}
+		s.decoy.RecycleOrigin(origin)
+	}
+	return
+}
+
+func (s *Server) isValidClientPacket(packet *Packet) bool {
+	if packet.Flags&PacketFlagDeobfuscatedAfterReceived == 0 {
+		return false
+	}
+	switch packet.MessageType() {
+	case device.MessageInitiationType:
+		if packet.Length != device.MessageInitiationSize {
+			return false
+		}
+		for _, checker := range s.cookieCheckers {
+			if checker.CheckMAC1(packet.Slice()) {
+				return true
+			}
+		}
+	case device.MessageTransportType:
+		return packet.Length >= device.MessageTransportSize
 	}
+	return false
+}
 
+// decryptPeer finds the server the MessageInitiation is sent to, and decrypts the client public key.
+func (s *Server) decryptPeer(msg *device.MessageInitiation) (serverPublicKey NoisePublicKey, clientPublicKey NoisePublicKey, err error) {
 	if len(s.servers) == 0 {
 		err = fmt.Errorf("no server configured")
 		return
 	}
+	for _, server := range s.servers {
+		clientPublicKey, err = DecryptInitiationPublicKey(*server.PrivateKey, msg)
+		if err == nil {
+			serverPublicKey = server.publicKey
+			return
+		}
+	}
+	err = fmt.Errorf("no server private key decrypted the message: %w", err)
+	return
+}
+
+func (s *Server) extractPeer(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (sp *ServerConfigPeer, err error) {
+	return s.matchPeer(ctx, request, s.peerProvider)
+}
+
+// restorePeer matches the peer loaded from the cache with the config again, so its access window
+// and source filter are restored. the peer provider is not consulted to not block the start,
+// the peers from it are refused and they handshake again.
+func (s *Server) restorePeer(request *PeerRequest) (sp *ServerConfigPeer, err error) {
+	return s.matchPeer(context.Background(), request, nil)
+}
 
+// matchPeer finds the peer of the client in the config, or from the peer provider if it is not nil.
+func (s *Server) matchPeer(ctx context.Context, request *PeerRequest, provider *peerProviderCache) (sp *ServerConfigPeer, err error) {
 	var matchedServer *ServerConfigServer
-	var peerPK NoisePublicKey
 	for _, server := range s.servers {
-		peerPK, err = tryDecryptPeerPKWith(*server.PrivateKey)
-		if err == nil {
+		if server.publicKey == request.ServerPublicKey {
 			matchedServer = server
 			break
 		}
 	}
-	if err != nil {
-		err = fmt.Errorf("no server private key decrypted the message: %w", err)
+	if matchedServer == nil {
+		err = fmt.Errorf("no server with public key %s", request.ServerPublicKey.Base64())
 		return
 	}
+	peerPK := request.ClientPublicKey
+	source := request.Source
 
 	var matchedServerPeer *ServerConfigPeer
 	var fallbackServerPeer *ServerConfigPeer
 	for _, peer := range matchedServer.Peers {
+		if !peer.matchesSource(source.Addr()) {
+			continue
+		}
 		if peer.isFallback() {
-			fallbackServerPeer = peer
+			if fallbackServerPeer == nil {
+				fallbackServerPeer = peer
+			}
 		} else {
-			if peer.ClientPublicKey.Equals(peerPK.NoisePublicKey) {
+			if matchedServerPeer == nil && peer.ClientPublicKey.Equals(peerPK.NoisePublicKey) {
 				matchedServerPeer = peer
 			}
 		}
 	}
+	if matchedServerPeer == nil && provider != nil {
+		matchedServerPeer, err = provider.lookup(ctx, request, func(sp *ServerConfigPeer) (err error) {
+			err = matchedServer.initializePeer(sp)
+			if err != nil {
+				return
+			}
+			return s.checkUpstreamObfuscator(sp)
+		})
+		if err != nil {
+			err = fmt.Errorf("peer provider refused client %s: %w", peerPK.Base64(), err)
+			return
+		}
+		if matchedServerPeer != nil && !matchedServerPeer.matchesSource(source.Addr()) {
+			// the same as the peers in the config
+			matchedServerPeer = nil
+		}
+	}
+
+	now := time.Now()
+	if matchedServerPeer != nil && !matchedServerPeer.access.Allows(now) {
+		if !matchedServerPeer.FallbackOutsideWindow {
+			err = fmt.Errorf("client %s is out of the access window", peerPK.Base64())
+			return
+		}
+		matchedServerPeer = nil
+	}
 	if matchedServerPeer == nil {
 		matchedServerPeer = fallbackServerPeer
+		if matchedServerPeer != nil && !matchedServerPeer.access.Allows(now) {
+			err = fmt.Errorf("client %s is out of the access window of the fallback peer", peerPK.Base64())
+			return
+		}
 	}
 	if matchedServerPeer == nil {
 		err = fmt.Errorf("no matched server peer and no fallback server peer for server %s", matchedServer.PrivateKey.Base64())
@@ -271,8 +1030,130 @@ func (s *Server) extractPeer(msg *device.MessageInitiation) (sp *ServerConfigPee
 	return
 }
 
+// SetPeerProvider delegates the peers of the client public keys not in the config to the provider,
+// before the fallback peer, the results are cached for ttl unless the provider specifies one.
+// it must be called before Start().
+func (s *Server) SetPeerProvider(provider PeerProvider, ttl time.Duration) {
+	s.peerProvider = newPeerProviderCache(provider, ttl)
+	if s.wgitTable.TrafficLimiter == nil {
+		// for the rate_limit and quota of the peers from the provider
+		s.wgitTable.TrafficLimiter, _ = NewTrafficLimiter("")
+	}
+}
+
+// checkUpstreamObfuscator checks the upstream_obfs of the peer from PeerProvider,
+// which is only supported for the forward_to addresses with the same upstream_obfs in the config.
+func (s *Server) checkUpstreamObfuscator(sp *ServerConfigPeer) (err error) {
+	obfuscator, ok := s.upstreamObfuscators[sp.forwardToAddress]
+	if !ok {
+		if sp.UpstreamObfuscateKey != "" || sp.UpstreamObfuscateMimicry != "" {
+			err = fmt.Errorf("upstream_obfs is not configured for forward_to address %s", sp.forwardToAddress)
+		}
+		return
+	}
+	if sha256.Sum256([]byte(sp.UpstreamObfuscateKey)) != obfuscator.userKeyHash || sp.UpstreamObfuscateMimicry != obfuscator.mimicry {
+		err = fmt.Errorf("upstream_obfs or upstream_obfs_mimicry of forward_to address %s does not match the config", sp.forwardToAddress)
+		return
+	}
+	err = s.checkUpstreamSourceValidateLevel(sp)
+	return
+}
+
+// AddListen listens on more addresses (can be a port range), before or after Start().
+func (s *Server) AddListen(address string) (err error) {
+	addrs, err := resolveUDPAddrRange(address)
+	if err != nil {
+		err = fmt.Errorf("invalid listen address %s: %w", address, err)
+		return
+	}
+	for _, addr := range addrs {
+		err = s.listenClientTransports(addr)
+		if err != nil {
+			return
+		}
+	}
+	log.Printf("[info] listen on %s ...\n", address)
+	return
+}
+
+// listenClientTransports listens on addr with a socket for every worker.
+func (s *Server) listenClientTransports(addr *net.UDPAddr) (err error) {
+	// ClientTransports[i] is handled by the worker i % s.workers
+	transports, err := ListenUDPTransports(addr, s.workers, s.listenSocketOptions)
+	if err != nil {
+		err = fmt.Errorf("failed to listen on %s: %w", addr.String(), err)
+		return
+	}
+	for _, transport := range transports {
+		s.wgitTable.AddClientTransport(s.wrapClientTransport(transport))
+	}
+	return
+}
+
+// SaveTrafficUsage saves the quota usage to traffic_usage_file if it is set,
+// it should be called on shutdown, or the usage since the last save is lost.
+func (s *Server) SaveTrafficUsage() (err error) {
+	err = s.wgitTable.TrafficLimiter.Save()
+	return
+}
+
 func (s *Server) Start() (err error) {
-	log.Printf("[info] listen on %s ...\n", s.wgitTable.ClientListen)
+	for _, addr := range s.listens {
+		err = s.listenClientTransports(addr)
+		if err != nil {
+			return
+		}
+	}
+	if len(s.listens) > 1 {
+		log.Printf("[info] listen on %s and %d more ports ...\n", s.listens[0], len(s.listens)-1)
+	} else {
+		log.Printf("[info] listen on %s ...\n", s.listens[0])
+	}
+	if s.listenTCP != "" {
+		var conn *streamServerConn
+		conn, err = listenTCPStreamServerConn(s.listenTCP)
+		if err != nil {
+			err = fmt.Errorf("failed to listen on tcp addr %s: %w", s.listenTCP, err)
+			return
+		}
+		s.wgitTable.AddClientTransport(s.wrapClientTransport(NewPacketConnTransport(conn)))
+		log.Printf("[info] listen on %s (tcp) ...\n", s.listenTCP)
+	}
+	if s.listenWebSocket != "" {
+		var conn *streamServerConn
+		conn, err = listenWebSocketStreamServerConn(s.listenWebSocket, s.webSocketPath)
+		if err != nil {
+			err = fmt.Errorf("failed to listen on ws addr %s: %w", s.listenWebSocket, err)
+			return
+		}
+		s.wgitTable.AddClientTransport(s.wrapClientTransport(NewPacketConnTransport(conn)))
+		log.Printf("[info] listen on %s%s (ws) ...\n", s.listenWebSocket, s.webSocketPath)
+	}
+	var serverTransports []*PacketConnTransport
+	if s.upstreamListen != nil && s.upstreamListen.Port != 0 {
+		// the workers share the port with SO_REUSEPORT
+		serverTransports, err = ListenUDPTransports(s.upstreamListen, s.workers, s.upstreamSocketOptions)
+		if err != nil {
+			err = fmt.Errorf("failed to listen for servers on %s: %w", s.upstreamListen, err)
+			return
+		}
+	} else {
+		for i := 0; i < s.workers; i++ {
+			var serverTransport *PacketConnTransport
+			serverTransport, err = ListenUDPTransportWithOptions(s.upstreamListen, s.upstreamSocketOptions)
+			if err != nil {
+				err = fmt.Errorf("failed to listen for servers: %w", err)
+				return
+			}
+			serverTransports = append(serverTransports, serverTransport)
+		}
+	}
+	for _, serverTransport := range serverTransports {
+		s.wgitTable.ServerTransports = append(s.wgitTable.ServerTransports, s.wrapServerTransport(serverTransport))
+	}
+	if s.workers > 1 {
+		log.Printf("[info] forwarding with %d workers\n", s.workers)
+	}
 	err = s.wgitTable.Serve()
 	return
 }
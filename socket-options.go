@@ -0,0 +1,90 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// SocketOptions are the options set on the sockets before they are bound or connected,
+// such as for the policy routing, so the packets to mwgp-server do not loop back into the tunnel.
+type SocketOptions struct {
+	// Mark is the fwmark (SO_MARK) of the packets sent from the sockets, requires CAP_NET_ADMIN (Linux only).
+	Mark int `json:"fwmark,omitempty"`
+	// BindToDevice binds the sockets to the network interface (SO_BINDTODEVICE, Linux only).
+	BindToDevice string `json:"bind_to_device,omitempty"`
+	// DSCP is the DSCP value (0-63) in the IP header of the packets sent from the sockets (IP_TOS or IPV6_TCLASS).
+	DSCP int `json:"dscp,omitempty"`
+	// ReceiveBuffer is the size of the receive buffer in bytes (SO_RCVBUF),
+	// it is not limited by net.core.rmem_max with CAP_NET_ADMIN.
+	ReceiveBuffer int `json:"rcvbuf,omitempty"`
+	// SendBuffer is the size of the send buffer in bytes (SO_SNDBUF),
+	// it is not limited by net.core.wmem_max with CAP_NET_ADMIN.
+	SendBuffer int `json:"sndbuf,omitempty"`
+}
+
+func (o *SocketOptions) isEmpty() bool {
+	return o == nil || *o == SocketOptions{}
+}
+
+func (o *SocketOptions) Validate() (err error) {
+	if o.isEmpty() {
+		return
+	}
+	if !socketOptionsSupported {
+		err = errors.New("socket options are not supported on this platform")
+		return
+	}
+	if o.Mark < 0 {
+		err = fmt.Errorf("invalid fwmark %d", o.Mark)
+		return
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		err = fmt.Errorf("invalid dscp %d, must be 0-63", o.DSCP)
+		return
+	}
+	if o.ReceiveBuffer < 0 || o.SendBuffer < 0 {
+		err = errors.New("invalid socket buffer size")
+		return
+	}
+	return
+}
+
+// control returns the Control function of net.ListenConfig and net.Dialer which sets the options,
+// or nil if there is no option set.
+func (o *SocketOptions) control() func(network, address string, c syscall.RawConn) error {
+	if o.isEmpty() {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			err = setSocketOptions(fd, o)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+		return
+	}
+}
+
+// chainControl returns the Control function which calls the non-nil ones in order.
+func chainControl(controls ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var chained []func(network, address string, c syscall.RawConn) error
+	for _, control := range controls {
+		if control != nil {
+			chained = append(chained, control)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) (err error) {
+		for _, control := range chained {
+			err = control(network, address, c)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
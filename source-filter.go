@@ -0,0 +1,87 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+var errSourceDenied = errors.New("source denied")
+
+// SourceFilter is the allow_from and deny_from lists of a level (global, server or peer),
+// a source must be allowed by every level in the chain. a nil one allows everything.
+type SourceFilter struct {
+	// the source must be in one of them if not empty
+	allow []netip.Prefix
+	deny  []netip.Prefix
+
+	// the filter of the outer level
+	next *SourceFilter
+}
+
+// NewSourceFilter parses the CIDR lists, next is the filter of the outer level which is also checked.
+// it returns next if both lists are empty.
+func NewSourceFilter(allowFrom []string, denyFrom []string, next *SourceFilter) (f *SourceFilter, err error) {
+	if len(allowFrom) == 0 && len(denyFrom) == 0 {
+		f = next
+		return
+	}
+	f = &SourceFilter{
+		next: next,
+	}
+	f.allow, err = parsePrefixes(allowFrom)
+	if err != nil {
+		err = fmt.Errorf("invalid allow_from: %w", err)
+		return
+	}
+	f.deny, err = parsePrefixes(denyFrom)
+	if err != nil {
+		err = fmt.Errorf("invalid deny_from: %w", err)
+		return
+	}
+	return
+}
+
+// parsePrefixes parses the CIDRs, a single address is a prefix of itself.
+func parsePrefixes(cidrs []string) (prefixes []netip.Prefix, err error) {
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		var prefix netip.Prefix
+		if strings.Contains(cidr, "/") {
+			prefix, err = netip.ParsePrefix(cidr)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(cidr)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid CIDR %s: %w", cidr, err)
+			return
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+func (f *SourceFilter) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for ; f != nil; f = f.next {
+		if containsAddr(f.deny, addr) {
+			return false
+		}
+		if len(f.allow) > 0 && !containsAddr(f.allow, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package mwgp
+
+import (
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"testing"
+)
+
+func TestSourceFilter(t *testing.T) {
+	global, err := NewSourceFilter(nil, []string{"198.51.100.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSourceFilter(nil, nil, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != global {
+		t.Fatal("expected the empty level to be skipped")
+	}
+	peer, err := NewSourceFilter([]string{"192.0.2.0/24", "2001:db8::1"}, []string{"192.0.2.128/25"}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr   string
+		global bool
+		peer   bool
+	}{
+		{"192.0.2.1", true, true},
+		{"::ffff:192.0.2.1", true, true},
+		{"192.0.2.129", true, false},
+		{"2001:db8::1", true, true},
+		{"2001:db8::2", true, false},
+		{"203.0.113.1", true, false},
+		{"198.51.100.1", false, false},
+	} {
+		addr := netip.MustParseAddr(c.addr)
+		if global.Allows(addr) != c.global || peer.Allows(addr) != c.peer {
+			t.Errorf("%s: expected global %v and peer %v, got %v and %v", c.addr, c.global, c.peer, global.Allows(addr), peer.Allows(addr))
+		}
+	}
+
+	var unlimited *SourceFilter
+	if !unlimited.Allows(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("expected the nil filter to allow everything")
+	}
+
+	_, err = NewSourceFilter([]string{"192.0.2.0/33"}, nil, nil)
+	if err == nil {
+		t.Error("expected invalid CIDR")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_RoamingDenied(t *testing.T) {
+	filter, err := NewSourceFilter(nil, []string{"198.51.100.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	peer := &Peer{
+		clientDestination: clientAddr,
+		serverProxyIndex:  0x22222222,
+		sourceFilter:      filter,
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.serverMap.Store(peer.serverProxyIndex, peer)
+
+	// dropped silently as the denied handshakes
+	packet := &Packet{Data: make([]byte, defaultMaxPacketSize), Length: device.MessageTransportSize}
+	packet.Data[0] = device.MessageTransportType
+	_ = packet.SetReceiverIndex(peer.serverProxyIndex)
+	packet.Source = netip.MustParseAddrPort("198.51.100.1:51820")
+	_, err = table.processMessageTransport(packet, false)
+	if !errors.Is(err, errSourceDenied) {
+		t.Errorf("expected source denied, got %v", err)
+	}
+	if peer.currentClientDestination() != clientAddr {
+		t.Errorf("the denied client roamed to %s", peer.currentClientDestination())
+	}
+}
@@ -0,0 +1,675 @@
+package mwgp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Stream transports carry the WireGuard datagrams between mwgp-client and mwgp-server
+// over TCP or WebSocket, for the networks where UDP is blocked.
+//
+// A. Framing
+// A.1. TCP: every datagram is prefixed with its length as a 2-bytes big-endian integer.
+// A.2. WebSocket: every datagram is sent as a binary message.
+// A.3. The datagrams are obfuscated in the same way as over UDP if obfs is enabled.
+//
+// B. mwgp-server
+// B.1. All streams accepted by a listener are wrapped into a single net.PacketConn,
+//      and fed into the same WGIT table with the UDP ones.
+// B.2. A stream is identified by its remote address, which is used as the UDP source address,
+//      so a reconnected client looks like a roaming client.
+//
+// C. mwgp-client
+// C.1. The stream is dialed to the server address on the first write,
+//      and redialed on the next write once it is broken.
+//
+// D. Sending
+// D.1. The datagrams are queued and sent by a goroutine of the stream, so a stalled stream
+//      never blocks the shared write loop, they are dropped once the queue is full, as UDP does.
+// D.2. A stream is closed if a write has not completed in kStreamWriteTimeout.
+
+const (
+	TransportUDP       = "udp"
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"
+)
+
+const (
+	kStreamFrameHeaderLength = 2
+	kStreamMaxDatagramLength = 0xffff
+	kStreamReadChanSize      = 64
+	kStreamDialTimeout       = 10 * time.Second
+	kStreamRedialInterval    = 1 * time.Second
+	kStreamIdleTimeout       = 5 * time.Minute
+	kStreamWriteTimeout      = 5 * time.Second
+	kStreamSendQueueSize     = 64
+	kStreamSendBufferSize    = 2048
+)
+
+var errStreamDeadlineNotSupported = errors.New("deadline is not supported by stream transport")
+
+// datagramStream carries datagrams over a single stream.
+type datagramStream interface {
+	ReadDatagram(b []byte) (n int, err error)
+	WriteDatagram(b []byte) (err error)
+	SetReadDeadline(t time.Time) (err error)
+	SetWriteDeadline(t time.Time) (err error)
+	Close() (err error)
+}
+
+type tcpDatagramStream struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func newTCPDatagramStream(conn net.Conn) (s *tcpDatagramStream) {
+	s = &tcpDatagramStream{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	return
+}
+
+func (s *tcpDatagramStream) ReadDatagram(b []byte) (n int, err error) {
+	var header [kStreamFrameHeaderLength]byte
+	_, err = io.ReadFull(s.reader, header[:])
+	if err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length > len(b) {
+		err = io.ErrShortBuffer
+		return
+	}
+	n, err = io.ReadFull(s.reader, b[:length])
+	return
+}
+
+func (s *tcpDatagramStream) WriteDatagram(b []byte) (err error) {
+	if len(b) > kStreamMaxDatagramLength {
+		err = fmt.Errorf("datagram too large: %d", len(b))
+		return
+	}
+	var header [kStreamFrameHeaderLength]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	buffers := net.Buffers{header[:], b}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err = buffers.WriteTo(s.conn)
+	return
+}
+
+func (s *tcpDatagramStream) SetReadDeadline(t time.Time) (err error) {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *tcpDatagramStream) SetWriteDeadline(t time.Time) (err error) {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *tcpDatagramStream) Close() (err error) {
+	return s.conn.Close()
+}
+
+type webSocketDatagramStream struct {
+	conn *websocket.Conn
+}
+
+func newWebSocketDatagramStream(conn *websocket.Conn) (s *webSocketDatagramStream) {
+	conn.PayloadType = websocket.BinaryFrame
+	conn.MaxPayloadBytes = kStreamMaxDatagramLength
+	s = &webSocketDatagramStream{
+		conn: conn,
+	}
+	return
+}
+
+func (s *webSocketDatagramStream) ReadDatagram(b []byte) (n int, err error) {
+	// websocket.Conn.Read() may return a partial frame, receive the whole message instead.
+	var data []byte
+	err = websocket.Message.Receive(s.conn, &data)
+	if err != nil {
+		return
+	}
+	if len(data) > len(b) {
+		err = io.ErrShortBuffer
+		return
+	}
+	n = copy(b, data)
+	return
+}
+
+func (s *webSocketDatagramStream) WriteDatagram(b []byte) (err error) {
+	// websocket.Conn sends every Write() as a single frame
+	_, err = s.conn.Write(b)
+	return
+}
+
+func (s *webSocketDatagramStream) SetReadDeadline(t time.Time) (err error) {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *webSocketDatagramStream) SetWriteDeadline(t time.Time) (err error) {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *webSocketDatagramStream) Close() (err error) {
+	return s.conn.Close()
+}
+
+// queuedDatagramStream sends the datagrams to the underlying stream from a buffered queue.
+type queuedDatagramStream struct {
+	datagramStream
+	sendChan  chan []byte
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+var queuedDatagramPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, kStreamSendBufferSize)
+	},
+}
+
+func newQueuedDatagramStream(stream datagramStream) (s *queuedDatagramStream) {
+	s = &queuedDatagramStream{
+		datagramStream: stream,
+		sendChan:       make(chan []byte, kStreamSendQueueSize),
+		closeChan:      make(chan struct{}),
+	}
+	go s.sendLoop()
+	return
+}
+
+func (s *queuedDatagramStream) sendLoop() {
+	for {
+		select {
+		case b := <-s.sendChan:
+			_ = s.datagramStream.SetWriteDeadline(time.Now().Add(kStreamWriteTimeout))
+			err := s.datagramStream.WriteDatagram(b)
+			queuedDatagramPool.Put(b[:0])
+			if err != nil {
+				// the reader of the stream gets an error and drops it
+				_ = s.Close()
+				return
+			}
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// WriteDatagram queues the datagram, it is dropped if the queue is full.
+func (s *queuedDatagramStream) WriteDatagram(b []byte) (err error) {
+	if len(b) > kStreamMaxDatagramLength {
+		err = fmt.Errorf("datagram too large: %d", len(b))
+		return
+	}
+	select {
+	case <-s.closeChan:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	buf := append(queuedDatagramPool.Get().([]byte), b...)
+	select {
+	case s.sendChan <- buf:
+	default:
+		queuedDatagramPool.Put(buf[:0])
+	}
+	return
+}
+
+func (s *queuedDatagramStream) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+	return s.datagramStream.Close()
+}
+
+// streamServerConn is a net.PacketConn for mwgp-server,
+// which receives the datagrams from all streams accepted by a listener.
+type streamServerConn struct {
+	listener  net.Listener
+	readChan  chan streamDatagram
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	// remote address -> stream
+	streams     map[string]datagramStream
+	streamsLock sync.RWMutex
+
+	bufferPool sync.Pool
+}
+
+type streamDatagram struct {
+	data   []byte
+	length int
+	source *net.UDPAddr
+}
+
+func newStreamServerConn(listener net.Listener) (c *streamServerConn) {
+	c = &streamServerConn{
+		listener:  listener,
+		readChan:  make(chan streamDatagram, kStreamReadChanSize),
+		closeChan: make(chan struct{}),
+		streams:   make(map[string]datagramStream),
+	}
+	c.bufferPool.New = func() interface{} {
+		return make([]byte, kStreamMaxDatagramLength)
+	}
+	return
+}
+
+// listenTCPStreamServerConn listens on address for mwgp-client with TCP transport.
+func listenTCPStreamServerConn(address string) (c *streamServerConn, err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+	c = newStreamServerConn(listener)
+	go func() {
+		for {
+			conn, aerr := listener.Accept()
+			if aerr != nil {
+				if errors.Is(aerr, net.ErrClosed) {
+					return
+				}
+				log.Printf("[error] failed to accept tcp conn on %s: %s\n", listener.Addr().String(), aerr.Error())
+				time.Sleep(kStreamRedialInterval)
+				continue
+			}
+			tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				_ = conn.Close()
+				continue
+			}
+			remoteAddr := &net.UDPAddr{
+				IP:   tcpAddr.IP,
+				Port: tcpAddr.Port,
+				Zone: tcpAddr.Zone,
+			}
+			go c.serveStream(newTCPDatagramStream(conn), remoteAddr)
+		}
+	}()
+	return
+}
+
+// listenWebSocketStreamServerConn listens on address for mwgp-client with WebSocket transport,
+// the WebSocket endpoint is served on the HTTP path.
+func listenWebSocketStreamServerConn(address, path string) (c *streamServerConn, err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+	c = newStreamServerConn(listener)
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// accept any Origin, the requests may come through CDN or reverse proxies.
+		Handshake: func(config *websocket.Config, request *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			addrPort, perr := netip.ParseAddrPort(conn.Request().RemoteAddr)
+			if perr != nil {
+				return
+			}
+			c.serveStream(newWebSocketDatagramStream(conn), net.UDPAddrFromAddrPort(addrPort))
+		},
+	})
+	go func() {
+		serr := http.Serve(listener, mux)
+		if serr != nil && !errors.Is(serr, net.ErrClosed) {
+			log.Printf("[error] failed to serve websocket on %s: %s\n", listener.Addr().String(), serr.Error())
+		}
+	}()
+	return
+}
+
+func (c *streamServerConn) serveStream(stream datagramStream, remoteAddr *net.UDPAddr) {
+	stream = newQueuedDatagramStream(stream)
+	key := remoteAddr.String()
+	c.streamsLock.Lock()
+	c.streams[key] = stream
+	c.streamsLock.Unlock()
+
+	defer func() {
+		c.streamsLock.Lock()
+		delete(c.streams, key)
+		c.streamsLock.Unlock()
+		_ = stream.Close()
+	}()
+
+	for {
+		_ = stream.SetReadDeadline(time.Now().Add(kStreamIdleTimeout))
+		buf := c.bufferPool.Get().([]byte)
+		n, err := stream.ReadDatagram(buf)
+		if err != nil {
+			c.bufferPool.Put(buf)
+			return
+		}
+		select {
+		case c.readChan <- streamDatagram{data: buf, length: n, source: remoteAddr}:
+		case <-c.closeChan:
+			c.bufferPool.Put(buf)
+			return
+		}
+	}
+}
+
+func (c *streamServerConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case datagram := <-c.readChan:
+		n = copy(b, datagram.data[:datagram.length])
+		addr = datagram.source
+		c.bufferPool.Put(datagram.data)
+	case <-c.closeChan:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (c *streamServerConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	c.streamsLock.RLock()
+	stream, ok := c.streams[addr.String()]
+	c.streamsLock.RUnlock()
+	if !ok {
+		err = fmt.Errorf("no stream connected from %s", addr.String())
+		return
+	}
+	err = stream.WriteDatagram(b)
+	if err != nil {
+		return
+	}
+	n = len(b)
+	return
+}
+
+func (c *streamServerConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		err = c.listener.Close()
+		c.streamsLock.RLock()
+		for _, stream := range c.streams {
+			_ = stream.Close()
+		}
+		c.streamsLock.RUnlock()
+	})
+	return
+}
+
+func (c *streamServerConn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *streamServerConn) SetDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+func (c *streamServerConn) SetReadDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+func (c *streamServerConn) SetWriteDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+// streamClientConn is a net.PacketConn for mwgp-client,
+// which sends the datagrams through a stream dialed to the destination.
+type streamClientConn struct {
+	dialFunc func(destination *net.UDPAddr) (stream datagramStream, err error)
+
+	stream            datagramStream
+	streamDestination *net.UDPAddr
+	streamCond        *sync.Cond
+	lastDialFailed    time.Time
+	dialing           bool
+	closed            bool
+}
+
+func newStreamClientConn(dialFunc func(destination *net.UDPAddr) (stream datagramStream, err error)) (c *streamClientConn) {
+	c = &streamClientConn{
+		dialFunc:   dialFunc,
+		streamCond: sync.NewCond(&sync.Mutex{}),
+	}
+	return
+}
+
+// newStreamDialer returns the dialer of the TCP connections for the stream transports.
+func newStreamDialer(options *SocketOptions) *net.Dialer {
+	return &net.Dialer{
+		Timeout: kStreamDialTimeout,
+		Control: options.control(),
+	}
+}
+
+// newTCPDatagramStreamDialer returns the dialFunc of streamClientConn for TCP transport.
+func newTCPDatagramStreamDialer(options *SocketOptions) func(destination *net.UDPAddr) (stream datagramStream, err error) {
+	dialer := newStreamDialer(options)
+	return func(destination *net.UDPAddr) (stream datagramStream, err error) {
+		conn, err := dialer.Dial("tcp", destination.String())
+		if err != nil {
+			return
+		}
+		stream = newTCPDatagramStream(conn)
+		return
+	}
+}
+
+// newWebSocketDatagramStreamDialer returns the dialFunc of streamClientConn for WebSocket transport.
+//
+// the TCP connection is dialed to the destination resolved by mwgp-client,
+// rather than the host of wsURL, so the resolver option also works for it.
+func newWebSocketDatagramStreamDialer(wsURL string, options *SocketOptions) (dialFunc func(destination *net.UDPAddr) (stream datagramStream, err error), err error) {
+	location, err := url.Parse(wsURL)
+	if err != nil {
+		return
+	}
+	var origin string
+	switch location.Scheme {
+	case "ws":
+		origin = "http://" + location.Host
+	case "wss":
+		origin = "https://" + location.Host
+	default:
+		err = fmt.Errorf("unsupported scheme: %s", location.Scheme)
+		return
+	}
+	config, err := websocket.NewConfig(wsURL, origin)
+	if err != nil {
+		return
+	}
+	dialer := newStreamDialer(options)
+	dialFunc = func(destination *net.UDPAddr) (stream datagramStream, err error) {
+		conn, err := dialer.Dial("tcp", destination.String())
+		if err != nil {
+			return
+		}
+		_ = conn.SetDeadline(time.Now().Add(kStreamDialTimeout))
+		if location.Scheme == "wss" {
+			conn = tls.Client(conn, &tls.Config{
+				ServerName: location.Hostname(),
+			})
+		}
+		wsConn, err := websocket.NewClient(config, conn)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		_ = conn.SetDeadline(time.Time{})
+		stream = newWebSocketDatagramStream(wsConn)
+		return
+	}
+	return
+}
+
+// currentStream waits until a stream is dialed.
+func (c *streamClientConn) currentStream() (stream datagramStream, destination *net.UDPAddr, err error) {
+	c.streamCond.L.Lock()
+	defer c.streamCond.L.Unlock()
+	for c.stream == nil && !c.closed {
+		c.streamCond.Wait()
+	}
+	if c.closed {
+		err = net.ErrClosed
+		return
+	}
+	stream = c.stream
+	destination = c.streamDestination
+	return
+}
+
+func (c *streamClientConn) dropStream(stream datagramStream) {
+	c.streamCond.L.Lock()
+	if c.stream == stream {
+		c.stream = nil
+		c.streamDestination = nil
+	}
+	c.streamCond.L.Unlock()
+	_ = stream.Close()
+}
+
+func (c *streamClientConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var stream datagramStream
+		var destination *net.UDPAddr
+		stream, destination, err = c.currentStream()
+		if err != nil {
+			return
+		}
+		n, err = stream.ReadDatagram(b)
+		if err != nil {
+			log.Printf("[info] stream to server %s is broken: %s\n", destination.String(), err.Error())
+			c.dropStream(stream)
+			continue
+		}
+		addr = destination
+		return
+	}
+}
+
+func (c *streamClientConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	destination, ok := addr.(*net.UDPAddr)
+	if !ok {
+		err = fmt.Errorf("unexpected destination address type %T", addr)
+		return
+	}
+
+	c.streamCond.L.Lock()
+	if c.closed {
+		c.streamCond.L.Unlock()
+		err = net.ErrClosed
+		return
+	}
+	if c.stream != nil && !(c.streamDestination.IP.Equal(destination.IP) && c.streamDestination.Port == destination.Port) {
+		// server address updated
+		_ = c.stream.Close()
+		c.stream = nil
+		c.streamDestination = nil
+	}
+	if c.stream == nil {
+		if c.dialing || time.Since(c.lastDialFailed) < kStreamRedialInterval {
+			c.streamCond.L.Unlock()
+			err = fmt.Errorf("stream to server %s is not connected", destination.String())
+			return
+		}
+		// dial without the lock, the reads and Close() should not wait for the dial timeout and the handshake
+		c.dialing = true
+		c.streamCond.L.Unlock()
+		var stream datagramStream
+		stream, err = c.dialFunc(destination)
+		c.streamCond.L.Lock()
+		c.dialing = false
+		if err != nil {
+			c.lastDialFailed = time.Now()
+			c.streamCond.L.Unlock()
+			err = fmt.Errorf("failed to dial server %s: %w", destination.String(), err)
+			return
+		}
+		if c.closed {
+			c.streamCond.L.Unlock()
+			_ = stream.Close()
+			err = net.ErrClosed
+			return
+		}
+		log.Printf("[info] stream to server %s is connected\n", destination.String())
+		c.stream = newQueuedDatagramStream(stream)
+		c.streamDestination = destination
+		c.streamCond.Broadcast()
+	}
+	stream := c.stream
+	c.streamCond.L.Unlock()
+
+	err = stream.WriteDatagram(b)
+	if err != nil {
+		c.dropStream(stream)
+		return
+	}
+	n = len(b)
+	return
+}
+
+func (c *streamClientConn) Close() (err error) {
+	c.streamCond.L.Lock()
+	defer c.streamCond.L.Unlock()
+	c.closed = true
+	if c.stream != nil {
+		err = c.stream.Close()
+		c.stream = nil
+		c.streamDestination = nil
+	}
+	c.streamCond.Broadcast()
+	return
+}
+
+func (c *streamClientConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *streamClientConn) SetDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+func (c *streamClientConn) SetReadDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+func (c *streamClientConn) SetWriteDeadline(t time.Time) error {
+	return errStreamDeadlineNotSupported
+}
+
+// webSocketURLHostPort returns the "host:port" of the WebSocket URL, with the default port of its scheme.
+func webSocketURLHostPort(wsURL string) (hostPort string, err error) {
+	location, err := url.Parse(wsURL)
+	if err != nil {
+		return
+	}
+	port := location.Port()
+	if port == "" {
+		switch location.Scheme {
+		case "ws":
+			port = "80"
+		case "wss":
+			port = "443"
+		default:
+			err = fmt.Errorf("unsupported scheme: %s", location.Scheme)
+			return
+		}
+	}
+	hostPort = net.JoinHostPort(location.Hostname(), port)
+	return
+}
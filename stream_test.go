@@ -0,0 +1,169 @@
+package mwgp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testStreamTransport(t *testing.T, server *streamServerConn, client *streamClientConn) {
+	defer server.Close()
+	defer client.Close()
+
+	serverAddr := server.LocalAddr().(*net.TCPAddr)
+	destination := &net.UDPAddr{IP: serverAddr.IP, Port: serverAddr.Port}
+
+	buf := make([]byte, defaultMaxPacketSize)
+	for _, length := range []int{1, 32, 148, 1452, kStreamMaxDatagramLength} {
+		datagram := bytes.Repeat([]byte{byte(length)}, length)
+		_, err := client.WriteTo(datagram, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, source, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("c2s datagram mismatch, length %d", length)
+		}
+
+		_, err = server.WriteTo(datagram, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, source, err = client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("s2c datagram mismatch, length %d", length)
+		}
+		if source.String() != destination.String() {
+			t.Fatalf("unexpected source %s, expected %s", source.String(), destination.String())
+		}
+	}
+}
+
+func TestStreamTransport_TCP(t *testing.T) {
+	server, err := listenTCPStreamServerConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStreamTransport(t, server, newStreamClientConn(newTCPDatagramStreamDialer(nil)))
+}
+
+func TestStreamTransport_WebSocket(t *testing.T) {
+	server, err := listenWebSocketStreamServerConn("127.0.0.1:0", "/mwgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialFunc, err := newWebSocketDatagramStreamDialer("ws://mwgp.example.com/mwgp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStreamTransport(t, server, newStreamClientConn(dialFunc))
+}
+
+// testDatagramStream is an in-memory datagramStream recording whether it is closed.
+type testDatagramStream struct {
+	closed bool
+}
+
+func (s *testDatagramStream) ReadDatagram(b []byte) (n int, err error) {
+	err = net.ErrClosed
+	return
+}
+
+func (s *testDatagramStream) WriteDatagram(b []byte) (err error) {
+	return
+}
+
+func (s *testDatagramStream) SetReadDeadline(t time.Time) (err error) {
+	return
+}
+
+func (s *testDatagramStream) SetWriteDeadline(t time.Time) (err error) {
+	return
+}
+
+func (s *testDatagramStream) Close() (err error) {
+	s.closed = true
+	return
+}
+
+func TestStreamClientConn_CloseWhileDialing(t *testing.T) {
+	dialStarted := make(chan struct{})
+	dialRelease := make(chan struct{})
+	stream := &testDatagramStream{}
+	client := newStreamClientConn(func(destination *net.UDPAddr) (datagramStream, error) {
+		close(dialStarted)
+		<-dialRelease
+		return stream, nil
+	})
+
+	destination := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	writeErr := make(chan error)
+	go func() {
+		_, err := client.WriteTo([]byte("datagram"), destination)
+		writeErr <- err
+	}()
+	<-dialStarted
+
+	// neither another write nor Close() waits for the dial
+	done := make(chan struct{})
+	go func() {
+		_, err := client.WriteTo([]byte("datagram"), destination)
+		if err == nil {
+			t.Error("expected the write to be dropped while dialing")
+		}
+		_ = client.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by the dial")
+	}
+
+	close(dialRelease)
+	err := <-writeErr
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed, got %v", err)
+	}
+	if !stream.closed {
+		t.Error("the stream dialed after Close() is not closed")
+	}
+}
+
+func TestQueuedDatagramStream_Stalled(t *testing.T) {
+	// the peer never reads
+	local, remote := net.Pipe()
+	defer remote.Close()
+	stream := newQueuedDatagramStream(newTCPDatagramStream(local))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < kStreamSendQueueSize*4; i++ {
+			err := stream.WriteDatagram(make([]byte, 1280))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by the stalled stream")
+	}
+
+	_ = stream.Close()
+	err := stream.WriteDatagram(make([]byte, 1280))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+package mwgp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The traffic limits share the capacity of the servers between the clients,
+// the bandwidth and the traffic quota are accounted for every client public key,
+// so a client cannot escape them by a new handshake.
+
+const (
+	TrafficQuotaDaily   = "daily"
+	TrafficQuotaWeekly  = "weekly"
+	TrafficQuotaMonthly = "monthly"
+
+	kTrafficUsageSaveInterval = time.Minute
+
+	// the default burst is at least a max size UDP packet
+	kMinDefaultBandwidthBurst = 65536
+)
+
+var errTrafficLimited = errors.New("traffic limited")
+
+// BandwidthLimitConfig is a token bucket of bytes, applied to each direction.
+type BandwidthLimitConfig struct {
+	// Rate is the number of bytes allowed per second.
+	Rate int64 `json:"rate"`
+	// Burst is the size of the bucket in bytes, default to Rate or 64 KiB, whichever is larger.
+	Burst int64 `json:"burst,omitempty"`
+}
+
+func (c *BandwidthLimitConfig) Validate() (err error) {
+	if c.Rate <= 0 {
+		err = fmt.Errorf("invalid rate %d", c.Rate)
+		return
+	}
+	if c.Burst < 0 {
+		err = fmt.Errorf("invalid burst %d", c.Burst)
+		return
+	}
+	return
+}
+
+func (c *BandwidthLimitConfig) burst() int64 {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	if c.Rate < kMinDefaultBandwidthBurst {
+		return kMinDefaultBandwidthBurst
+	}
+	return c.Rate
+}
+
+// TrafficQuotaConfig is the total bytes of both directions allowed in a period,
+// the client is blocked once it is exceeded, until the next period.
+type TrafficQuotaConfig struct {
+	Bytes int64 `json:"bytes"`
+	// Period is "daily", "weekly" (from Monday) or "monthly" in UTC,
+	// or a duration such as "72h" counted from the Unix epoch.
+	Period string `json:"period"`
+}
+
+func (c *TrafficQuotaConfig) Validate() (err error) {
+	if c.Bytes <= 0 {
+		err = fmt.Errorf("invalid bytes %d", c.Bytes)
+		return
+	}
+	switch c.Period {
+	case TrafficQuotaDaily, TrafficQuotaWeekly, TrafficQuotaMonthly:
+	default:
+		var d time.Duration
+		d, err = time.ParseDuration(c.Period)
+		if err != nil || d <= 0 {
+			err = fmt.Errorf("invalid period %s", c.Period)
+			return
+		}
+	}
+	return
+}
+
+// periodOf returns the period which now is in.
+func (c *TrafficQuotaConfig) periodOf(now time.Time) (start time.Time, end time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch c.Period {
+	case TrafficQuotaDaily:
+		start = day
+		end = start.AddDate(0, 0, 1)
+	case TrafficQuotaWeekly:
+		start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		end = start.AddDate(0, 0, 7)
+	case TrafficQuotaMonthly:
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, 0)
+	default:
+		// rounded from the Unix epoch, time.Truncate rounds from the zero time
+		d, _ := time.ParseDuration(c.Period)
+		start = time.Unix(0, now.UnixNano()/int64(d)*int64(d)).UTC()
+		end = start.Add(d)
+	}
+	return
+}
+
+// TrafficLimiter holds the traffic accounts of the clients, a nil one limits nothing.
+type TrafficLimiter struct {
+	// UsageFilePath is the file to persist the quota usage across restarts (optional).
+	UsageFilePath string
+
+	lock     sync.Mutex
+	accounts map[NoisePublicKey]*trafficAccount
+
+	saveLock sync.Mutex
+}
+
+type trafficAccount struct {
+	publicKey NoisePublicKey
+
+	lock sync.Mutex
+
+	// nil if unlimited
+	rateLimit  *BandwidthLimitConfig
+	upstream   tokenBucket
+	downstream tokenBucket
+
+	// nil if unlimited
+	quota       *TrafficQuotaConfig
+	periodStart time.Time
+	periodEnd   time.Time
+	used        int64
+}
+
+type trafficUsageFile struct {
+	Usage []trafficUsage `json:"usage"`
+}
+
+// trafficUsage also keeps the limits of the client,
+// so they are enforced on the peers loaded from the forward table cache before the next handshake.
+type trafficUsage struct {
+	ClientPublicKey NoisePublicKey        `json:"client_pubkey"`
+	PeriodStart     string                `json:"period_start,omitempty"`
+	Used            int64                 `json:"used"`
+	RateLimit       *BandwidthLimitConfig `json:"rate_limit,omitempty"`
+	Quota           *TrafficQuotaConfig   `json:"quota,omitempty"`
+}
+
+func NewTrafficLimiter(usageFilePath string) (l *TrafficLimiter, err error) {
+	l = &TrafficLimiter{
+		UsageFilePath: usageFilePath,
+		accounts:      make(map[NoisePublicKey]*trafficAccount),
+	}
+	if usageFilePath == "" {
+		return
+	}
+	bs, err := os.ReadFile(usageFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		} else {
+			err = fmt.Errorf("failed to read traffic usage file %s: %w", usageFilePath, err)
+		}
+		return
+	}
+	var file trafficUsageFile
+	err = json.Unmarshal(bs, &file)
+	if err != nil {
+		err = fmt.Errorf("failed to parse traffic usage file %s: %w", usageFilePath, err)
+		return
+	}
+	now := time.Now()
+	for _, usage := range file.Usage {
+		a := &trafficAccount{
+			publicKey: usage.ClientPublicKey,
+		}
+		a.setLimitsLocked(usage.RateLimit, usage.Quota, now)
+		if a.quota != nil && usage.PeriodStart != "" {
+			periodStart, perr := time.Parse(time.RFC3339, usage.PeriodStart)
+			if perr == nil && periodStart.Equal(a.periodStart) {
+				a.used = usage.Used
+			}
+		}
+		l.accounts[a.publicKey] = a
+	}
+	return
+}
+
+// account returns the traffic account of the client with the limits updated,
+// or nil if there is no limit.
+func (l *TrafficLimiter) account(publicKey NoisePublicKey, rateLimit *BandwidthLimitConfig, quota *TrafficQuotaConfig) (a *trafficAccount) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	a, ok := l.accounts[publicKey]
+	if !ok {
+		if rateLimit == nil && quota == nil {
+			return
+		}
+		a = &trafficAccount{
+			publicKey: publicKey,
+		}
+		l.accounts[publicKey] = a
+	}
+	a.lock.Lock()
+	a.setLimitsLocked(rateLimit, quota, time.Now())
+	a.lock.Unlock()
+	if rateLimit == nil && quota == nil {
+		delete(l.accounts, publicKey)
+		a = nil
+	}
+	return
+}
+
+// lookup returns the traffic account of the client if it has one.
+func (l *TrafficLimiter) lookup(publicKey NoisePublicKey) *trafficAccount {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.accounts[publicKey]
+}
+
+// Save writes the quota usage to UsageFilePath.
+func (l *TrafficLimiter) Save() (err error) {
+	if l == nil || l.UsageFilePath == "" {
+		return
+	}
+	l.saveLock.Lock()
+	defer l.saveLock.Unlock()
+
+	file := trafficUsageFile{
+		Usage: []trafficUsage{},
+	}
+	l.lock.Lock()
+	for _, a := range l.accounts {
+		a.lock.Lock()
+		usage := trafficUsage{
+			ClientPublicKey: a.publicKey,
+			Used:            a.used,
+			RateLimit:       a.rateLimit,
+			Quota:           a.quota,
+		}
+		if a.quota != nil {
+			usage.PeriodStart = a.periodStart.Format(time.RFC3339)
+		}
+		a.lock.Unlock()
+		file.Usage = append(file.Usage, usage)
+	}
+	l.lock.Unlock()
+
+	bs, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return
+	}
+	tmpfile := l.UsageFilePath + ".tmp"
+	err = os.WriteFile(tmpfile, bs, 0644)
+	if err != nil {
+		err = fmt.Errorf("failed to write traffic usage tmpfile %s: %w", tmpfile, err)
+		return
+	}
+	err = os.Rename(tmpfile, l.UsageFilePath)
+	if err != nil {
+		err = fmt.Errorf("failed to create traffic usage file %s: %w", l.UsageFilePath, err)
+		return
+	}
+	return
+}
+
+func (a *trafficAccount) setLimitsLocked(rateLimit *BandwidthLimitConfig, quota *TrafficQuotaConfig, now time.Time) {
+	if rateLimit != nil && a.rateLimit == nil {
+		a.upstream = tokenBucket{tokens: float64(rateLimit.burst()), last: now}
+		a.downstream = a.upstream
+	}
+	a.rateLimit = rateLimit
+	a.quota = quota
+	if quota == nil {
+		a.used = 0
+		return
+	}
+	a.rollPeriodLocked(now)
+}
+
+// rollPeriodLocked resets the usage if the period is over.
+func (a *trafficAccount) rollPeriodLocked(now time.Time) {
+	if !now.Before(a.periodEnd) || now.Before(a.periodStart) {
+		a.periodStart, a.periodEnd = a.quota.periodOf(now)
+		a.used = 0
+	}
+}
+
+// blocked returns true if the client has exceeded its quota.
+func (a *trafficAccount) blocked(now time.Time) bool {
+	if a == nil {
+		return false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.quota == nil {
+		return false
+	}
+	a.rollPeriodLocked(now)
+	return a.used >= a.quota.Bytes
+}
+
+// allow accounts the MessageTransport packet of n bytes, returns false if it should be dropped.
+func (a *trafficAccount) allow(n int, s2c bool, now time.Time) bool {
+	if a == nil {
+		return true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.quota != nil {
+		a.rollPeriodLocked(now)
+		if a.used >= a.quota.Bytes {
+			return false
+		}
+	}
+	if a.rateLimit != nil {
+		bucket := &a.upstream
+		if s2c {
+			bucket = &a.downstream
+		}
+		bucket.refill(float64(a.rateLimit.Rate), float64(a.rateLimit.burst()), now)
+		// a packet larger than the tokens left is allowed as a debt, so any burst works with any packet size
+		if bucket.tokens <= 0 {
+			return false
+		}
+		bucket.tokens -= float64(n)
+	}
+	if a.quota != nil {
+		a.used += int64(n)
+		if a.used >= a.quota.Bytes {
+			log.Printf("[info] client %s exceeded the traffic quota of %d bytes, blocked until %s\n",
+				a.publicKey.Base64(), a.quota.Bytes, a.periodEnd.Format(time.RFC3339))
+		}
+	}
+	return true
+}
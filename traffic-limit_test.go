@@ -0,0 +1,145 @@
+package mwgp
+
+import (
+	"errors"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficAccount_RateLimit(t *testing.T) {
+	l, err := NewTrafficLimiter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey NoisePublicKey
+	a := l.account(publicKey, &BandwidthLimitConfig{Rate: 1000, Burst: 1500}, nil)
+	now := a.upstream.last
+
+	// the burst is allowed in each direction, the last packet goes into debt
+	for _, s2c := range []bool{false, true} {
+		if !a.allow(1000, s2c, now) || !a.allow(1000, s2c, now) {
+			t.Fatalf("expected the burst to be allowed, s2c=%v", s2c)
+		}
+		if a.allow(1000, s2c, now) {
+			t.Fatalf("expected the packet to be dropped, s2c=%v", s2c)
+		}
+	}
+
+	// the debt of 500 bytes is paid in 0.5s
+	if a.allow(1000, false, now.Add(500*time.Millisecond)) {
+		t.Fatal("expected the packet to be dropped before the debt is paid")
+	}
+	if !a.allow(1000, false, now.Add(600*time.Millisecond)) {
+		t.Fatal("expected the packet to be allowed after the debt is paid")
+	}
+
+	if l.account(publicKey, nil, nil) != nil || l.lookup(publicKey) != nil {
+		t.Error("expected the account to be removed without limits")
+	}
+}
+
+func TestTrafficAccount_Quota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	l, err := NewTrafficLimiter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey NoisePublicKey
+	publicKey.NoisePublicKey[0] = 1
+	quota := &TrafficQuotaConfig{Bytes: 2000, Period: TrafficQuotaDaily}
+	a := l.account(publicKey, nil, quota)
+	now := time.Now()
+
+	if !a.allow(1000, false, now) || !a.allow(1000, true, now) {
+		t.Fatal("expected the packets within the quota to be allowed")
+	}
+	if a.allow(100, false, now) || !a.blocked(now) {
+		t.Fatal("expected the client to be blocked")
+	}
+
+	// the usage persists across restarts
+	err = l.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewTrafficLimiter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = l.lookup(publicKey)
+	if a == nil || !a.blocked(now) {
+		t.Fatal("expected the loaded client to be blocked")
+	}
+
+	// until the next period
+	if a.blocked(a.periodEnd) || !a.allow(1000, false, a.periodEnd) {
+		t.Error("expected the client to be unblocked in the next period")
+	}
+}
+
+func TestTrafficQuotaConfig_Period(t *testing.T) {
+	now := time.Date(2024, 2, 29, 13, 0, 0, 0, time.UTC) // Thursday
+	for _, c := range []struct {
+		period     string
+		start, end time.Time
+	}{
+		{TrafficQuotaDaily, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{TrafficQuotaWeekly, time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{TrafficQuotaMonthly, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"12h", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 30, 0, 0, 0, 0, time.UTC)},
+		// the durations are rounded from the Unix epoch
+		{"72h", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+	} {
+		quota := &TrafficQuotaConfig{Bytes: 1, Period: c.period}
+		if err := quota.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		start, end := quota.periodOf(now)
+		if !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("%s: expected %s - %s, got %s - %s", c.period, c.start, c.end, start, end)
+		}
+	}
+}
+
+func TestWireGuardIndexTranslationTable_TrafficLimitedRoaming(t *testing.T) {
+	l, err := NewTrafficLimiter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey NoisePublicKey
+	a := l.account(publicKey, nil, &TrafficQuotaConfig{Bytes: 1000, Period: TrafficQuotaDaily})
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	peer := &Peer{
+		clientDestination: clientAddr,
+		serverProxyIndex:  0x22222222,
+		traffic:           a,
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.serverMap.Store(peer.serverProxyIndex, peer)
+
+	packet := &Packet{Data: make([]byte, defaultMaxPacketSize), Length: 1000}
+	packet.Data[0] = device.MessageTransportType
+	_ = packet.SetReceiverIndex(peer.serverProxyIndex)
+	packet.Source = clientAddr
+	_, err = table.processMessageTransport(packet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastActive := peer.lastActiveTime()
+
+	// over the quota, the client neither roams nor keeps the peer alive
+	packet.Source = netip.MustParseAddrPort("192.0.2.2:51820")
+	_, err = table.processMessageTransport(packet, false)
+	if !errors.Is(err, errTrafficLimited) {
+		t.Fatalf("expected traffic limited, got %v", err)
+	}
+	if peer.clientDestination != clientAddr {
+		t.Errorf("the limited client roamed to %s", peer.clientDestination)
+	}
+	if !peer.lastActiveTime().Equal(lastActive) {
+		t.Error("the limited packet kept the peer alive")
+	}
+}
@@ -0,0 +1,318 @@
+package mwgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Transport is a packet-oriented endpoint of the WGIT table, such as a UDP socket.
+//
+// Transports can be stacked, e.g. the obfuscation is a Transport wrapping another one.
+type Transport interface {
+	// ReadPacket reads a packet into packet.Data, and sets packet.Length and packet.Source.
+	ReadPacket(packet *Packet) (err error)
+
+	// WritePacket writes packet.Slice() to packet.Destination.
+	WritePacket(packet *Packet) (err error)
+
+	Close() (err error)
+}
+
+// BatchTransport is a Transport that can read and write multiple packets in a single call,
+// such as with recvmmsg(2) and sendmmsg(2) on Linux.
+type BatchTransport interface {
+	Transport
+
+	// BatchSize returns the max number of packets can be read or written in a single call.
+	BatchSize() int
+
+	// ReadPackets reads at least one packet into packets, and returns the number of packets read,
+	// which are placed at the beginning of packets.
+	ReadPackets(packets []*Packet) (n int, err error)
+
+	// WritePackets writes all the packets.
+	WritePackets(packets []*Packet) (err error)
+}
+
+const (
+	kPacketBatchSize = 64
+)
+
+// transportBatchSize returns the BatchSize of transport if it is a BatchTransport, or 1.
+func transportBatchSize(transport Transport) int {
+	if bt, ok := transport.(BatchTransport); ok {
+		return bt.BatchSize()
+	}
+	return 1
+}
+
+// readPackets reads packets from transport in a batch if it is supported.
+func readPackets(transport Transport, packets []*Packet) (n int, err error) {
+	if bt, ok := transport.(BatchTransport); ok {
+		return bt.ReadPackets(packets)
+	}
+	err = transport.ReadPacket(packets[0])
+	if err != nil {
+		return
+	}
+	n = 1
+	return
+}
+
+// writePackets writes packets to transport in a batch if it is supported.
+func writePackets(transport Transport, packets []*Packet) (err error) {
+	if bt, ok := transport.(BatchTransport); ok {
+		return bt.WritePackets(packets)
+	}
+	for _, packet := range packets {
+		err = transport.WritePacket(packet)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// udpBatcher reads and writes packets in a batch with the platform specific syscalls.
+//
+// It may enable the receive offload on the socket, so ReadPacket must not be mixed with readPackets.
+type udpBatcher interface {
+	readPackets(packets []*Packet) (n int, err error)
+	writePackets(packets []*Packet) (err error)
+}
+
+// PacketConnTransport is the default Transport over a net.PacketConn.
+type PacketConnTransport struct {
+	conn net.PacketConn
+
+	// not nil if conn is a *net.UDPConn, to avoid the allocation of net.Addr.
+	udpConn *net.UDPConn
+
+	// not nil if conn is a *net.UDPConn and the platform supports batch I/O.
+	batch udpBatcher
+}
+
+func NewPacketConnTransport(conn net.PacketConn) (t *PacketConnTransport) {
+	t = &PacketConnTransport{
+		conn: conn,
+	}
+	t.udpConn, _ = conn.(*net.UDPConn)
+	if t.udpConn != nil {
+		t.batch = newUDPBatcher(t.udpConn)
+	}
+	return
+}
+
+// udpNetwork returns "udp4" or "udp6" for the specified IP of addr,
+// or "udp" for the dual-stack socket if the IP is not specified.
+//
+// so "0.0.0.0:1000" and "[::]:1000" can be listened at the same time.
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr == nil || addr.IP == nil {
+		return "udp"
+	}
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// ListenUDPTransport listens on addr and returns a PacketConnTransport over it.
+func ListenUDPTransport(addr *net.UDPAddr) (t *PacketConnTransport, err error) {
+	return ListenUDPTransportWithOptions(addr, nil)
+}
+
+// ListenUDPTransportWithOptions is ListenUDPTransport with the socket options set (optional).
+func ListenUDPTransportWithOptions(addr *net.UDPAddr, options *SocketOptions) (t *PacketConnTransport, err error) {
+	if options.isEmpty() {
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP(udpNetwork(addr), addr)
+		if err != nil {
+			return
+		}
+		t = NewPacketConnTransport(conn)
+		return
+	}
+	lc := net.ListenConfig{
+		Control: options.control(),
+	}
+	bindAddr := &net.UDPAddr{}
+	if addr != nil {
+		bindAddr = addr
+	}
+	conn, err := lc.ListenPacket(context.Background(), udpNetwork(addr), bindAddr.String())
+	if err != nil {
+		return
+	}
+	t = NewPacketConnTransport(conn)
+	return
+}
+
+// ListenUDPTransports listens on addr with n sockets sharing the same port with SO_REUSEPORT,
+// the kernel distributes the packets among them by the hash of the source.
+func ListenUDPTransports(addr *net.UDPAddr, n int, options *SocketOptions) (transports []*PacketConnTransport, err error) {
+	if n <= 1 {
+		var transport *PacketConnTransport
+		transport, err = ListenUDPTransportWithOptions(addr, options)
+		if err != nil {
+			return
+		}
+		transports = append(transports, transport)
+		return
+	}
+	if !reusePortSupported {
+		err = errors.New("SO_REUSEPORT is not supported on this platform")
+		return
+	}
+	lc := net.ListenConfig{
+		Control: chainControl(reusePortControl, options.control()),
+	}
+	bindAddr := &net.UDPAddr{}
+	if addr != nil {
+		*bindAddr = *addr
+	}
+	for i := 0; i < n; i++ {
+		var conn net.PacketConn
+		conn, err = lc.ListenPacket(context.Background(), udpNetwork(addr), bindAddr.String())
+		if err != nil {
+			for _, transport := range transports {
+				_ = transport.Close()
+			}
+			transports = nil
+			return
+		}
+		if bindAddr.Port == 0 {
+			// the rest ones share the port allocated to the first one
+			bindAddr.Port = conn.LocalAddr().(*net.UDPAddr).Port
+		}
+		transports = append(transports, NewPacketConnTransport(conn))
+	}
+	return
+}
+
+// ListenTransparentUDPTransport listens on a non-local addr with IP_TRANSPARENT (Linux only, requires CAP_NET_ADMIN),
+// so the packets are sent from addr, and the packets to addr are received if they are routed to the local host.
+func ListenTransparentUDPTransport(addr *net.UDPAddr, options *SocketOptions) (t *PacketConnTransport, err error) {
+	if !transparentSupported {
+		err = errors.New("IP_TRANSPARENT is not supported on this platform")
+		return
+	}
+	network := "udp6"
+	if addr.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{
+		Control: chainControl(transparentControl, options.control()),
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return
+	}
+	t = NewPacketConnTransport(conn)
+	return
+}
+
+func (t *PacketConnTransport) ReadPacket(packet *Packet) (err error) {
+	if t.udpConn != nil {
+		var source netip.AddrPort
+		packet.Length, source, err = t.udpConn.ReadFromUDPAddrPort(packet.Data[:])
+		if err != nil {
+			return
+		}
+		packet.Source = unmapAddrPort(source)
+		return
+	}
+	var source net.Addr
+	packet.Length, source, err = t.conn.ReadFrom(packet.Data[:])
+	if err != nil {
+		return
+	}
+	udpAddr, ok := source.(*net.UDPAddr)
+	if !ok {
+		err = fmt.Errorf("unexpected source address type %T", source)
+		return
+	}
+	packet.Source = addrPortFromUDPAddr(udpAddr)
+	return
+}
+
+func (t *PacketConnTransport) WritePacket(packet *Packet) (err error) {
+	if packet.Local.IsValid() && t.batch != nil {
+		// only the batcher sets the source address
+		return t.batch.writePackets([]*Packet{packet})
+	}
+	if t.udpConn != nil {
+		_, err = t.udpConn.WriteToUDPAddrPort(packet.Slice(), packet.Destination)
+		return
+	}
+	_, err = t.conn.WriteTo(packet.Slice(), net.UDPAddrFromAddrPort(packet.Destination))
+	return
+}
+
+func (t *PacketConnTransport) BatchSize() int {
+	if t.batch == nil {
+		return 1
+	}
+	return kPacketBatchSize
+}
+
+func (t *PacketConnTransport) ReadPackets(packets []*Packet) (n int, err error) {
+	if t.batch == nil {
+		err = t.ReadPacket(packets[0])
+		if err != nil {
+			return
+		}
+		n = 1
+		return
+	}
+	return t.batch.readPackets(packets)
+}
+
+func (t *PacketConnTransport) WritePackets(packets []*Packet) (err error) {
+	if t.batch == nil {
+		for _, packet := range packets {
+			err = t.WritePacket(packet)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	return t.batch.writePackets(packets)
+}
+
+func (t *PacketConnTransport) Close() (err error) {
+	return t.conn.Close()
+}
+
+// LocalAddr returns the local address of the underlying net.PacketConn.
+func (t *PacketConnTransport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// unmapAddrPort converts the IPv4-mapped IPv6 address received from a dual-stack socket to IPv4,
+// so the addresses can be compared with the resolved ones.
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+func addrPortFromUDPAddr(addr *net.UDPAddr) netip.AddrPort {
+	return unmapAddrPort(addr.AddrPort())
+}
+
+// compactPackets moves the first n packets accepted by keep to the beginning of packets,
+// and returns the number of them. The dropped packets are reset, but still owned by the caller.
+func compactPackets(packets []*Packet, n int, keep func(packet *Packet) bool) (kept int) {
+	for i := 0; i < n; i++ {
+		if !keep(packets[i]) {
+			packets[i].Reset()
+			continue
+		}
+		packets[kept], packets[i] = packets[i], packets[kept]
+		kept++
+	}
+	return
+}
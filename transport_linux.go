@@ -0,0 +1,544 @@
+//go:build linux
+
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// not defined in the syscall package
+const (
+	kUDPSegment = 103 // UDP_SEGMENT
+	kUDPGRO     = 104 // UDP_GRO
+)
+
+const (
+	// the max number of segments in a single UDP GSO send, limited by the kernel
+	kMaxGSOSegments = 64
+
+	// the max UDP payload size for a GSO send or a GRO receive
+	kMaxGSOSize = 65507
+)
+
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound.
+func reusePortControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+const transparentSupported = true
+
+// transparentControl sets IP_TRANSPARENT or IPV6_TRANSPARENT on the socket before it is bound.
+func transparentControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		if network == "udp4" {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		} else {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+const socketOptionsSupported = true
+
+// setSocketOptions sets the options on the socket fd, it is called by the Control function of SocketOptions.
+func setSocketOptions(fd uintptr, o *SocketOptions) (err error) {
+	s := int(fd)
+	if o.Mark != 0 {
+		err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_MARK, o.Mark)
+		if err != nil {
+			err = fmt.Errorf("failed to set SO_MARK: %w", err)
+			return
+		}
+	}
+	if o.BindToDevice != "" {
+		err = unix.BindToDevice(s, o.BindToDevice)
+		if err != nil {
+			err = fmt.Errorf("failed to set SO_BINDTODEVICE: %w", err)
+			return
+		}
+	}
+	if o.DSCP != 0 {
+		tos := o.DSCP << 2
+		domain, _ := unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if domain == unix.AF_INET6 {
+			err = unix.SetsockoptInt(s, unix.SOL_IPV6, unix.IPV6_TCLASS, tos)
+			if err != nil {
+				err = fmt.Errorf("failed to set IPV6_TCLASS: %w", err)
+				return
+			}
+		}
+		// also for the IPv4 packets from a dual-stack socket
+		err = unix.SetsockoptInt(s, unix.SOL_IP, unix.IP_TOS, tos)
+		if err != nil && domain != unix.AF_INET6 {
+			err = fmt.Errorf("failed to set IP_TOS: %w", err)
+			return
+		}
+		err = nil
+	}
+	if o.ReceiveBuffer > 0 {
+		err = setSocketBuffer(s, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, o.ReceiveBuffer)
+		if err != nil {
+			err = fmt.Errorf("failed to set SO_RCVBUF: %w", err)
+			return
+		}
+	}
+	if o.SendBuffer > 0 {
+		err = setSocketBuffer(s, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, o.SendBuffer)
+		if err != nil {
+			err = fmt.Errorf("failed to set SO_SNDBUF: %w", err)
+			return
+		}
+	}
+	return
+}
+
+// setSocketBuffer sets the buffer size with the force option first, which requires CAP_NET_ADMIN,
+// then falls back to the one limited by the sysctl.
+func setSocketBuffer(s int, force int, opt int, size int) (err error) {
+	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, force, size)
+	if err == nil {
+		return
+	}
+	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, opt, size)
+	return
+}
+
+// ipv4.Message and ipv6.Message are the same type.
+type udpBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// pendingSegment is a segment of a GRO coalesced datagram, which did not fit in the packets of a read.
+type pendingSegment struct {
+	offset int
+	length int
+	source netip.AddrPort
+	local  netip.Addr
+}
+
+// linuxUDPBatcher reads and writes packets with recvmmsg(2) and sendmmsg(2).
+//
+// If the kernel supports UDP GRO, the coalesced datagrams are split into the packets
+// before they are returned, so the upper layers always see single WireGuard messages.
+// If the kernel supports UDP GSO, the consecutive packets to the same destination
+// are coalesced with UDP_SEGMENT before they are sent.
+//
+// If the socket listens on a wildcard address, the local address of every received packet
+// is recorded with IP_PKTINFO (or IPV6_RECVPKTINFO), and the packets with Packet.Local set
+// are sent from it, so the replies leave from the address the clients sent to.
+type linuxUDPBatcher struct {
+	conn    udpBatchConn
+	rawConn syscall.RawConn
+	pktinfo bool
+
+	// only used by the single read loop of the transport
+	readMessages []ipv4.Message
+	groChecked   bool
+	groEnabled   bool
+	// the max number of segments per datagram in the last read, to limit the next read
+	groSegments     int
+	pendingData     []byte
+	pendingSegments []pendingSegment
+	scratch         []*Packet
+	segmentSizes    []int
+
+	writeMessages []ipv4.Message
+	writeLock     sync.Mutex
+	gsoEnabled    bool
+}
+
+func newUDPBatcher(conn *net.UDPConn) udpBatcher {
+	b := &linuxUDPBatcher{
+		readMessages:  make([]ipv4.Message, kPacketBatchSize),
+		writeMessages: make([]ipv4.Message, kPacketBatchSize),
+		groSegments:   1,
+		segmentSizes:  make([]int, kPacketBatchSize),
+	}
+	addr, _ := conn.LocalAddr().(*net.UDPAddr)
+	ipv4Socket := addr != nil && addr.IP.To4() != nil
+	if ipv4Socket {
+		b.conn = ipv4.NewPacketConn(conn)
+	} else {
+		b.conn = ipv6.NewPacketConn(conn)
+	}
+	b.rawConn, _ = conn.SyscallConn()
+	for i := range b.readMessages {
+		b.readMessages[i].Buffers = make([][]byte, 1)
+		b.readMessages[i].OOB = make([]byte, syscall.CmsgSpace(4)+syscall.CmsgSpace(unix.SizeofInet6Pktinfo))
+	}
+	for i := range b.writeMessages {
+		b.writeMessages[i].Buffers = make([][]byte, 0, kMaxGSOSegments)
+		b.writeMessages[i].OOB = make([]byte, 0, syscall.CmsgSpace(2)+syscall.CmsgSpace(unix.SizeofInet6Pktinfo))
+	}
+	b.gsoEnabled = b.supportsGSO()
+	if addr != nil && addr.IP.IsUnspecified() {
+		b.pktinfo = b.enablePacketInfo(ipv4Socket)
+	}
+	return b
+}
+
+// enablePacketInfo enables the local address of the received packets in the control messages.
+func (b *linuxUDPBatcher) enablePacketInfo(ipv4Socket bool) (ok bool) {
+	if b.rawConn == nil {
+		return
+	}
+	_ = b.rawConn.Control(func(fd uintptr) {
+		if ipv4Socket {
+			ok = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_PKTINFO, 1) == nil
+			return
+		}
+		ok = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVPKTINFO, 1) == nil
+		// for the IPv4 packets received by a dual-stack socket
+		_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_PKTINFO, 1)
+	})
+	if !ok {
+		log.Printf("[warn] IP_PKTINFO is not supported, replies may not leave from the local address the clients sent to\n")
+	}
+	return
+}
+
+func (b *linuxUDPBatcher) supportsGSO() (ok bool) {
+	if b.rawConn == nil {
+		return
+	}
+	_ = b.rawConn.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_UDP, kUDPSegment)
+		ok = err == nil
+	})
+	return
+}
+
+// enableGRO enables UDP GRO on the socket, only if the packets are large enough for the coalesced datagrams.
+func (b *linuxUDPBatcher) enableGRO(packet *Packet) {
+	b.groChecked = true
+	if b.rawConn == nil || len(packet.Data) < kMaxGSOSize {
+		return
+	}
+	_ = b.rawConn.Control(func(fd uintptr) {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, kUDPGRO, 1)
+		b.groEnabled = err == nil
+	})
+}
+
+func (b *linuxUDPBatcher) readPackets(packets []*Packet) (n int, err error) {
+	if len(b.pendingSegments) > 0 {
+		n = b.readPendingSegments(packets)
+		return
+	}
+	if len(packets) > len(b.readMessages) {
+		packets = packets[:len(b.readMessages)]
+	}
+	if !b.groChecked {
+		b.enableGRO(packets[0])
+	}
+
+	count := len(packets)
+	if b.groEnabled {
+		// leave room for the segments of coalesced datagrams
+		count = len(packets) / b.groSegments
+		if count < 1 {
+			count = 1
+		}
+	}
+	ms := b.readMessages[:count]
+	for i := range ms {
+		ms[i].Buffers[0] = packets[i].Data
+		ms[i].OOB = ms[i].OOB[:cap(ms[i].OOB)]
+	}
+	m, err := b.conn.ReadBatch(ms, 0)
+	if err != nil {
+		return
+	}
+	b.groSegments = 1
+	for i := 0; i < m; i++ {
+		packets[i].Length = ms[i].N
+		if addr, ok := ms[i].Addr.(*net.UDPAddr); ok {
+			packets[i].Source = addrPortFromUDPAddr(addr)
+		}
+		if b.groEnabled || b.pktinfo {
+			b.segmentSizes[i], packets[i].Local = parseControlMessages(ms[i].OOB[:ms[i].NN])
+		}
+	}
+	if !b.groEnabled {
+		n = m
+		return
+	}
+	n = b.splitSegments(packets, m, func(i int) int {
+		return b.segmentSizes[i]
+	})
+	return
+}
+
+// parseControlMessages returns the segment size of a GRO coalesced datagram (or 0),
+// and the local address it received on (if IP_PKTINFO is enabled) from its control messages.
+//
+// it does not allocate, unlike syscall.ParseSocketControlMessage.
+func parseControlMessages(oob []byte) (segmentSize int, local netip.Addr) {
+	for len(oob) >= syscall.CmsgLen(0) {
+		header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		length := int(header.Len)
+		if length < syscall.CmsgLen(0) || length > len(oob) {
+			return
+		}
+		data := oob[syscall.CmsgLen(0):length]
+		switch {
+		case header.Level == syscall.IPPROTO_UDP && header.Type == kUDPGRO && len(data) >= 4:
+			segmentSize = int(*(*int32)(unsafe.Pointer(&data[0])))
+		case header.Level == unix.SOL_IP && header.Type == unix.IP_PKTINFO && len(data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			local = netip.AddrFrom4(info.Addr)
+		case header.Level == unix.SOL_IPV6 && header.Type == unix.IPV6_PKTINFO && len(data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			local = netip.AddrFrom16(info.Addr).Unmap()
+		}
+		next := syscall.CmsgSpace(length - syscall.CmsgLen(0))
+		if next > len(oob) {
+			return
+		}
+		oob = oob[next:]
+	}
+	return
+}
+
+// splitSegments splits the first m packets into segments with the size returned by segmentSize,
+// and returns the number of packets, which are placed at the beginning of packets.
+//
+// The extra segments are copied into the unused packets, and the ones that do not fit
+// are kept as pending and returned by the next reads, so the order is preserved.
+func (b *linuxUDPBatcher) splitSegments(packets []*Packet, m int, segmentSize func(i int) int) (n int) {
+	b.scratch = append(b.scratch[:0], packets...)
+	datagrams := b.scratch[:m]
+	free := b.scratch[m:]
+	var unused []*Packet
+
+	for i, packet := range datagrams {
+		size := segmentSize(i)
+		segments := 1
+		if size > 0 && size < packet.Length {
+			segments = (packet.Length + size - 1) / size
+		} else {
+			size = packet.Length
+		}
+		if segments > b.groSegments {
+			b.groSegments = segments
+		}
+		placed := false
+		for s := 0; s < segments; s++ {
+			offset := s * size
+			end := offset + size
+			if end > packet.Length {
+				end = packet.Length
+			}
+			if len(b.pendingSegments) > 0 || (offset > 0 && len(free) == 0) {
+				b.pendingSegments = append(b.pendingSegments, pendingSegment{
+					offset: len(b.pendingData),
+					length: end - offset,
+					source: packet.Source,
+					local:  packet.Local,
+				})
+				b.pendingData = append(b.pendingData, packet.Data[offset:end]...)
+				continue
+			}
+			if offset == 0 {
+				// the first segment is already in place
+				packets[n] = packet
+				placed = true
+			} else {
+				segment := free[len(free)-1]
+				free = free[:len(free)-1]
+				segment.Length = copy(segment.Data, packet.Data[offset:end])
+				segment.Source = packet.Source
+				segment.Local = packet.Local
+				packets[n] = segment
+			}
+			n++
+		}
+		if placed {
+			packet.Length = size
+		} else {
+			unused = append(unused, packet)
+		}
+	}
+
+	rest := packets[n:]
+	rest = rest[copy(rest, free):]
+	copy(rest, unused)
+	for _, packet := range packets[n:] {
+		packet.Reset()
+	}
+	for i := range b.scratch {
+		b.scratch[i] = nil
+	}
+	return
+}
+
+func (b *linuxUDPBatcher) readPendingSegments(packets []*Packet) (n int) {
+	for n < len(packets) && n < len(b.pendingSegments) {
+		segment := b.pendingSegments[n]
+		packets[n].Length = copy(packets[n].Data, b.pendingData[segment.offset:segment.offset+segment.length])
+		packets[n].Source = segment.source
+		packets[n].Local = segment.local
+		n++
+	}
+	b.pendingSegments = b.pendingSegments[:copy(b.pendingSegments, b.pendingSegments[n:])]
+	if len(b.pendingSegments) == 0 {
+		b.pendingData = b.pendingData[:0]
+	}
+	return
+}
+
+func (b *linuxUDPBatcher) writePackets(packets []*Packet) (err error) {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	for len(packets) > 0 {
+		gso := b.gsoEnabled
+		var ms []ipv4.Message
+		var consumed int
+		ms, consumed = b.prepareWriteMessages(packets, gso)
+		// sendmmsg(2) may send only a part of messages
+		for sent := 0; sent < len(ms); {
+			var n int
+			n, err = b.conn.WriteBatch(ms[sent:], 0)
+			if err == nil && n == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				break
+			}
+			sent += n
+		}
+		if err != nil {
+			if gso && errors.Is(err, syscall.EIO) {
+				// the device does not support checksum offload, which is required by UDP GSO.
+				// the messages may be partially sent, but it is fine for WireGuard.
+				log.Printf("[warn] disable UDP GSO since it is not supported by the device: %s\n", err.Error())
+				b.gsoEnabled = false
+				err = nil
+				continue
+			}
+			return
+		}
+		packets = packets[consumed:]
+	}
+	return
+}
+
+// prepareWriteMessages fills the write messages with packets, coalescing the consecutive
+// packets to the same destination if gso is true. It returns the messages and the number of packets in them.
+func (b *linuxUDPBatcher) prepareWriteMessages(packets []*Packet, gso bool) (ms []ipv4.Message, consumed int) {
+	ms = b.writeMessages[:0]
+	for consumed < len(packets) && len(ms) < len(b.writeMessages) {
+		first := packets[consumed]
+		segments := 1
+		if gso {
+			size := first.Length
+			total := size
+			for consumed+segments < len(packets) && segments < kMaxGSOSegments {
+				next := packets[consumed+segments]
+				if next.Destination != first.Destination || next.Local != first.Local || next.Length > size || total+next.Length > kMaxGSOSize {
+					break
+				}
+				total += next.Length
+				segments++
+				if next.Length < size {
+					// only the last segment can be shorter
+					break
+				}
+			}
+		}
+
+		ms = ms[:len(ms)+1]
+		message := &ms[len(ms)-1]
+		message.Buffers = message.Buffers[:0]
+		for _, packet := range packets[consumed : consumed+segments] {
+			message.Buffers = append(message.Buffers, packet.Slice())
+		}
+		message.Addr = net.UDPAddrFromAddrPort(first.Destination)
+		message.OOB = message.OOB[:0]
+		if segments > 1 {
+			message.OOB = appendUDPSegmentControlMessage(message.OOB, uint16(first.Length))
+		}
+		if b.pktinfo && first.Local.IsValid() {
+			message.OOB = appendPacketInfoControlMessage(message.OOB, first.Local)
+		}
+		if len(message.OOB) == 0 {
+			// x/net reuses the msghdrs of sendmmsg(2) without clearing the control messages
+			// if the OOB is empty, so a stale IP_PKTINFO or UDP_SEGMENT may be sent with it.
+			message.OOB = appendNoopControlMessage(message.OOB)
+		}
+		consumed += segments
+	}
+	return
+}
+
+// appendControlMessage appends a zeroed control message with dataLen bytes of data to oob,
+// oob must have enough capacity.
+func appendControlMessage(oob []byte, level int32, typ int32, dataLen int) (out []byte, data []byte) {
+	start := len(oob)
+	out = oob[:start+syscall.CmsgSpace(dataLen)]
+	for i := range out[start:] {
+		out[start+i] = 0
+	}
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&out[start]))
+	header.Level = level
+	header.Type = typ
+	header.SetLen(syscall.CmsgLen(dataLen))
+	data = out[start+syscall.CmsgLen(0) : start+syscall.CmsgLen(dataLen)]
+	return
+}
+
+// appendNoopControlMessage appends a control message ignored by the UDP sockets of both IPv4 and IPv6,
+// as they only handle the ones of SOL_SOCKET, SOL_UDP, SOL_IP and SOL_IPV6.
+func appendNoopControlMessage(oob []byte) []byte {
+	oob, _ = appendControlMessage(oob, syscall.IPPROTO_TCP, 0, 0)
+	return oob
+}
+
+// appendUDPSegmentControlMessage appends a UDP_SEGMENT control message to oob.
+func appendUDPSegmentControlMessage(oob []byte, size uint16) []byte {
+	oob, data := appendControlMessage(oob, syscall.IPPROTO_UDP, kUDPSegment, 2)
+	*(*uint16)(unsafe.Pointer(&data[0])) = size
+	return oob
+}
+
+// appendPacketInfoControlMessage appends an IP_PKTINFO or IPV6_PKTINFO control message to oob,
+// so the packet is sent from the local address.
+//
+// IP_PKTINFO also works for the IPv4 packets sent from a dual-stack socket.
+func appendPacketInfoControlMessage(oob []byte, local netip.Addr) []byte {
+	if local.Is4() {
+		oob, data := appendControlMessage(oob, unix.SOL_IP, unix.IP_PKTINFO, unix.SizeofInet4Pktinfo)
+		info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+		info.Spec_dst = local.As4()
+		return oob
+	}
+	oob, data := appendControlMessage(oob, unix.SOL_IPV6, unix.IPV6_PKTINFO, unix.SizeofInet6Pktinfo)
+	info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+	info.Addr = local.As16()
+	return oob
+}
@@ -0,0 +1,309 @@
+//go:build linux
+
+package mwgp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLinuxUDPBatcher_SplitSegments(t *testing.T) {
+	source := netip.MustParseAddrPort("192.0.2.1:51820")
+	b := &linuxUDPBatcher{groSegments: 1}
+
+	// 2 datagrams read into 4 packets: [0 1 2] coalesced with segment size 2, then [3 4 5 6 7] with size 1,
+	// so 2 segments of the second one do not fit.
+	packets := newTestPackets(4, 0, netip.AddrPort{})
+	datagrams := []struct {
+		data []byte
+		size int
+	}{
+		{data: []byte{0, 0, 1, 1, 2}, size: 2},
+		{data: []byte{3, 4, 5, 6, 7}, size: 1},
+	}
+	for i, d := range datagrams {
+		packets[i].Length = copy(packets[i].Data, d.data)
+		packets[i].Source = source
+	}
+	n := b.splitSegments(packets, len(datagrams), func(i int) int {
+		return datagrams[i].size
+	})
+	if n != 4 {
+		t.Fatalf("expected 4 packets, got %d", n)
+	}
+	expected := [][]byte{{0, 0}, {1, 1}, {2}, {3}}
+	for i, e := range expected {
+		if string(packets[i].Slice()) != string(e) || packets[i].Source != source {
+			t.Errorf("packet %d: expected %v from %s, got %v from %s", i, e, source, packets[i].Slice(), packets[i].Source)
+		}
+	}
+	if b.groSegments != 5 {
+		t.Errorf("expected groSegments 5, got %d", b.groSegments)
+	}
+
+	// the pending segments are returned first, in order
+	packets = newTestPackets(2, 0, netip.AddrPort{})
+	n, err := b.readPackets(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || packets[0].Slice()[0] != 4 || packets[1].Slice()[0] != 5 {
+		t.Errorf("unexpected pending segments %d: %v %v", n, packets[0].Slice(), packets[1].Slice())
+	}
+	n, err = b.readPackets(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || packets[0].Slice()[0] != 6 || packets[1].Slice()[0] != 7 || packets[1].Source != source {
+		t.Errorf("unexpected pending segments %d: %v %v", n, packets[0].Slice(), packets[1].Slice())
+	}
+	if len(b.pendingSegments) != 0 || len(b.pendingData) != 0 {
+		t.Errorf("pending segments are not drained")
+	}
+}
+
+func TestPacketConnTransport_Segments(t *testing.T) {
+	sender, receiver, receiverAddr := listenLoopbackTransportPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// UDP GRO is enabled by the first read, which times out immediately
+	_ = receiver.conn.SetReadDeadline(time.Now())
+	_, err := receiver.ReadPackets(newTestPackets(8, 0, netip.AddrPort{}))
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+
+	// same size packets to the same destination are sent with UDP GSO,
+	// and received with UDP GRO if the kernel supports them.
+	const count = 40
+	sent := newTestPackets(count, 1200, receiverAddr)
+	sent[count-1].Length = 100
+	err = sender.WritePackets(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = receiver.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	senderPort := uint16(sender.LocalAddr().(*net.UDPAddr).Port)
+	for total := 0; total < count; {
+		received := newTestPackets(8, 0, netip.AddrPort{})
+		n, err := receiver.ReadPackets(received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range received[:n] {
+			expectedLength := 1200
+			if total == count-1 {
+				expectedLength = 100
+			}
+			if packet.Length != expectedLength || packet.Data[0] != byte(total) || packet.Source.Port() != senderPort {
+				t.Errorf("packet %d: unexpected length %d, order %d or source %s", total, packet.Length, packet.Data[0], packet.Source)
+			}
+			total++
+		}
+	}
+}
+
+func TestPacketConnTransport_SegmentsThenSingle(t *testing.T) {
+	sender, receiver, receiverAddr := listenLoopbackTransportPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// the segmented sends are followed by the single ones on the same socket,
+	// which must not be segmented by the UDP_SEGMENT of the former.
+	var lengths []int
+	for _, batch := range [][]int{{1200, 1200, 900, 900, 600, 600}, {100}, {1000, 1100, 1200}} {
+		packets := newTestPackets(len(batch), 0, receiverAddr)
+		for i, length := range batch {
+			packets[i].Length = length
+		}
+		err := sender.WritePackets(packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, batch...)
+	}
+
+	_ = receiver.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for total := 0; total < len(lengths); {
+		received := newTestPackets(8, 0, netip.AddrPort{})
+		n, err := receiver.ReadPackets(received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range received[:n] {
+			if total < len(lengths) && packet.Length != lengths[total] {
+				t.Errorf("packet %d: expected length %d, got %d", total, lengths[total], packet.Length)
+			}
+			total++
+		}
+	}
+}
+
+func TestListenUDPTransports(t *testing.T) {
+	transports, err := ListenUDPTransports(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, transport := range transports {
+			_ = transport.Close()
+		}
+	}()
+	if len(transports) != 4 {
+		t.Fatalf("expected 4 transports, got %d", len(transports))
+	}
+	port := transports[0].LocalAddr().(*net.UDPAddr).Port
+	for _, transport := range transports[1:] {
+		if transport.LocalAddr().(*net.UDPAddr).Port != port {
+			t.Errorf("expected port %d, got %s", port, transport.LocalAddr())
+		}
+	}
+}
+
+// TestListenTransparentUDPTransport requires CAP_NET_ADMIN and the routes for the replies,
+// which can be set up in a network namespace on loopback:
+//
+//	unshare -n sh -c 'ip link set lo up &&
+//	  ip rule add to 192.0.2.0/24 lookup 100 &&
+//	  ip route add local 0.0.0.0/0 dev lo table 100 &&
+//	  MWGP_TEST_TRANSPARENT=1 go test -run TestListenTransparentUDPTransport .'
+func TestListenTransparentUDPTransport(t *testing.T) {
+	if os.Getenv("MWGP_TEST_TRANSPARENT") == "" {
+		t.Skip("MWGP_TEST_TRANSPARENT is not set")
+	}
+
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	transparent, err := ListenTransparentUDPTransport(net.UDPAddrFromAddrPort(clientAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transparent.Close()
+	server, err := ListenUDPTransport(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	serverAddr := addrPortFromUDPAddr(server.LocalAddr().(*net.UDPAddr))
+	_ = transparent.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_ = server.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the server sees the address of the client
+	packet := newTestPackets(1, 100, serverAddr)[0]
+	err = transparent.WritePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.ReadPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Source != clientAddr {
+		t.Fatalf("expected source %s, got %s", clientAddr, packet.Source)
+	}
+
+	// and its replies to the client are received by the transparent socket
+	packet.Destination = packet.Source
+	err = server.WritePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transparent.ReadPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Source != serverAddr {
+		t.Fatalf("expected source %s, got %s", serverAddr, packet.Source)
+	}
+}
+
+func TestListenUDPTransportWithOptions(t *testing.T) {
+	options := &SocketOptions{
+		DSCP:          46,
+		ReceiveBuffer: 1 << 20,
+		SendBuffer:    1 << 20,
+	}
+	err := options.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := ListenUDPTransportWithOptions(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	rawConn, err := transport.udpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos, rcvbuf int
+	_ = rawConn.Control(func(fd uintptr) {
+		tos, _ = unix.GetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TOS)
+		rcvbuf, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if tos != 46<<2 {
+		t.Errorf("expected tos %d, got %d", 46<<2, tos)
+	}
+	// the kernel doubles the size for the bookkeeping, and limits it by the sysctl without CAP_NET_ADMIN
+	if os.Geteuid() == 0 && rcvbuf < 1<<20 {
+		t.Errorf("expected receive buffer at least %d, got %d", 1<<20, rcvbuf)
+	}
+
+	options.DSCP = 64
+	if options.Validate() == nil {
+		t.Errorf("expected invalid dscp")
+	}
+}
+
+func TestPacketConnTransport_PacketInfo(t *testing.T) {
+	wildcard, err := ListenUDPTransport(&net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+	client, err := ListenUDPTransport(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = wildcard.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_ = client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	port := uint16(wildcard.LocalAddr().(*net.UDPAddr).Port)
+	for _, local := range []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")} {
+		// the local address the client sent to is recorded
+		err = client.WritePackets(newTestPackets(1, 100, netip.AddrPortFrom(local, port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets := newTestPackets(1, 0, netip.AddrPort{})
+		_, err = wildcard.ReadPackets(packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packets[0].Local != local {
+			t.Fatalf("expected local address %s, got %s", local, packets[0].Local)
+		}
+
+		// and the reply leaves from it
+		packets[0].Destination = packets[0].Source
+		err = wildcard.WritePacket(packets[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := newTestPackets(1, 0, netip.AddrPort{})[0]
+		err = client.ReadPacket(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Source != netip.AddrPortFrom(local, port) {
+			t.Errorf("expected reply from %s, got %s", netip.AddrPortFrom(local, port), reply.Source)
+		}
+	}
+}
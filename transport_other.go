@@ -0,0 +1,31 @@
+//go:build !linux
+
+package mwgp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// newUDPBatcher returns nil since batch I/O is not supported on this platform,
+// PacketConnTransport reads and writes packets one by one instead.
+func newUDPBatcher(conn *net.UDPConn) udpBatcher {
+	return nil
+}
+
+// the packets are not distributed among the sockets sharing a port on other platforms,
+// such as FreeBSD which requires SO_REUSEPORT_LB instead.
+const reusePortSupported = false
+
+var reusePortControl func(network, address string, c syscall.RawConn) error
+
+const transparentSupported = false
+
+var transparentControl func(network, address string, c syscall.RawConn) error
+
+const socketOptionsSupported = false
+
+func setSocketOptions(fd uintptr, o *SocketOptions) error {
+	return errors.New("socket options are not supported on this platform")
+}
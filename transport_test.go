@@ -0,0 +1,137 @@
+package mwgp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	_ BatchTransport = (*PacketConnTransport)(nil)
+	_ BatchTransport = (*obfuscatedTransport)(nil)
+	_ BatchTransport = (*upstreamTransport)(nil)
+	_ BatchTransport = (*strictClientTransport)(nil)
+	_ BatchTransport = (*clientUpstreamTransport)(nil)
+)
+
+func listenLoopbackTransportPair(t testing.TB) (sender, receiver *PacketConnTransport, receiverAddr netip.AddrPort) {
+	// the sender listens on the wildcard address to cover the dual-stack socket
+	sender, err := ListenUDPTransport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = ListenUDPTransport(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		sender.Close()
+		t.Fatal(err)
+	}
+	receiverAddr = addrPortFromUDPAddr(receiver.LocalAddr().(*net.UDPAddr))
+	return
+}
+
+func newTestPackets(count int, size int, destination netip.AddrPort) (packets []*Packet) {
+	packets = make([]*Packet, count)
+	for i := range packets {
+		packets[i] = &Packet{
+			Data:        make([]byte, defaultMaxPacketSize),
+			Length:      size,
+			Destination: destination,
+		}
+		packets[i].Data[0] = byte(i)
+	}
+	return
+}
+
+func TestPacketConnTransport_Batch(t *testing.T) {
+	sender, receiver, receiverAddr := listenLoopbackTransportPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	const count = 16
+	err := sender.WritePackets(newTestPackets(count, 100, receiverAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = receiver.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := newTestPackets(count, 0, netip.AddrPort{})
+	for total := 0; total < count; {
+		n, err := receiver.ReadPackets(received[total:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range received[total : total+n] {
+			if packet.Length != 100 {
+				t.Errorf("unexpected packet length %d", packet.Length)
+			}
+			if packet.Source.Port() != uint16(sender.LocalAddr().(*net.UDPAddr).Port) || !packet.Source.Addr().Is4() {
+				t.Errorf("unexpected packet source %s", packet.Source)
+			}
+		}
+		total += n
+	}
+	for i, packet := range received {
+		if packet.Data[0] != byte(i) {
+			t.Errorf("packet %d: unexpected order %d", i, packet.Data[0])
+		}
+	}
+}
+
+func benchmarkPacketConnTransport(b *testing.B, batch bool) {
+	sender, receiver, receiverAddr := listenLoopbackTransportPair(b)
+	defer sender.Close()
+	defer receiver.Close()
+	if !batch {
+		sender.batch = nil
+		receiver.batch = nil
+	}
+
+	const packetSize = 1400
+	sent := newTestPackets(kPacketBatchSize, packetSize, receiverAddr)
+	received := newTestPackets(kPacketBatchSize, 0, netip.AddrPort{})
+
+	b.SetBytes(packetSize * kPacketBatchSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// lockstep so that no packet is dropped by the socket buffer
+		err := sender.WritePackets(sent)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for total := 0; total < len(received); {
+			n, err := receiver.ReadPackets(received[total:])
+			if err != nil {
+				b.Fatal(err)
+			}
+			total += n
+		}
+	}
+}
+
+func BenchmarkPacketConnTransport_Single(b *testing.B) {
+	benchmarkPacketConnTransport(b, false)
+}
+
+func BenchmarkPacketConnTransport_Batch(b *testing.B) {
+	benchmarkPacketConnTransport(b, true)
+}
+
+func TestListenUDPTransport_DualStack(t *testing.T) {
+	v4, err := ListenUDPTransport(&net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.Close()
+
+	// the IPv4 and IPv6 wildcard addresses can be listened on the same port separately
+	port := v4.LocalAddr().(*net.UDPAddr).Port
+	v6, err := ListenUDPTransport(&net.UDPAddr{IP: net.IPv6unspecified, Port: port})
+	if err != nil {
+		if _, lerr := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); lerr != nil {
+			t.Skip("IPv6 is not available")
+		}
+		t.Fatal(err)
+	}
+	defer v6.Close()
+}
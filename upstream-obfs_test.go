@@ -0,0 +1,121 @@
+package mwgp
+
+import (
+	"bytes"
+	_ "embed"
+	"github.com/flynn/json5"
+	"golang.zx2c4.com/wireguard/device"
+	"net/netip"
+	"testing"
+)
+
+//go:embed server-upstream-obfs.test.json
+var upstreamObfuscateServerConfig []byte
+
+func TestServer_UpstreamObfuscate(t *testing.T) {
+	var c ServerConfig
+	err := json5.Unmarshal(upstreamObfuscateServerConfig, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range c.Servers {
+		err = server.Initialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []struct {
+		peer    *ServerConfigPeer
+		key     string
+		mimicry string
+	}{
+		{c.Servers[0].Peers[0], "upstream password", ObfuscateMimicryQUIC},
+		{c.Servers[0].Peers[1], "another password", ObfuscateMimicryDTLS},
+		{c.Servers[1].Peers[0], "", ""},
+	} {
+		if p.peer.UpstreamObfuscateKey != p.key || p.peer.UpstreamObfuscateMimicry != p.mimicry {
+			t.Errorf("peer %s: unexpected upstream_obfs %q and mimicry %q", p.peer.ForwardTo, p.peer.UpstreamObfuscateKey, p.peer.UpstreamObfuscateMimicry)
+		}
+	}
+
+	s := &Server{servers: c.Servers}
+	err = s.initializeUpstreamObfuscators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainedAddr := netip.MustParseAddrPort("192.0.2.1:1000")
+	plainAddr := netip.MustParseAddrPort("192.0.2.3:1001")
+	if len(s.upstreamObfuscators) != 2 || s.upstreamObfuscators[chainedAddr] == nil {
+		t.Fatalf("unexpected upstream obfuscators %v", s.upstreamObfuscators)
+	}
+
+	// the chained mwgp-server shares the upstream_obfs as its obfs
+	var chained WireGuardObfuscator
+	chained.Initialize("upstream password")
+	_ = chained.SetMimicry(ObfuscateMimicryQUIC)
+
+	raw := newTestTransport()
+	defer raw.Close()
+	transport := s.wrapServerTransport(raw)
+	newPacket := func(destination netip.AddrPort) *Packet {
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize), Length: 128, Destination: destination}
+		p.Data[0] = device.MessageTransportType
+		p.Data[4] = 0x42
+		return p
+	}
+	origin := append([]byte(nil), newPacket(chainedAddr).Slice()...)
+
+	err = transport.WritePacket(newPacket(plainAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.expect(t, origin, plainAddr)
+
+	err = transport.WritePacket(newPacket(chainedAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := <-raw.writeChan
+	received := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+	received.Length = copy(received.Data, d.data)
+	chained.Deobfuscate(received)
+	if d.addr != chainedAddr || bytes.Equal(d.data, origin) || !bytes.Equal(received.Slice(), origin) {
+		t.Errorf("the packet to the chained mwgp-server is not obfuscated with upstream_obfs")
+	}
+
+	// the replies of the chained mwgp-server are deobfuscated,
+	// including the ones from another port allowed by ssvl
+	for _, source := range []netip.AddrPort{chainedAddr, netip.MustParseAddrPort("192.0.2.1:2000")} {
+		reply := newPacket(chainedAddr)
+		reply.Flags |= PacketFlagObfuscateBeforeSend
+		chained.Obfuscate(reply)
+		raw.readChan <- testDatagram{data: reply.Slice(), addr: source}
+		p := &Packet{Data: make([]byte, defaultMaxPacketSize)}
+		err = transport.ReadPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Slice(), origin) {
+			t.Errorf("the reply of the chained mwgp-server from %s is not deobfuscated", source)
+		}
+	}
+
+	// the replies from any source cannot be deobfuscated
+	c.Servers[0].Peers[0].ServerSourceValidateLevel = SourceValidateLevelNone
+	err = s.initializeUpstreamObfuscators()
+	if err == nil {
+		t.Error("expected upstream_obfs to be refused with ssvl 1")
+	}
+	c.Servers[0].Peers[0].ServerSourceValidateLevel = SourceValidateLevelDefault
+
+	// the peers forwarded to the same address must agree on upstream_obfs
+	c.Servers[1].Peers = append(c.Servers[1].Peers, &ServerConfigPeer{ForwardTo: "192.0.2.1:1000"})
+	err = c.Servers[1].Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.initializeUpstreamObfuscators()
+	if err == nil {
+		t.Error("expected conflicting upstream_obfs")
+	}
+}
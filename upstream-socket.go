@@ -0,0 +1,245 @@
+package mwgp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Dedicated upstream sockets make the servers see every client (or every handshake session)
+// from its own source address, instead of all of them from the shared socket of mwgp-server.
+
+const (
+	// UpstreamSocketShared shares the socket of the worker between all the peers,
+	// or the socket of the upstream_bind address between the peers of the server.
+	UpstreamSocketShared = ""
+
+	// UpstreamSocketPeer allocates a socket for every peer, which is created by a handshake.
+	// the source port changes on every handshake, so it is better to use UpstreamSocketPublicKey.
+	UpstreamSocketPeer = "peer"
+
+	// UpstreamSocketPublicKey allocates a socket for every client public key,
+	// it is shared by the peers of the client and closed after the last one expires.
+	UpstreamSocketPublicKey = "pubkey"
+
+	// UpstreamSocketTransparent allocates a socket bound to the address of every client with IP_TRANSPARENT,
+	// so the servers see the real addresses of the clients. Linux only, see README for the TPROXY setup.
+	UpstreamSocketTransparent = "transparent"
+)
+
+// upstreamSocketAllocator is the ServerTransportAllocator of mwgp-server.
+type upstreamSocketAllocator struct {
+	mode string
+
+	// the local port range, or 0 for the ephemeral ports
+	portStart int
+	portEnd   int
+
+	// the local address of the sockets (upstream_listen), or nil for the wildcard address
+	defaultBind *net.UDPAddr
+	// forward_to address -> the local address of the sockets to it (upstream_bind)
+	binds map[netip.AddrPort]*net.UDPAddr
+
+	// listens on addr and wraps the transport, such as with upstream_obfs
+	listen func(addr *net.UDPAddr, transparent bool) (transport Transport, err error)
+
+	lock        sync.Mutex
+	nextPort    int
+	sockets     map[interface{}]*upstreamSocket // shared sockets only
+	byTransport map[Transport]*upstreamSocket
+}
+
+type upstreamSocket struct {
+	// nil if the socket is not shared
+	key       interface{}
+	transport Transport
+	refs      int
+}
+
+// upstreamBindKey is the key of the socket shared by the peers forwarded from the same upstream_bind address.
+type upstreamBindKey string
+
+// upstreamPublicKeyKey is the key of the socket shared by the peers of a client public key.
+type upstreamPublicKeyKey struct {
+	publicKey NoisePublicKey
+	bind      string
+}
+
+func newUpstreamSocketAllocator(mode string, portRange string, defaultBind *net.UDPAddr, binds map[netip.AddrPort]*net.UDPAddr,
+	listen func(addr *net.UDPAddr, transparent bool) (Transport, error)) (a *upstreamSocketAllocator, err error) {
+	a = &upstreamSocketAllocator{
+		mode:        mode,
+		defaultBind: defaultBind,
+		binds:       binds,
+		listen:      listen,
+		sockets:     make(map[interface{}]*upstreamSocket),
+		byTransport: make(map[Transport]*upstreamSocket),
+	}
+	switch mode {
+	case UpstreamSocketShared:
+		if len(binds) == 0 {
+			err = errors.New("shared upstream socket requires upstream_bind")
+			return
+		}
+		if portRange != "" {
+			err = errors.New("shared upstream socket uses the port of upstream_bind, port range is not allowed")
+			return
+		}
+	case UpstreamSocketPeer, UpstreamSocketPublicKey:
+		if defaultBind != nil && defaultBind.Port != 0 {
+			err = errors.New("dedicated upstream sockets cannot share the port of upstream_listen, use upstream_port_range instead")
+			return
+		}
+		for _, bind := range binds {
+			if bind.Port != 0 {
+				err = errors.New("dedicated upstream sockets cannot share the port of upstream_bind, use upstream_port_range instead")
+				return
+			}
+		}
+	case UpstreamSocketTransparent:
+		if !transparentSupported {
+			err = errors.New("transparent upstream socket is not supported on this platform")
+			return
+		}
+		if portRange != "" {
+			err = errors.New("transparent upstream socket uses the ports of clients, port range is not allowed")
+			return
+		}
+		if defaultBind != nil || len(binds) != 0 {
+			err = errors.New("transparent upstream socket uses the addresses of clients, upstream_listen and upstream_bind are not allowed")
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown upstream socket mode %s", mode)
+		return
+	}
+	if portRange != "" {
+		a.portStart, a.portEnd, err = parsePortRange(portRange)
+		if err != nil {
+			return
+		}
+		if a.portStart == 0 {
+			err = fmt.Errorf("invalid port range %s", portRange)
+			return
+		}
+		a.nextPort = rand.Intn(a.portEnd - a.portStart + 1)
+	}
+	return
+}
+
+// bindOf returns the local address of the socket to the server, or nil for the wildcard address.
+func (a *upstreamSocketAllocator) bindOf(serverDestination netip.AddrPort) *net.UDPAddr {
+	if bind, ok := a.binds[serverDestination]; ok {
+		return bind
+	}
+	return a.defaultBind
+}
+
+// keyOf returns the key of the socket shared by the peers, or nil if it is not shared.
+func (a *upstreamSocketAllocator) keyOf(request ServerTransportRequest, bind *net.UDPAddr) interface{} {
+	switch a.mode {
+	case UpstreamSocketShared:
+		return upstreamBindKey(bind.String())
+	case UpstreamSocketPublicKey:
+		key := upstreamPublicKeyKey{
+			publicKey: request.ClientPublicKey,
+		}
+		if bind != nil {
+			key.bind = bind.String()
+		}
+		return key
+	case UpstreamSocketTransparent:
+		// the peers of a client from the same address cannot bind the address twice
+		return request.ClientSource
+	}
+	return nil
+}
+
+func (a *upstreamSocketAllocator) Acquire(request ServerTransportRequest) (transport Transport, fresh bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	bind := a.bindOf(request.ServerDestination)
+	if a.mode == UpstreamSocketShared {
+		if _, ok := a.binds[request.ServerDestination]; !ok {
+			// the socket of the worker
+			return
+		}
+	}
+	key := a.keyOf(request, bind)
+	if key != nil {
+		if socket, ok := a.sockets[key]; ok {
+			socket.refs++
+			transport = socket.transport
+			return
+		}
+	}
+	if a.mode == UpstreamSocketTransparent {
+		if request.ClientSource.Addr().Is4() != request.ServerDestination.Addr().Is4() {
+			err = fmt.Errorf("cannot forward client %s to server %s transparently with different IP versions",
+				request.ClientSource.String(), request.ServerDestination.String())
+			return
+		}
+		transport, err = a.listen(net.UDPAddrFromAddrPort(request.ClientSource), true)
+	} else {
+		transport, err = a.listenLocked(bind)
+	}
+	if err != nil {
+		return
+	}
+	fresh = true
+	socket := &upstreamSocket{
+		key:       key,
+		transport: transport,
+		refs:      1,
+	}
+	if key != nil {
+		a.sockets[key] = socket
+	}
+	a.byTransport[transport] = socket
+	return
+}
+
+// listenLocked listens on bind, with the next available port in the range if the port of bind is not specified.
+func (a *upstreamSocketAllocator) listenLocked(bind *net.UDPAddr) (transport Transport, err error) {
+	if a.portStart == 0 || (bind != nil && bind.Port != 0) {
+		return a.listen(bind, false)
+	}
+	ports := a.portEnd - a.portStart + 1
+	for i := 0; i < ports; i++ {
+		addr := &net.UDPAddr{}
+		if bind != nil {
+			*addr = *bind
+		}
+		addr.Port = a.portStart + a.nextPort
+		a.nextPort = (a.nextPort + 1) % ports
+		transport, err = a.listen(addr, false)
+		if err == nil {
+			return
+		}
+	}
+	err = errors.New("no available port in the upstream port range")
+	return
+}
+
+func (a *upstreamSocketAllocator) Release(transport Transport) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	socket, ok := a.byTransport[transport]
+	if !ok {
+		return
+	}
+	socket.refs--
+	if socket.refs > 0 {
+		return
+	}
+	delete(a.byTransport, transport)
+	if socket.key != nil {
+		delete(a.sockets, socket.key)
+	}
+	_ = transport.Close()
+}
@@ -0,0 +1,164 @@
+package mwgp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestUpstreamSocketAllocator(t *testing.T) {
+	var listened []int
+	listen := func(addr *net.UDPAddr, transparent bool) (Transport, error) {
+		if addr != nil {
+			listened = append(listened, addr.Port)
+		}
+		return newTestTransport(), nil
+	}
+
+	var alice, bob NoisePublicKey
+	alice.NoisePublicKey[0] = 1
+	bob.NoisePublicKey[0] = 2
+
+	a, err := newUpstreamSocketAllocator(UpstreamSocketPublicKey, "30000-30001", nil, nil, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, fresh, err := a.Acquire(ServerTransportRequest{ClientPublicKey: alice})
+	if err != nil || !fresh {
+		t.Fatalf("expected a fresh transport, got %v %v", fresh, err)
+	}
+	t2, fresh, err := a.Acquire(ServerTransportRequest{ClientPublicKey: alice})
+	if err != nil || fresh || t2 != t1 {
+		t.Fatalf("expected the shared transport of the public key, got %v %v", fresh, err)
+	}
+	t3, fresh, err := a.Acquire(ServerTransportRequest{ClientPublicKey: bob})
+	if err != nil || !fresh || t3 == t1 {
+		t.Fatalf("expected a fresh transport for another public key, got %v %v", fresh, err)
+	}
+	if len(listened) != 2 || listened[0] == listened[1] {
+		t.Errorf("expected 2 different ports in the range, got %v", listened)
+	}
+
+	closed := func(transport Transport) bool {
+		select {
+		case <-transport.(*testTransport).closeChan:
+			return true
+		default:
+			return false
+		}
+	}
+	a.Release(t1)
+	if closed(t1) {
+		t.Errorf("transport closed while still used by a peer")
+	}
+	a.Release(t2)
+	if !closed(t1) {
+		t.Errorf("transport not closed after all the peers released")
+	}
+
+	a, err = newUpstreamSocketAllocator(UpstreamSocketPeer, "", nil, nil, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, _, _ = a.Acquire(ServerTransportRequest{ClientPublicKey: alice})
+	t2, fresh, _ = a.Acquire(ServerTransportRequest{ClientPublicKey: alice})
+	if !fresh || t1 == t2 {
+		t.Errorf("expected a transport for every peer")
+	}
+	a.Release(t1)
+	if !closed(t1) || closed(t2) {
+		t.Errorf("expected only the released transport closed")
+	}
+
+	if transparentSupported {
+		var transparentAddrs []*net.UDPAddr
+		a, err = newUpstreamSocketAllocator(UpstreamSocketTransparent, "", nil, nil, func(addr *net.UDPAddr, transparent bool) (Transport, error) {
+			if !transparent {
+				t.Errorf("expected a transparent socket")
+			}
+			transparentAddrs = append(transparentAddrs, addr)
+			return newTestTransport(), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := ServerTransportRequest{
+			ClientPublicKey:   alice,
+			ClientSource:      netip.MustParseAddrPort("192.0.2.1:51820"),
+			ServerDestination: netip.MustParseAddrPort("198.51.100.1:51820"),
+		}
+		t1, _, _ = a.Acquire(request)
+		// the next handshake from the same address shares the socket
+		t2, fresh, _ = a.Acquire(request)
+		if fresh || t1 != t2 {
+			t.Errorf("expected the shared transport of the client address")
+		}
+		if len(transparentAddrs) != 1 || transparentAddrs[0].String() != "192.0.2.1:51820" {
+			t.Errorf("unexpected bound addresses %v", transparentAddrs)
+		}
+		request.ServerDestination = netip.MustParseAddrPort("[2001:db8::1]:51820")
+		request.ClientSource = netip.MustParseAddrPort("192.0.2.2:51820")
+		_, _, err = a.Acquire(request)
+		if err == nil {
+			t.Errorf("expected error for different IP versions")
+		}
+	}
+
+	_, err = newUpstreamSocketAllocator("unknown", "", nil, nil, listen)
+	if err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
+
+func TestUpstreamSocketAllocator_Bind(t *testing.T) {
+	var listened []string
+	listen := func(addr *net.UDPAddr, transparent bool) (Transport, error) {
+		listened = append(listened, addr.String())
+		return newTestTransport(), nil
+	}
+
+	bound := netip.MustParseAddrPort("192.0.2.2:51820")
+	unbound := netip.MustParseAddrPort("192.0.2.3:51820")
+	binds := map[netip.AddrPort]*net.UDPAddr{
+		bound: {IP: net.IPv4(198, 51, 100, 1), Port: 51000},
+	}
+
+	// the peers forwarded to the same upstream_bind share its socket
+	a, err := newUpstreamSocketAllocator(UpstreamSocketShared, "", nil, binds, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, fresh, err := a.Acquire(ServerTransportRequest{ServerDestination: bound})
+	if err != nil || !fresh {
+		t.Fatalf("expected a fresh transport, got %v %v", fresh, err)
+	}
+	t2, fresh, err := a.Acquire(ServerTransportRequest{ServerDestination: bound})
+	if err != nil || fresh || t2 != t1 {
+		t.Fatalf("expected the shared transport of upstream_bind, got %v %v", fresh, err)
+	}
+	t3, _, err := a.Acquire(ServerTransportRequest{ServerDestination: unbound})
+	if err != nil || t3 != nil {
+		t.Fatalf("expected the transport of the worker, got %v %v", t3, err)
+	}
+	if len(listened) != 1 || listened[0] != "198.51.100.1:51000" {
+		t.Errorf("unexpected bound addresses %v", listened)
+	}
+
+	// the dedicated sockets are bound to the address of upstream_bind or upstream_listen
+	listened = nil
+	binds[bound] = &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1)}
+	a, err = newUpstreamSocketAllocator(UpstreamSocketPeer, "30000", &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2)}, binds, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _ = a.Acquire(ServerTransportRequest{ServerDestination: bound})
+	_, _, _ = a.Acquire(ServerTransportRequest{ServerDestination: unbound})
+	if len(listened) != 2 || listened[0] != "198.51.100.1:30000" || listened[1] != "198.51.100.2:30000" {
+		t.Errorf("unexpected bound addresses %v", listened)
+	}
+
+	_, err = newUpstreamSocketAllocator(UpstreamSocketPublicKey, "", &net.UDPAddr{Port: 51000}, nil, listen)
+	if err == nil {
+		t.Errorf("expected error for the port of upstream_listen")
+	}
+}
@@ -2,18 +2,29 @@ package mwgp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"golang.zx2c4.com/wireguard/device"
 	"log"
 	"math/rand"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	kReplaceServerTransportGracePeriod = 10 * time.Second
+)
+
 type Peer struct {
+	// unix nano, accessed atomically.
+	// it is the first field for the 64-bit alignment on 32-bit platforms.
+	lastActive int64
+
 	// the index the client told us whom CLIENT is
 	// in MessageInitiation.Sender (client -> us, register)
 	// in MessageResponse.Receiver (us -> client, translate)
@@ -48,54 +59,156 @@ type Peer struct {
 	serverCookieGenerator device.CookieGenerator
 	serverPublicKey       NoisePublicKey
 
-	clientDestination *net.UDPAddr
-	serverDestination *net.UDPAddr
-	lastActive        atomic.Value // time.Time
+	clientDestination netip.AddrPort
+	serverDestination netip.AddrPort
+
+	// the transport that the client sent packets to, packets to the client are sent through it,
+	// so the replies leave from the local address the client sent to.
+	// nil means the first one of ClientTransports.
+	clientTransport Transport
+
+	// the local address the client sent packets to, packets to the client are sent from it.
+	// invalid means the one chosen by the kernel, such as clientTransport does not listen on a wildcard address.
+	clientLocal netip.Addr
+
+	// the local address of clientTransport loaded from the cache, resolved into clientTransport by Serve()
+	cachedClientLocal string
+
+	// protects clientDestination, clientTransport and clientLocal, which are updated on client roaming
+	// while the packets to the client are handled by another worker,
+	// and serverDestination, which is updated by the DNS update or port hopping of mwgp-client.
+	endpointLock sync.RWMutex
+
+	// the dedicated transport to the server allocated by ServerTransportAllocator,
+	// nil means the one of the worker which handles the packets.
+	serverTransport Transport
 
 	clientSourceValidateLevel int
 	serverSourceValidateLevel int
 
 	obfuscateEnabled bool
+
+	// the bandwidth and quota of the client public key, nil if unlimited
+	traffic *trafficAccount
+
+	// the allowed sources of the client besides ClientSourceFilter, nil if unlimited
+	sourceFilter *SourceFilter
+
+	// the peer is expired once the access window closes, nil if unlimited
+	access *AccessWindow
 }
 
 func (p *Peer) IsServerReplied() bool {
 	return p.serverProxyIndex != 0
 }
 
+func (p *Peer) touch(now time.Time) {
+	atomic.StoreInt64(&p.lastActive, now.UnixNano())
+}
+
+func (p *Peer) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActive))
+}
+
+func (p *Peer) currentClientDestination() (destination netip.AddrPort) {
+	p.endpointLock.RLock()
+	destination = p.clientDestination
+	p.endpointLock.RUnlock()
+	return
+}
+
+func (p *Peer) currentServerDestination() (destination netip.AddrPort) {
+	p.endpointLock.RLock()
+	destination = p.serverDestination
+	p.endpointLock.RUnlock()
+	return
+}
+
+// expireCheckTime returns the time to check whether the peer is expired,
+// which is the deadline of the activity, or the close of the access window if it is earlier.
+func (p *Peer) expireCheckTime(timeout time.Duration, now time.Time) (check time.Time) {
+	check = p.lastActiveTime().Add(timeout)
+	if closes := p.access.closesAt(now); !closes.IsZero() && closes.Before(check) {
+		check = closes
+	}
+	return
+}
+
 type WireGuardIndexTranslationTable struct {
 	// client <-> us
-	clientConn            *net.UDPConn
-	ClientListen          *net.UDPAddr
-	ClientReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	ClientWriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
-	clientReadChan        chan *Packet
-	clientWriteChan       chan *Packet
+	// ClientTransports are the transports to clients, at least one is required.
+	// clients can switch between them, packets to a client are sent through the one it sent to.
+	//
+	// ClientTransports[i] is handled by the worker i % len(ServerTransports).
+	// more can be added by AddClientTransport(), even after Serve().
+	ClientTransports []Transport
+
+	// protects ClientTransports after Serve()
+	clientTransportsLock sync.Mutex
+	// the first one of ClientTransports
+	defaultClientTransport Transport
 
 	// us <-> server
-	serverConn            *net.UDPConn
-	ServerListen          *net.UDPAddr
-	ServerReadFromUDPFunc func(conn *net.UDPConn, packet *Packet) (err error)
-	ServerWriteToUDPFunc  func(conn *net.UDPConn, packet *Packet) (err error)
-	serverReadChan        chan *Packet
-	serverWriteChan       chan *Packet
+	// ServerTransports are the transports to servers, one for each worker, at least one is required.
+	// the packets from a client are forwarded through the one of the worker which handled them.
+	//
+	// with a single worker, it can be replaced by ReplaceServerTransport().
+	ServerTransports []Transport
+
+	workers atomic.Value // []*wgitWorker
+
+	// ServerTransportAllocator allocates dedicated transports to servers for peers (optional),
+	// so servers can distinguish the clients by the source port.
+	ServerTransportAllocator ServerTransportAllocator
 
 	Timeout         time.Duration
-	ExtractPeerFunc func(msg *device.MessageInitiation) (fi *ServerConfigPeer, err error)
+	ExtractPeerFunc func(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error)
 	CacheJar        WGITCacheJar
 
+	// DecryptPeerFunc decrypts the public keys of the server and the client from the MessageInitiation
+	// into the request of ExtractPeerFunc (optional), the keys are zero without it.
+	DecryptPeerFunc func(msg *device.MessageInitiation) (serverPublicKey NoisePublicKey, clientPublicKey NoisePublicKey, err error)
+
+	// RestorePeerFunc returns the config of the peer loaded from CacheJar (optional),
+	// so its access window and source filter are enforced. the peer is dropped on error,
+	// or if the config forwards it to another server.
+	RestorePeerFunc func(request *PeerRequest) (fi *ServerConfigPeer, err error)
+
+	// PeerEventFunc is called with the endpoints of the peer on every peer create stage #2 (optional).
+	// it is called with the map locked, so it must not block.
+	PeerEventFunc func(event *PeerEvent)
+
+	// HandshakeLimiter limits the handshake packets from clients (optional).
+	HandshakeLimiter *HandshakeLimiter
+
+	// ClientSourceFilter drops the handshakes from the denied sources before ExtractPeerFunc (optional),
+	// and the roaming of clients to them.
+	// the filter of every peer is returned by ExtractPeerFunc.
+	ClientSourceFilter *SourceFilter
+
+	// TrafficLimiter limits the bandwidth and traffic of clients by the public key (optional).
+	// the limits are returned by ExtractPeerFunc.
+	TrafficLimiter *TrafficLimiter
+
 	// clientProxyIndex -> Peer
-	clientMap map[uint32]*Peer
+	clientMap *peerIndexMap
 
 	// serverProxyIndex -> Peer
-	serverMap map[uint32]*Peer
-
-	mapLock    sync.RWMutex
-	expireChan <-chan time.Time
-	packetPool sync.Pool
+	serverMap *peerIndexMap
+
+	// serializes the modifications of clientMap and serverMap,
+	// so the handshake state is consistent across workers. lookups do not need it.
+	mapLock     sync.Mutex
+	expireWheel *expireWheel // protected by mapLock
+	expireChan  <-chan time.Time
+	reportChan  <-chan time.Time // nil without HandshakeLimiter
+	usageChan   <-chan time.Time // nil without TrafficLimiter
+	packetPool  sync.Pool
+	batchPool   sync.Pool
 
 	// UpdateAllServerDestinationChan is used to set all server address for mwgp-client (in case of DNS update).
 	// this channel is not intended to be used by mwgp-server.
-	UpdateAllServerDestinationChan chan *net.UDPAddr
+	UpdateAllServerDestinationChan chan netip.AddrPort
 
 	// MaxPacketSize is the maximum size of a WireGuard packet.
 	//
@@ -107,142 +220,375 @@ type WireGuardIndexTranslationTable struct {
 	// If you are running mwgp on a server with limited memory, you can adjust this to
 	// reduce memory consumption.
 	MaxPacketSize uint
+
+	// BatchSize is the max number of packets read from a transport in a single call,
+	// if the transport supports batch I/O (such as recvmmsg(2) on Linux).
+	//
+	// Every read loop holds BatchSize packets with MaxPacketSize bytes,
+	// so reduce it if there are lots of transports.
+	BatchSize int
 }
 
-func defaultReadFromUDPFunc(conn *net.UDPConn, packet *Packet) (err error) {
-	packet.Length, packet.Source, err = conn.ReadFromUDP(packet.Data[:])
-	if err != nil {
-		return
-	}
-	return
+// ServerTransportAllocator allocates the dedicated transports to servers for peers.
+type ServerTransportAllocator interface {
+	// Acquire returns the transport for a new peer, or nil if the peer uses the transport of the worker,
+	// fresh is true if the transport is just created and should be read by the table.
+	Acquire(request ServerTransportRequest) (transport Transport, fresh bool, err error)
+
+	// Release releases the transport of an expired peer, it is closed once no peer uses it.
+	Release(transport Transport)
 }
 
-func defaultWriteToUDPFunc(conn *net.UDPConn, packet *Packet) (err error) {
-	_, err = conn.WriteToUDP(packet.Slice(), packet.Destination)
-	if err != nil {
-		return
+// ServerTransportRequest describes the new peer which requires a dedicated transport to the server.
+type ServerTransportRequest struct {
+	ClientPublicKey   NoisePublicKey
+	ClientSource      netip.AddrPort
+	ServerDestination netip.AddrPort
+}
+
+const (
+	// the dedicated transports are read with a small batch, since there are lots of them
+	kDedicatedServerTransportBatchSize = 1
+)
+
+// wgitWorker is a forwarding pipeline with its own goroutines and transport to servers.
+// the peers are shared between workers.
+type wgitWorker struct {
+	clientReadChan  chan *packetBatch
+	clientWriteChan chan *packetBatch
+
+	serverTransport atomic.Value // serverTransportHolder
+	serverReadChan  chan *packetBatch
+	serverWriteChan chan *packetBatch
+}
+
+func newWGITWorker(serverTransport Transport) (w *wgitWorker) {
+	w = &wgitWorker{
+		clientReadChan:  make(chan *packetBatch, 64),
+		clientWriteChan: make(chan *packetBatch, 64),
+		serverReadChan:  make(chan *packetBatch, 64),
+		serverWriteChan: make(chan *packetBatch, 64),
 	}
+	w.serverTransport.Store(serverTransportHolder{serverTransport})
 	return
 }
 
+// packetBatch is a batch of packets that move through the pipeline together.
+type packetBatch struct {
+	packets []*Packet
+}
+
+// serverTransportHolder wraps the transport to servers,
+// since atomic.Value requires all stored values to be the same concrete type.
+type serverTransportHolder struct {
+	transport Transport
+}
+
 func NewWireGuardIndexTranslationTable() (table *WireGuardIndexTranslationTable) {
 	table = &WireGuardIndexTranslationTable{
-		ClientReadFromUDPFunc:          defaultReadFromUDPFunc,
-		ServerReadFromUDPFunc:          defaultReadFromUDPFunc,
-		ClientWriteToUDPFunc:           defaultWriteToUDPFunc,
-		ServerWriteToUDPFunc:           defaultWriteToUDPFunc,
-		clientReadChan:                 make(chan *Packet, 64),
-		clientWriteChan:                make(chan *Packet, 64),
-		serverReadChan:                 make(chan *Packet, 64),
-		serverWriteChan:                make(chan *Packet, 64),
 		Timeout:                        60 * time.Second,
-		clientMap:                      make(map[uint32]*Peer),
-		serverMap:                      make(map[uint32]*Peer),
-		UpdateAllServerDestinationChan: make(chan *net.UDPAddr),
+		clientMap:                      newPeerIndexMap(),
+		serverMap:                      newPeerIndexMap(),
+		UpdateAllServerDestinationChan: make(chan netip.AddrPort),
 		MaxPacketSize:                  defaultMaxPacketSize,
+		BatchSize:                      kPacketBatchSize,
 	}
 	table.packetPool.New = func() interface{} {
 		return &Packet{
 			Data: make([]byte, table.MaxPacketSize),
 		}
 	}
+	table.batchPool.New = func() interface{} {
+		return &packetBatch{
+			packets: make([]*Packet, 0, kPacketBatchSize),
+		}
+	}
 	return
 }
 
 func (t *WireGuardIndexTranslationTable) Serve() (err error) {
+	t.mapLock.Lock()
+	t.expireWheel = newExpireWheel(t.Timeout, time.Now())
 	cerr := t.CacheJar.LoadLocked(t.serverMap, t.clientMap)
 	if cerr != nil {
 		log.Printf("[warn] forward table cache not loaded: %s\n", cerr.Error())
 	}
+	if t.RestorePeerFunc != nil {
+		t.restoreCachedPeersLocked()
+	}
+	now := time.Now()
+	t.clientMap.Range(func(index uint32, peer *Peer) bool {
+		t.expireWheel.Schedule(peer, peer.expireCheckTime(t.Timeout, now))
+		return true
+	})
+	t.expireChan = time.Tick(t.expireWheel.tick)
+	if t.HandshakeLimiter != nil {
+		t.reportChan = time.Tick(kHandshakeLimiterReportInterval)
+	}
+	if t.TrafficLimiter != nil {
+		t.usageChan = time.Tick(kTrafficUsageSaveInterval)
+		// the peers loaded from the cache, their limits are updated on the next handshake
+		t.clientMap.Range(func(index uint32, peer *Peer) bool {
+			peer.traffic = t.TrafficLimiter.lookup(peer.clientPublicKey)
+			return true
+		})
+	}
+	t.mapLock.Unlock()
 
-	t.clientConn, err = net.ListenUDP("udp", t.ClientListen)
-	if err != nil {
-		err = fmt.Errorf("failed to listen on client addr %s: %w", t.ClientListen, err)
+	if len(t.ClientTransports) == 0 {
+		err = fmt.Errorf("no client transport")
 		return
 	}
-	t.serverConn, err = net.ListenUDP("udp", t.ServerListen)
-	if err != nil {
-		err = fmt.Errorf("failed to listen on server addr %s: %w", t.ServerListen, err)
+	if len(t.ServerTransports) == 0 {
+		err = fmt.Errorf("no server transport")
 		return
 	}
-	t.expireChan = time.Tick(t.Timeout)
-	go t.writeLoop()
-	go t.serverReadLoop()
-	go t.clientReadLoop()
+	workers := make([]*wgitWorker, len(t.ServerTransports))
+	for i, serverTransport := range t.ServerTransports {
+		workers[i] = newWGITWorker(serverTransport)
+	}
+	t.workers.Store(workers)
+	if t.ServerTransportAllocator != nil {
+		// the peers loaded from the cache
+		t.clientMap.Range(func(index uint32, peer *Peer) bool {
+			aerr := t.acquireServerTransport(peer)
+			if aerr != nil {
+				log.Printf("[warn] failed to allocate transport to server for cached peer %s: %s\n", peer.currentClientDestination().String(), aerr.Error())
+			}
+			return true
+		})
+	}
+	t.clientTransportsLock.Lock()
+	t.defaultClientTransport = t.ClientTransports[0]
+	t.resolveCachedClientTransports()
+	for i, worker := range workers {
+		go t.writeLoop(worker)
+		go t.workerLoop(worker)
+		go t.serverReadLoop(t.ServerTransports[i], worker)
+	}
+	for i, clientTransport := range t.ClientTransports {
+		go t.clientReadLoop(clientTransport, workers[i%len(workers)])
+	}
+	t.clientTransportsLock.Unlock()
 	t.mainLoop()
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) clientReadLoop() {
+// AddClientTransport adds a transport to clients, such as a listener on a new address.
+// it can be called before or after Serve().
+func (t *WireGuardIndexTranslationTable) AddClientTransport(transport Transport) {
+	t.clientTransportsLock.Lock()
+	defer t.clientTransportsLock.Unlock()
+
+	t.ClientTransports = append(t.ClientTransports, transport)
+	workers, ok := t.workers.Load().([]*wgitWorker)
+	if !ok || t.defaultClientTransport == nil {
+		// it will be read by Serve()
+		return
+	}
+	go t.clientReadLoop(transport, workers[(len(t.ClientTransports)-1)%len(workers)])
+}
+
+// resolveCachedClientTransports sets the transports of the peers loaded from the cache by their local addresses,
+// so the replies to them still leave from the local addresses they sent to.
+func (t *WireGuardIndexTranslationTable) resolveCachedClientTransports() {
+	transports := make(map[string]Transport)
+	for _, transport := range t.ClientTransports {
+		if addr := transportLocalAddr(transport); addr != nil {
+			if _, ok := transports[addr.String()]; !ok {
+				transports[addr.String()] = transport
+			}
+		}
+	}
+	t.clientMap.Range(func(index uint32, peer *Peer) bool {
+		if peer.cachedClientLocal == "" {
+			return true
+		}
+		peer.endpointLock.Lock()
+		peer.clientTransport = transports[peer.cachedClientLocal]
+		peer.endpointLock.Unlock()
+		peer.cachedClientLocal = ""
+		return true
+	})
+}
+
+// ReplaceServerTransport replaces the transport to servers with a new one,
+// the old one will be closed after kReplaceServerTransportGracePeriod for the packets in flight.
+//
+// this is intended to be used by mwgp-client for source port hopping.
+func (t *WireGuardIndexTranslationTable) ReplaceServerTransport(transport Transport) (err error) {
+	workers, ok := t.workers.Load().([]*wgitWorker)
+	if !ok {
+		err = fmt.Errorf("not serving")
+		return
+	}
+	if len(workers) != 1 {
+		err = fmt.Errorf("not supported with %d workers", len(workers))
+		return
+	}
+	worker := workers[0]
+	old := worker.serverTransport.Load().(serverTransportHolder)
+	worker.serverTransport.Store(serverTransportHolder{transport})
+	go t.serverReadLoop(transport, worker)
+	time.AfterFunc(kReplaceServerTransportGracePeriod, func() {
+		_ = old.transport.Close()
+	})
+	return
+}
+
+func (t *WireGuardIndexTranslationTable) clientReadLoop(transport Transport, worker *wgitWorker) {
+	t.readLoop(transport, worker.clientReadChan, "client", t.BatchSize)
+}
+
+func (t *WireGuardIndexTranslationTable) serverReadLoop(transport Transport, worker *wgitWorker) {
+	t.readLoop(transport, worker.serverReadChan, "server", t.BatchSize)
+}
+
+// dedicatedServerReadLoop reads the transport allocated by ServerTransportAllocator until it is released.
+func (t *WireGuardIndexTranslationTable) dedicatedServerReadLoop(transport Transport, worker *wgitWorker) {
+	t.readLoop(transport, worker.serverReadChan, "server", kDedicatedServerTransportBatchSize)
+}
+
+func (t *WireGuardIndexTranslationTable) readLoop(transport Transport, readChan chan<- *packetBatch, side string, maxBatchSize int) {
+	batchSize := transportBatchSize(transport)
+	if batchSize > maxBatchSize {
+		batchSize = maxBatchSize
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	packets := make([]*Packet, batchSize)
 	for {
-		packet := t.obtainPacket()
-		err := t.ClientReadFromUDPFunc(t.clientConn, packet)
+		for i := range packets {
+			if packets[i] == nil {
+				packets[i] = t.obtainPacket()
+			}
+		}
+		n, err := readPackets(transport, packets)
 		if err != nil {
-			log.Printf("[error] failed to read from client conn: %s\n", err.Error())
-			t.recyclePacket(packet)
+			for _, packet := range packets {
+				packet.Reset()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				for _, packet := range packets {
+					t.recyclePacket(packet)
+				}
+				return
+			}
+			log.Printf("[error] failed to read from %s transport: %s\n", side, err.Error())
 			continue
 		}
-		t.clientReadChan <- packet
+		batch := t.obtainBatch()
+		for i := 0; i < n; i++ {
+			packets[i].transport = transport
+			batch.packets = append(batch.packets, packets[i])
+			packets[i] = nil
+		}
+		readChan <- batch
 	}
 }
 
-func (t *WireGuardIndexTranslationTable) serverReadLoop() {
+func (t *WireGuardIndexTranslationTable) writeLoop(worker *wgitWorker) {
 	for {
-		packet := t.obtainPacket()
-		err := t.ServerReadFromUDPFunc(t.serverConn, packet)
+		select {
+		case batch := <-worker.clientWriteChan:
+			t.writeBatch(batch, t.defaultClientTransport, "client")
+		case batch := <-worker.serverWriteChan:
+			t.writeBatch(batch, worker.serverTransport.Load().(serverTransportHolder).transport, "server")
+		}
+	}
+}
+
+// writeBatch writes the packets in batch to their transports, or defaultTransport if not specified.
+func (t *WireGuardIndexTranslationTable) writeBatch(batch *packetBatch, defaultTransport Transport, side string) {
+	packets := batch.packets
+	for len(packets) > 0 {
+		// write the consecutive packets to the same transport in a single call
+		n := 1
+		for n < len(packets) && packets[n].transport == packets[0].transport {
+			n++
+		}
+		transport := packets[0].transport
+		if transport == nil {
+			transport = defaultTransport
+		}
+		err := writePackets(transport, packets[:n])
 		if err != nil {
-			log.Printf("[error] failed to read from server conn: %s\n", err.Error())
-			t.recyclePacket(packet)
-			continue
+			log.Printf("[error] failed to write to %s transport dest=%s: %s\n", side, packets[0].Destination.String(), err.Error())
 		}
-		t.serverReadChan <- packet
+		packets = packets[n:]
+	}
+	for _, packet := range batch.packets {
+		t.recyclePacket(packet)
 	}
+	t.recycleBatch(batch)
 }
 
-func (t *WireGuardIndexTranslationTable) writeLoop() {
+// workerLoop handles the packets read by the worker.
+func (t *WireGuardIndexTranslationTable) workerLoop(worker *wgitWorker) {
 	for {
 		select {
-		case packet := <-t.clientWriteChan:
-			err := t.ClientWriteToUDPFunc(t.clientConn, packet)
-			if err != nil {
-				log.Printf("[error] failed to write to client conn dest=%s: %s\n", packet.Destination.String(), err.Error())
-			}
-			t.recyclePacket(packet)
-		case packet := <-t.serverWriteChan:
-			err := t.ServerWriteToUDPFunc(t.serverConn, packet)
-			if err != nil {
-				log.Printf("[error] failed to write to server conn dest=%s: %s\n", packet.Destination.String(), err.Error())
-			}
-			t.recyclePacket(packet)
+		case batch := <-worker.clientReadChan:
+			t.handlePacketBatch(batch, t.handleClientPacket, t.HandshakeLimiter, worker.serverWriteChan)
+		case batch := <-worker.serverReadChan:
+			t.handlePacketBatch(batch, t.handleServerPacket, nil, worker.clientWriteChan)
 		}
 	}
 }
 
+// mainLoop handles the events of the whole table.
 func (t *WireGuardIndexTranslationTable) mainLoop() {
 	for {
 		select {
-		case packet := <-t.clientReadChan:
-			if packet.MessageType() == device.MessageTransportType {
-				t.handleClientPacket(packet)
-			} else {
-				go t.handleClientPacket(packet)
-			}
-		case packet := <-t.serverReadChan:
-			if packet.MessageType() == device.MessageTransportType {
-				t.handleServerPacket(packet)
-			} else {
-				go t.handleServerPacket(packet)
-			}
 		case current := <-t.expireChan:
 			t.handlePeersExpireCheck(current)
+		case current := <-t.reportChan:
+			t.HandshakeLimiter.report(current)
+		case <-t.usageChan:
+			go t.persistTrafficUsage()
 		case newServerAddr := <-t.UpdateAllServerDestinationChan:
 			t.handleAllServerDestinationUpdate(newServerAddr)
 		}
 	}
 }
 
-func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
-	packetForwarded := false
+// handlePacketBatch handles the MessageTransport packets in the batch inline,
+// and sends the forwarded ones to the writeChan in a batch.
+// other packets are handled asynchronously since they are expensive, if they are admitted by the limiter.
+func (t *WireGuardIndexTranslationTable) handlePacketBatch(batch *packetBatch, handle func(packet *Packet) bool, limiter *HandshakeLimiter, writeChan chan<- *packetBatch) {
+	forwarded := t.obtainBatch()
+	for _, packet := range batch.packets {
+		if packet.MessageType() == device.MessageTransportType {
+			if handle(packet) {
+				forwarded.packets = append(forwarded.packets, packet)
+			}
+		} else {
+			if !limiter.admit(packet) {
+				t.recyclePacket(packet)
+				continue
+			}
+			go func(packet *Packet) {
+				packetForwarded := handle(packet)
+				limiter.done()
+				if packetForwarded {
+					single := t.obtainBatch()
+					single.packets = append(single.packets, packet)
+					writeChan <- single
+				}
+			}(packet)
+		}
+	}
+	t.recycleBatch(batch)
+	if len(forwarded.packets) == 0 {
+		t.recycleBatch(forwarded)
+		return
+	}
+	writeChan <- forwarded
+}
+
+// handleClientPacket translates the packet from client,
+// returns true if it should be forwarded to the server, otherwise it is recycled.
+func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) (packetForwarded bool) {
 	defer func() {
 		if !packetForwarded {
 			t.recyclePacket(packet)
@@ -253,13 +599,17 @@ func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 	var peer *Peer
 	switch packet.MessageType() {
 	case device.MessageInitiationType:
+		if !t.ClientSourceFilter.Allows(packet.Source.Addr()) {
+			err = errSourceDenied
+			break
+		}
 		var msg device.MessageInitiation
 		reader := bytes.NewReader(packet.Slice())
 		err = binary.Read(reader, binary.LittleEndian, &msg)
 		if err != nil {
 			break
 		}
-		peer, err = t.processClientMessageInitiation(packet.Source, &msg)
+		peer, err = t.processClientMessageInitiation(packet, &msg)
 		if err != nil {
 			break
 		}
@@ -273,6 +623,10 @@ func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 	default:
 		err = fmt.Errorf("unexcepted message type %d", packet.MessageType())
 	}
+	if errors.Is(err, errHandshakeRateLimited) || errors.Is(err, errTrafficLimited) || errors.Is(err, errSourceDenied) {
+		// dropped silently by the limiters
+		return
+	}
 	if err != nil {
 		log.Printf("[info] failed to handle type %d packet from client %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
 		return
@@ -295,13 +649,19 @@ func (t *WireGuardIndexTranslationTable) handleClientPacket(packet *Packet) {
 		return
 	}
 
+	peer.endpointLock.RLock()
 	packet.Destination = peer.serverDestination
-	t.serverWriteChan <- packet
+	peer.endpointLock.RUnlock()
+	packet.transport = peer.serverTransport
+	// the local address of the transport to clients, the one to servers is chosen by the kernel
+	packet.Local = netip.Addr{}
 	packetForwarded = true
+	return
 }
 
-func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
-	packetForwarded := false
+// handleServerPacket translates the packet from server,
+// returns true if it should be forwarded to the client, otherwise it is recycled.
+func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) (packetForwarded bool) {
 	defer func() {
 		if !packetForwarded {
 			t.recyclePacket(packet)
@@ -318,7 +678,7 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 		if err != nil {
 			break
 		}
-		peer, err = t.processServerMessageResponse(packet.Source, &msg)
+		peer, err = t.processServerMessageResponse(packet.Source, packet.transport, &msg)
 		if err != nil {
 			break
 		}
@@ -339,6 +699,9 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 	default:
 		err = fmt.Errorf("unexcepted message type %d", packet.MessageType())
 	}
+	if errors.Is(err, errTrafficLimited) {
+		return
+	}
 	if err != nil {
 		log.Printf("[info] failed to handle type %d packet from server %s: %s\n", packet.MessageType(), packet.Source.String(), err.Error())
 		return
@@ -375,14 +738,30 @@ func (t *WireGuardIndexTranslationTable) handleServerPacket(packet *Packet) {
 		packet.Flags |= PacketFlagObfuscateBeforeSend
 	}
 
+	peer.endpointLock.RLock()
 	packet.Destination = peer.clientDestination
-	t.clientWriteChan <- packet
+	packet.transport = peer.clientTransport
+	packet.Local = peer.clientLocal
+	peer.endpointLock.RUnlock()
 	packetForwarded = true
+	return
 }
 
-func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(src *net.UDPAddr, msg *device.MessageInitiation) (peer *Peer, err error) {
+func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(packet *Packet, msg *device.MessageInitiation) (peer *Peer, err error) {
 	// the MessageInitiation is the only message we can decrypt.
-	sp, err := t.ExtractPeerFunc(msg)
+	ctx, cancel := context.WithTimeout(context.Background(), kExtractPeerTimeout)
+	defer cancel()
+	request := &PeerRequest{
+		Source:   packet.Source,
+		Listener: transportLocalAddr(packet.transport),
+	}
+	if t.DecryptPeerFunc != nil {
+		request.ServerPublicKey, request.ClientPublicKey, err = t.DecryptPeerFunc(msg)
+		if err != nil {
+			return
+		}
+	}
+	sp, err := t.ExtractPeerFunc(ctx, msg, request)
 	if err != nil {
 		return
 	}
@@ -390,6 +769,19 @@ func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(src *net
 		log.Panicf("[fatal] ExtractPeerFunc must return a non-nil sp when err == nil\n")
 		return
 	}
+	if !t.HandshakeLimiter.allowPublicKey(*sp.ClientPublicKey) {
+		err = errHandshakeRateLimited
+		return
+	}
+	if !sp.sourceFilter.Allows(packet.Source.Addr()) {
+		err = fmt.Errorf("client %s is not allowed by allow_from or deny_from: %w", packet.Source.Addr().String(), errSourceDenied)
+		return
+	}
+	traffic := t.TrafficLimiter.account(*sp.ClientPublicKey, sp.RateLimit, sp.Quota)
+	if traffic.blocked(time.Now()) {
+		err = errTrafficLimited
+		return
+	}
 
 	peer = &Peer{}
 
@@ -399,26 +791,42 @@ func (t *WireGuardIndexTranslationTable) processClientMessageInitiation(src *net
 	peer.serverCookieGenerator.Init(sp.ClientPublicKey.NoisePublicKey)
 
 	peer.clientOriginIndex = msg.Sender
-	peer.clientDestination = src
+	peer.clientDestination = packet.Source
+	peer.clientTransport = packet.transport
+	peer.clientLocal = packet.Local
 
 	peer.serverDestination = sp.forwardToAddress
 	peer.clientSourceValidateLevel = sp.ClientSourceValidateLevel
+	peer.serverSourceValidateLevel = sp.ServerSourceValidateLevel
+	peer.traffic = traffic
+	peer.sourceFilter = sp.sourceFilter
+	peer.access = sp.access
 
-	peer.lastActive.Store(time.Now())
+	peer.touch(time.Now())
+
+	if t.ServerTransportAllocator != nil {
+		err = t.acquireServerTransport(peer)
+		if err != nil {
+			err = fmt.Errorf("failed to allocate transport to server: %w", err)
+			peer = nil
+			return
+		}
+	}
 
 	t.mapLock.Lock()
 	peer.clientProxyIndex = t.generateProxyIndexLocked(t.clientMap, peer.clientOriginIndex)
-	t.clientMap[peer.clientProxyIndex] = peer
+	t.clientMap.Store(peer.clientProxyIndex, peer)
+	t.expireWheel.Schedule(peer, peer.expireCheckTime(t.Timeout, time.Now()))
 	t.mapLock.Unlock()
 
 	log.Printf("[info] received message initiation from client, peer create stage #1: %s(idx:%08x->%08x) <=> %s\n",
-		peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-		peer.serverDestination.String())
+		peer.currentClientDestination().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+		peer.currentServerDestination().String())
 
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src *net.UDPAddr, msg *device.MessageResponse) (peer *Peer, err error) {
+func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src netip.AddrPort, transport Transport, msg *device.MessageResponse) (peer *Peer, err error) {
 	// we cannot decrypt the MessageResponse, but we need to handle the sender_index from server.
 	if msg.Receiver == 0 {
 		err = fmt.Errorf("received message hanndshake_response from server %s with impossible receiver_index=0", src.String())
@@ -432,14 +840,18 @@ func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src *net.U
 	defer t.mapLock.Unlock()
 
 	var ok bool
-	if peer, ok = t.clientMap[msg.Receiver]; ok {
-		peer.lastActive.Store(time.Now())
+	if peer, ok = t.clientMap.Load(msg.Receiver); ok {
+		peer.touch(time.Now())
 		peer.serverOriginIndex = msg.Sender
 		peer.serverProxyIndex = t.generateProxyIndexLocked(t.serverMap, peer.serverOriginIndex)
-		t.serverMap[peer.serverProxyIndex] = peer
+		t.serverMap.Store(peer.serverProxyIndex, peer)
 		log.Printf("[info] received message response from server, peer create stage #2: %s(idx:%08x->%08x) <=> %s(idx:%08x->%08x)\n",
-			peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-			peer.serverDestination.String(), peer.serverOriginIndex, peer.serverProxyIndex)
+			peer.currentClientDestination().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.currentServerDestination().String(), peer.serverOriginIndex, peer.serverProxyIndex)
+
+		if t.PeerEventFunc != nil {
+			t.PeerEventFunc(newPeerEvent(peer, transport))
+		}
 
 		go t.persistForwardTableCache()
 
@@ -450,16 +862,13 @@ func (t *WireGuardIndexTranslationTable) processServerMessageResponse(src *net.U
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) processServerMessageCookieReply(src *net.UDPAddr, msg *device.MessageCookieReply) (peer *Peer, err error) {
+func (t *WireGuardIndexTranslationTable) processServerMessageCookieReply(src netip.AddrPort, msg *device.MessageCookieReply) (peer *Peer, err error) {
 	if msg.Receiver == 0 {
 		err = fmt.Errorf("received message cookie_reply from server %s with impossible receiver_index=0", src.String())
 		return
 	}
 
-	var ok bool
-	t.mapLock.RLock()
-	peer, ok = t.clientMap[msg.Receiver]
-	t.mapLock.RUnlock()
+	peer, ok := t.clientMap.Load(msg.Receiver)
 
 	if !ok {
 		err = fmt.Errorf("no matched peer found for clientMap[%08x], referred by MessageCookieReply.Receiver from server %s", msg.Receiver, src.String())
@@ -490,17 +899,14 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 		return
 	}
 
-	var m map[uint32]*Peer
+	var m *peerIndexMap
 	if s2c {
 		m = t.clientMap
 	} else {
 		m = t.serverMap
 	}
 
-	var ok bool
-	t.mapLock.RLock()
-	peer, ok = m[receiverIndex]
-	t.mapLock.RUnlock()
+	peer, ok := m.Load(receiverIndex)
 
 	if !ok {
 		if s2c {
@@ -511,21 +917,28 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 		return
 	}
 
-	peer.lastActive.Store(time.Now())
+	// the limited packets neither keep the peer alive nor move its endpoints
+	now := time.Now()
+	if !peer.traffic.allow(packet.Length, s2c, now) {
+		err = errTrafficLimited
+		return
+	}
+	peer.touch(now)
 
 	if s2c {
 		// in case of udp out-of-order (seems not possible to happen)
 		if peer.IsServerReplied() {
-			ipChanged := !packet.Source.IP.Equal(peer.serverDestination.IP)
-			portChanged := packet.Source.Port != peer.serverDestination.Port
+			serverDestination := peer.currentServerDestination()
+			ipChanged := packet.Source.Addr() != serverDestination.Addr()
+			portChanged := packet.Source.Port() != serverDestination.Port()
 
 			switch peer.serverSourceValidateLevel {
 			case SourceValidateLevelIP:
 				if ipChanged {
 					err = fmt.Errorf("server IP mismatch (for client %s), expected %s, got %s",
-						peer.clientDestination,
-						peer.serverDestination.IP.String(),
-						packet.Source.IP.String())
+						peer.currentClientDestination(),
+						serverDestination.Addr().String(),
+						packet.Source.Addr().String())
 					return
 				}
 			case SourceValidateLevelDefault:
@@ -533,94 +946,185 @@ func (t *WireGuardIndexTranslationTable) processMessageTransport(packet *Packet,
 			case SourceValidateLevelIPAndPort:
 				if ipChanged || portChanged {
 					err = fmt.Errorf("server IP/port mismatch (for server %s), expected %s:%d, got %s:%d",
-						peer.clientDestination,
-						peer.serverDestination.IP.String(), peer.serverDestination.Port,
-						packet.Source.IP.String(), packet.Source.Port)
+						peer.currentClientDestination(),
+						serverDestination.Addr().String(), serverDestination.Port(),
+						packet.Source.Addr().String(), packet.Source.Port())
 					return
 				}
 			}
 			if ipChanged || portChanged {
-				log.Printf("[info] allowed server reply from another source: %s => %s\n", peer.clientDestination.String(), packet.Source.String())
+				log.Printf("[info] allowed server reply from another source: %s => %s\n", peer.currentClientDestination().String(), packet.Source.String())
 			}
 		}
 	} else {
-		ipChanged := !packet.Source.IP.Equal(peer.clientDestination.IP)
-		portChanged := packet.Source.Port != peer.clientDestination.Port
+		peer.endpointLock.RLock()
+		clientDestination := peer.clientDestination
+		clientTransport := peer.clientTransport
+		clientLocal := peer.clientLocal
+		serverDestination := peer.serverDestination
+		peer.endpointLock.RUnlock()
+
+		ipChanged := packet.Source.Addr() != clientDestination.Addr()
+		portChanged := packet.Source.Port() != clientDestination.Port()
 
 		switch peer.clientSourceValidateLevel {
 		case SourceValidateLevelIP:
 			if ipChanged {
 				err = fmt.Errorf("client IP mismatch (for server %s), expected %s, got %s",
-					peer.serverDestination,
-					peer.clientDestination.IP.String(),
-					packet.Source.IP.String())
+					serverDestination,
+					clientDestination.Addr().String(),
+					packet.Source.Addr().String())
 				return
 			}
 		case SourceValidateLevelIPAndPort:
 			if ipChanged || portChanged {
 				err = fmt.Errorf("client IP/port mismatch (for server %s), expected %s:%d, got %s:%d",
-					peer.serverDestination,
-					peer.clientDestination.IP.String(), peer.clientDestination.Port,
-					packet.Source.IP.String(), packet.Source.Port)
+					serverDestination,
+					clientDestination.Addr().String(), clientDestination.Port(),
+					packet.Source.Addr().String(), packet.Source.Port())
 				return
 			}
 		}
+		if ipChanged && !(t.ClientSourceFilter.Allows(packet.Source.Addr()) && peer.sourceFilter.Allows(packet.Source.Addr())) {
+			err = fmt.Errorf("client roaming (for server %s) from %s to %s is not allowed by allow_from or deny_from: %w",
+				serverDestination,
+				clientDestination.Addr().String(),
+				packet.Source.Addr().String(), errSourceDenied)
+			return
+		}
 		if ipChanged || portChanged {
-			log.Printf("[info] allowed client romaing: %s => %s\n", peer.clientDestination.String(), packet.Source.String())
+			log.Printf("[info] allowed client romaing: %s => %s\n", clientDestination.String(), packet.Source.String())
+		}
+		// the client may switch between ClientTransports (port hopping) or the local addresses
+		if ipChanged || portChanged || clientTransport != packet.transport || clientLocal != packet.Local {
+			peer.endpointLock.Lock()
 			peer.clientDestination = packet.Source
+			peer.clientTransport = packet.transport
+			peer.clientLocal = packet.Local
+			peer.endpointLock.Unlock()
 		}
 	}
+	return
+}
+
+// restoreCachedPeersLocked restores the access windows and source filters of the peers loaded from the cache,
+// and drops the ones no longer allowed by the config.
+func (t *WireGuardIndexTranslationTable) restoreCachedPeersLocked() {
+	var droppedClientIndexes, droppedServerIndexes []uint32
+	t.clientMap.Range(func(index uint32, peer *Peer) bool {
+		sp, err := t.RestorePeerFunc(&PeerRequest{
+			ServerPublicKey: peer.serverPublicKey,
+			ClientPublicKey: peer.clientPublicKey,
+			Source:          peer.clientDestination,
+		})
+		if err == nil && sp.forwardToAddress != peer.serverDestination {
+			err = fmt.Errorf("forwarded to %s in the config", sp.forwardToAddress)
+		}
+		if err != nil {
+			log.Printf("[info] drop cached peer %s (idx:%08x->%08x): %s\n",
+				peer.currentClientDestination().String(), peer.clientOriginIndex, peer.clientProxyIndex, err.Error())
+			droppedClientIndexes = append(droppedClientIndexes, peer.clientProxyIndex)
+			if peer.serverProxyIndex != 0 {
+				droppedServerIndexes = append(droppedServerIndexes, peer.serverProxyIndex)
+			}
+			return true
+		}
+		peer.access = sp.access
+		peer.sourceFilter = sp.sourceFilter
+		return true
+	})
+	t.clientMap.Delete(droppedClientIndexes...)
+	t.serverMap.Delete(droppedServerIndexes...)
+}
 
+// acquireServerTransport acquires a dedicated transport to the server for the peer before it is published.
+func (t *WireGuardIndexTranslationTable) acquireServerTransport(peer *Peer) (err error) {
+	transport, fresh, err := t.ServerTransportAllocator.Acquire(ServerTransportRequest{
+		ClientPublicKey:   peer.clientPublicKey,
+		ClientSource:      peer.clientDestination,
+		ServerDestination: peer.serverDestination,
+	})
+	if err != nil {
+		return
+	}
+	peer.serverTransport = transport
+	if fresh {
+		workers := t.workers.Load().([]*wgitWorker)
+		go t.dedicatedServerReadLoop(transport, workers[peer.clientOriginIndex%uint32(len(workers))])
+	}
 	return
 }
 
-func (t *WireGuardIndexTranslationTable) generateProxyIndexLocked(m map[uint32]*Peer, origin uint32) (proxy uint32) {
+func (t *WireGuardIndexTranslationTable) generateProxyIndexLocked(m *peerIndexMap, origin uint32) (proxy uint32) {
 	if !DebugAlwaysGenerateProxyIndex {
 		proxy = origin
 	}
 
 	// proxy index also cannot be 0, since the zero-value indicates the peer is not yet initialized
-	for _, ok := m[proxy]; ok || proxy == 0; {
+	for _, ok := m.Load(proxy); ok || proxy == 0; _, ok = m.Load(proxy) {
 		proxy = rand.Uint32()
 	}
 	return
 }
 
 func (t *WireGuardIndexTranslationTable) handlePeersExpireCheck(current time.Time) {
-	defer func() {
-		go t.persistForwardTableCache()
-	}()
-
 	t.mapLock.Lock()
 	defer t.mapLock.Unlock()
 
-	for _, peer := range t.clientMap {
-		if peer.lastActive.Load().(time.Time).Before(current.Add(-t.Timeout)) {
-			delete(t.clientMap, peer.clientProxyIndex)
-			delete(t.serverMap, peer.serverProxyIndex)
-			log.Printf("[info] expire peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)\n",
-				peer.clientDestination.String(), peer.clientOriginIndex, peer.clientProxyIndex,
-				peer.serverDestination.String(), peer.serverOriginIndex, peer.serverProxyIndex)
+	var expiredClientIndexes, expiredServerIndexes []uint32
+	t.expireWheel.Advance(current, func(peer *Peer) {
+		deadline := peer.lastActiveTime().Add(t.Timeout)
+		if !deadline.Before(current) && peer.access.Allows(current) {
+			// still active, check it again at the new deadline
+			t.expireWheel.Schedule(peer, peer.expireCheckTime(t.Timeout, current))
+			return
+		}
+		expiredClientIndexes = append(expiredClientIndexes, peer.clientProxyIndex)
+		if peer.serverProxyIndex != 0 {
+			expiredServerIndexes = append(expiredServerIndexes, peer.serverProxyIndex)
 		}
+		if peer.serverTransport != nil {
+			t.ServerTransportAllocator.Release(peer.serverTransport)
+		}
+		log.Printf("[info] expire peer %s (idx:%08x->%08x) <=> %s (idx:%08x->%08x)\n",
+			peer.currentClientDestination().String(), peer.clientOriginIndex, peer.clientProxyIndex,
+			peer.currentServerDestination().String(), peer.serverOriginIndex, peer.serverProxyIndex)
+	})
+	if len(expiredClientIndexes) == 0 {
+		return
 	}
+	t.clientMap.Delete(expiredClientIndexes...)
+	t.serverMap.Delete(expiredServerIndexes...)
+
+	go t.persistForwardTableCache()
 }
 
-func (t *WireGuardIndexTranslationTable) handleAllServerDestinationUpdate(addr *net.UDPAddr) {
+func (t *WireGuardIndexTranslationTable) handleAllServerDestinationUpdate(addr netip.AddrPort) {
+	var addrChanged bool
 	defer func() {
-		go t.persistForwardTableCache()
+		// the port hopping changes the port only, which is updated again on start, so it is not persisted
+		if addrChanged {
+			go t.persistForwardTableCache()
+		}
 	}()
 
 	t.mapLock.Lock()
 	defer t.mapLock.Unlock()
 
-	for _, peer := range t.clientMap {
+	t.clientMap.Range(func(index uint32, peer *Peer) bool {
+		peer.endpointLock.Lock()
+		if peer.serverDestination.Addr() != addr.Addr() {
+			addrChanged = true
+		}
 		peer.serverDestination = addr
-	}
+		peer.endpointLock.Unlock()
+		return true
+	})
 }
 
 func (t *WireGuardIndexTranslationTable) persistForwardTableCache() {
-	t.mapLock.RLock()
-	defer t.mapLock.RUnlock()
+	t.mapLock.Lock()
+	defer t.mapLock.Unlock()
 
 	err := t.CacheJar.SaveLocked(t.serverMap)
 	if err != nil {
@@ -628,6 +1132,13 @@ func (t *WireGuardIndexTranslationTable) persistForwardTableCache() {
 	}
 }
 
+func (t *WireGuardIndexTranslationTable) persistTrafficUsage() {
+	err := t.TrafficLimiter.Save()
+	if err != nil {
+		log.Printf("[error] failed to save traffic usage: %s\n", err)
+	}
+}
+
 func (t *WireGuardIndexTranslationTable) obtainPacket() *Packet {
 	return t.packetPool.Get().(*Packet)
 }
@@ -636,3 +1147,16 @@ func (t *WireGuardIndexTranslationTable) recyclePacket(packet *Packet) {
 	packet.Reset()
 	t.packetPool.Put(packet)
 }
+
+func (t *WireGuardIndexTranslationTable) obtainBatch() *packetBatch {
+	return t.batchPool.Get().(*packetBatch)
+}
+
+// recycleBatch recycles the batch itself, the packets in it are not recycled.
+func (t *WireGuardIndexTranslationTable) recycleBatch(batch *packetBatch) {
+	for i := range batch.packets {
+		batch.packets[i] = nil
+	}
+	batch.packets = batch.packets[:0]
+	t.batchPool.Put(batch)
+}
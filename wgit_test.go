@@ -0,0 +1,370 @@
+package mwgp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDatagram struct {
+	data []byte
+	addr netip.AddrPort
+}
+
+// testTransport is an in-memory Transport,
+// datagrams sent to readChan are read by the table, and the ones written by the table go to writeChan.
+type testTransport struct {
+	readChan  chan testDatagram
+	writeChan chan testDatagram
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestTransport() *testTransport {
+	return &testTransport{
+		readChan:  make(chan testDatagram, 16),
+		writeChan: make(chan testDatagram, 16),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (t *testTransport) ReadPacket(packet *Packet) (err error) {
+	select {
+	case d := <-t.readChan:
+		packet.Length = copy(packet.Data, d.data)
+		packet.Source = d.addr
+	case <-t.closeChan:
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (t *testTransport) WritePacket(packet *Packet) (err error) {
+	t.writeChan <- testDatagram{
+		data: append([]byte(nil), packet.Slice()...),
+		addr: packet.Destination,
+	}
+	return
+}
+
+func (t *testTransport) Close() (err error) {
+	t.closeOnce.Do(func() {
+		close(t.closeChan)
+	})
+	return
+}
+
+func (t *testTransport) expect(tb testing.TB, data []byte, addr netip.AddrPort) {
+	tb.Helper()
+	select {
+	case d := <-t.writeChan:
+		if !bytes.Equal(d.data, data) {
+			tb.Fatalf("datagram mismatch, type %d", data[0])
+		}
+		if d.addr != addr {
+			tb.Fatalf("destination mismatch, expected %s, got %s", addr, d.addr)
+		}
+	case <-time.After(time.Second):
+		tb.Fatalf("datagram type %d not forwarded", data[0])
+	}
+}
+
+func TestWireGuardIndexTranslationTable_Transport(t *testing.T) {
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	serverAddr := netip.MustParseAddrPort("192.0.2.2:51820")
+
+	var clientPublicKey NoisePublicKey
+	clientPublicKey.NoisePublicKey[0] = 1
+	sp := &ServerConfigPeer{
+		ClientPublicKey:  &clientPublicKey,
+		forwardToAddress: serverAddr,
+	}
+
+	clientTransport := newTestTransport()
+	serverTransport := newTestTransport()
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientTransports = []Transport{clientTransport}
+	table.ServerTransports = []Transport{serverTransport}
+	table.ExtractPeerFunc = func(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error) {
+		return sp, nil
+	}
+	events := make(chan *PeerEvent, 1)
+	table.PeerEventFunc = func(event *PeerEvent) {
+		events <- event
+	}
+	go func() {
+		_ = table.Serve()
+	}()
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation[0:], device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(initiation[4:], 0x11111111)
+	clientTransport.readChan <- testDatagram{data: initiation, addr: clientAddr}
+	serverTransport.expect(t, initiation, serverAddr)
+
+	response := make([]byte, device.MessageResponseSize)
+	binary.LittleEndian.PutUint32(response[0:], device.MessageResponseType)
+	binary.LittleEndian.PutUint32(response[4:], 0x22222222)
+	binary.LittleEndian.PutUint32(response[8:], 0x11111111)
+	serverTransport.readChan <- testDatagram{data: response, addr: serverAddr}
+	clientTransport.expect(t, response, clientAddr)
+
+	// the peer event is published on the peer create stage #2
+	event := <-events
+	if event.ClientPublicKey != clientPublicKey.Base64() || event.ClientEndpoint != clientAddr.String() || event.ServerEndpoint != serverAddr.String() {
+		t.Errorf("unexpected peer event %+v", event)
+	}
+
+	c2s := make([]byte, device.MessageTransportSize)
+	binary.LittleEndian.PutUint32(c2s[0:], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(c2s[4:], 0x22222222)
+	clientTransport.readChan <- testDatagram{data: c2s, addr: clientAddr}
+	serverTransport.expect(t, c2s, serverAddr)
+
+	s2c := make([]byte, device.MessageTransportSize)
+	binary.LittleEndian.PutUint32(s2c[0:], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(s2c[4:], 0x11111111)
+	serverTransport.readChan <- testDatagram{data: s2c, addr: serverAddr}
+	clientTransport.expect(t, s2c, clientAddr)
+
+	// the transport to servers can be replaced
+	newServerTransport := newTestTransport()
+	err := table.ReplaceServerTransport(newServerTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTransport.readChan <- testDatagram{data: c2s, addr: clientAddr}
+	newServerTransport.expect(t, c2s, serverAddr)
+}
+
+func TestWireGuardIndexTranslationTable_Workers(t *testing.T) {
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	serverAddr := netip.MustParseAddrPort("192.0.2.2:51820")
+
+	var clientPublicKey NoisePublicKey
+	clientPublicKey.NoisePublicKey[0] = 1
+	sp := &ServerConfigPeer{
+		ClientPublicKey:  &clientPublicKey,
+		forwardToAddress: serverAddr,
+	}
+
+	// ClientTransports[i] and ServerTransports[i] are handled by the worker i
+	clientTransports := []*testTransport{newTestTransport(), newTestTransport()}
+	serverTransports := []*testTransport{newTestTransport(), newTestTransport()}
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientTransports = []Transport{clientTransports[0], clientTransports[1]}
+	table.ServerTransports = []Transport{serverTransports[0], serverTransports[1]}
+	table.ExtractPeerFunc = func(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error) {
+		return sp, nil
+	}
+	go func() {
+		_ = table.Serve()
+	}()
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation[0:], device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(initiation[4:], 0x11111111)
+	clientTransports[0].readChan <- testDatagram{data: initiation, addr: clientAddr}
+	serverTransports[0].expect(t, initiation, serverAddr)
+
+	// the handshake state is shared, so the response can be handled by another worker
+	response := make([]byte, device.MessageResponseSize)
+	binary.LittleEndian.PutUint32(response[0:], device.MessageResponseType)
+	binary.LittleEndian.PutUint32(response[4:], 0x22222222)
+	binary.LittleEndian.PutUint32(response[8:], 0x11111111)
+	serverTransports[1].readChan <- testDatagram{data: response, addr: serverAddr}
+	clientTransports[0].expect(t, response, clientAddr)
+
+	// the client switches to the socket of worker 1
+	c2s := make([]byte, device.MessageTransportSize)
+	binary.LittleEndian.PutUint32(c2s[0:], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(c2s[4:], 0x22222222)
+	clientTransports[1].readChan <- testDatagram{data: c2s, addr: clientAddr}
+	serverTransports[1].expect(t, c2s, serverAddr)
+
+	s2c := make([]byte, device.MessageTransportSize)
+	binary.LittleEndian.PutUint32(s2c[0:], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(s2c[4:], 0x11111111)
+	serverTransports[0].readChan <- testDatagram{data: s2c, addr: serverAddr}
+	clientTransports[1].expect(t, s2c, clientAddr)
+
+	// the server address of mwgp-client is updated while the workers are forwarding
+	newServerAddr := netip.MustParseAddrPort("192.0.2.3:51820")
+	clientTransports[1].readChan <- testDatagram{data: c2s, addr: clientAddr}
+	table.UpdateAllServerDestinationChan <- newServerAddr
+	<-serverTransports[1].writeChan
+	// the second update is received after the first one is handled
+	table.UpdateAllServerDestinationChan <- newServerAddr
+	clientTransports[1].readChan <- testDatagram{data: c2s, addr: clientAddr}
+	serverTransports[1].expect(t, c2s, newServerAddr)
+
+	err := table.ReplaceServerTransport(newTestTransport())
+	if err == nil {
+		t.Errorf("expected error for ReplaceServerTransport with multiple workers")
+	}
+}
+
+func TestWireGuardIndexTranslationTable_RoamDuringResponse(t *testing.T) {
+	peer := &Peer{
+		clientDestination: netip.MustParseAddrPort("192.0.2.1:51820"),
+		clientProxyIndex:  0x11111111,
+		serverProxyIndex:  0x22222222,
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.clientMap.Store(peer.clientProxyIndex, peer)
+	table.serverMap.Store(peer.serverProxyIndex, peer)
+
+	// the client roams on a worker, while the MessageResponse is handled by another one
+	serverProxyIndex := peer.serverProxyIndex
+	start := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-start
+		packet := &Packet{Data: make([]byte, defaultMaxPacketSize), Length: device.MessageTransportSize}
+		packet.Data[0] = device.MessageTransportType
+		_ = packet.SetReceiverIndex(serverProxyIndex)
+		for i := 0; i < 1000; i++ {
+			packet.Source = netip.AddrPortFrom(netip.MustParseAddr("192.0.2.1"), uint16(10000+i))
+			_, err := table.processMessageTransport(packet, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	close(start)
+	for i := 0; i < 1000; i++ {
+		msg := &device.MessageResponse{Type: device.MessageResponseType, Sender: uint32(0x33330000 + i), Receiver: peer.clientProxyIndex}
+		_, err := table.processServerMessageResponse(netip.MustParseAddrPort("192.0.2.2:51820"), nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestWireGuardIndexTranslationTable_AddClientTransport(t *testing.T) {
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	serverAddr := netip.MustParseAddrPort("192.0.2.2:51820")
+
+	var clientPublicKey NoisePublicKey
+	clientPublicKey.NoisePublicKey[0] = 1
+	sp := &ServerConfigPeer{
+		ClientPublicKey:  &clientPublicKey,
+		forwardToAddress: serverAddr,
+	}
+
+	serverTransport := newTestTransport()
+	table := NewWireGuardIndexTranslationTable()
+	table.ClientTransports = []Transport{newTestTransport()}
+	table.ServerTransports = []Transport{serverTransport}
+	table.ExtractPeerFunc = func(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error) {
+		return sp, nil
+	}
+	go func() {
+		_ = table.Serve()
+	}()
+	for table.workers.Load() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a listener added after Serve() is read, and the replies leave from it
+	clientTransport := newTestTransport()
+	table.AddClientTransport(clientTransport)
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation[0:], device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(initiation[4:], 0x11111111)
+	clientTransport.readChan <- testDatagram{data: initiation, addr: clientAddr}
+	serverTransport.expect(t, initiation, serverAddr)
+
+	response := make([]byte, device.MessageResponseSize)
+	binary.LittleEndian.PutUint32(response[0:], device.MessageResponseType)
+	binary.LittleEndian.PutUint32(response[4:], 0x22222222)
+	binary.LittleEndian.PutUint32(response[8:], 0x11111111)
+	serverTransport.readChan <- testDatagram{data: response, addr: serverAddr}
+	clientTransport.expect(t, response, clientAddr)
+}
+
+type testServerTransportAllocator struct {
+	transports chan *testTransport
+	released   chan Transport
+}
+
+func (a *testServerTransportAllocator) Acquire(request ServerTransportRequest) (transport Transport, fresh bool, err error) {
+	t := newTestTransport()
+	a.transports <- t
+	return t, true, nil
+}
+
+func (a *testServerTransportAllocator) Release(transport Transport) {
+	a.released <- transport
+	_ = transport.Close()
+}
+
+func TestWireGuardIndexTranslationTable_DedicatedServerTransport(t *testing.T) {
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:51820")
+	serverAddr := netip.MustParseAddrPort("192.0.2.2:51820")
+
+	var clientPublicKey NoisePublicKey
+	clientPublicKey.NoisePublicKey[0] = 1
+	sp := &ServerConfigPeer{
+		ClientPublicKey:  &clientPublicKey,
+		forwardToAddress: serverAddr,
+	}
+
+	clientTransport := newTestTransport()
+	allocator := &testServerTransportAllocator{
+		transports: make(chan *testTransport, 1),
+		released:   make(chan Transport, 1),
+	}
+	table := NewWireGuardIndexTranslationTable()
+	table.Timeout = 100 * time.Millisecond
+	table.ClientTransports = []Transport{clientTransport}
+	table.ServerTransports = []Transport{newTestTransport()}
+	table.ServerTransportAllocator = allocator
+	table.ExtractPeerFunc = func(ctx context.Context, msg *device.MessageInitiation, request *PeerRequest) (fi *ServerConfigPeer, err error) {
+		return sp, nil
+	}
+	go func() {
+		_ = table.Serve()
+	}()
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation[0:], device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(initiation[4:], 0x11111111)
+	clientTransport.readChan <- testDatagram{data: initiation, addr: clientAddr}
+	serverTransport := <-allocator.transports
+	serverTransport.expect(t, initiation, serverAddr)
+
+	// the replies are read from the dedicated transport
+	response := make([]byte, device.MessageResponseSize)
+	binary.LittleEndian.PutUint32(response[0:], device.MessageResponseType)
+	binary.LittleEndian.PutUint32(response[4:], 0x22222222)
+	binary.LittleEndian.PutUint32(response[8:], 0x11111111)
+	serverTransport.readChan <- testDatagram{data: response, addr: serverAddr}
+	clientTransport.expect(t, response, clientAddr)
+
+	c2s := make([]byte, device.MessageTransportSize)
+	binary.LittleEndian.PutUint32(c2s[0:], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(c2s[4:], 0x22222222)
+	clientTransport.readChan <- testDatagram{data: c2s, addr: clientAddr}
+	serverTransport.expect(t, c2s, serverAddr)
+
+	// the dedicated transport is released with the peer
+	select {
+	case released := <-allocator.released:
+		if released != serverTransport {
+			t.Errorf("unexpected transport released")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("dedicated transport not released after the peer expired")
+	}
+}